@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package cbor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotCanonical is wrapped and returned by MarshalCanonical when the encoded
+// data does not follow the core deterministic encoding requirements of RFC
+// 8949 section 4.2.1.
+var ErrNotCanonical = errors.New("not core deterministic CBOR")
+
+// MarshalCanonical encodes v like Marshal and ensures that the result is core
+// deterministic (canonical) CBOR, as required for data which is signed.
+//
+// An Encoder with default options always produces core deterministic CBOR.
+// However, values implementing Marshaler or StreamMarshaler, such as
+// RawBytes, are written untransformed and may contain non-deterministic CBOR,
+// i.e. when they hold data which was decoded from a peer. In this case, an
+// error wrapping ErrNotCanonical is returned.
+func MarshalCanonical(v any) ([]byte, error) {
+	data, err := Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := checkCanonical(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotCanonical, err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: encoded more than one item, had extra %d bytes", ErrNotCanonical, len(rest))
+	}
+	return data, nil
+}
+
+// checkCanonical validates a single deterministically encoded item at the
+// start of data and returns the remaining data. Floats are not supported.
+func checkCanonical(data []byte) (rest []byte, err error) {
+	if len(data) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	highThreeBits, lowFiveBits := data[0]>>5, data[0]&fiveBitMask
+	arg, data, err := canonicalArg(lowFiveBits, data[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	switch highThreeBits {
+	case unsignedIntMajorType, negativeIntMajorType:
+		return data, nil
+
+	case byteStringMajorType, textStringMajorType:
+		if arg > uint64(len(data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return data[arg:], nil
+
+	case arrayMajorType:
+		for i := uint64(0); i < arg; i++ {
+			if data, err = checkCanonical(data); err != nil {
+				return nil, fmt.Errorf("array item %d: %w", i, err)
+			}
+		}
+		return data, nil
+
+	case mapMajorType:
+		var prevKey []byte
+		for i := uint64(0); i < arg; i++ {
+			rest, err := checkCanonical(data)
+			if err != nil {
+				return nil, fmt.Errorf("map key %d: %w", i, err)
+			}
+			key := data[:len(data)-len(rest)]
+			if i > 0 && bytes.Compare(prevKey, key) >= 0 {
+				return nil, fmt.Errorf("map key %d: keys not in bytewise lexical order or duplicated", i)
+			}
+			prevKey = key
+
+			if data, err = checkCanonical(rest); err != nil {
+				return nil, fmt.Errorf("map value %d: %w", i, err)
+			}
+		}
+		return data, nil
+
+	case tagMajorType:
+		return checkCanonical(data)
+
+	case simpleMajorType:
+		switch {
+		case lowFiveBits < oneByteAdditional:
+			return data, nil
+		case lowFiveBits == oneByteAdditional && arg >= 32:
+			return data, nil
+		default:
+			return nil, fmt.Errorf("unsupported or invalid simple value: %x", lowFiveBits)
+		}
+	}
+
+	panic("unreachable")
+}
+
+// canonicalArg decodes the argument of an item, ensuring that it uses the
+// shortest possible encoding.
+func canonicalArg(lowFiveBits byte, data []byte) (arg uint64, rest []byte, _ error) {
+	var size int
+	var lowerBound uint64
+	switch lowFiveBits {
+	case oneByteAdditional:
+		size, lowerBound = 1, uint64(oneByteAdditional)
+	case twoBytesAdditional:
+		size, lowerBound = 2, 1<<8
+	case fourBytesAdditional:
+		size, lowerBound = 4, 1<<16
+	case eightBytesAdditional:
+		size, lowerBound = 8, 1<<32
+	case indefiniteLength:
+		return 0, nil, fmt.Errorf("indefinite length items are not allowed")
+	default:
+		if lowFiveBits > eightBytesAdditional {
+			return 0, nil, fmt.Errorf("invalid additional info: %x", lowFiveBits)
+		}
+		return uint64(lowFiveBits), data, nil
+	}
+
+	if len(data) < size {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	arg = toU64(data[:size])
+	if arg < lowerBound {
+		return 0, nil, fmt.Errorf("argument %d is not encoded in its shortest form", arg)
+	}
+	return arg, data[size:], nil
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package cbor_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+func TestMarshalCanonical(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		input  any
+		expect []byte
+	}{
+		{name: "uint8 in uint64", input: uint64(24), expect: []byte{0x18, 0x18}},
+		{name: "uint16", input: 1000, expect: []byte{0x19, 0x03, 0xe8}},
+		{name: "uint32", input: 1000000, expect: []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}},
+		{name: "negative", input: int64(-1000), expect: []byte{0x39, 0x03, 0xe7}},
+		{
+			// RFC 8949 section 4.2.1
+			name: "map key order",
+			input: map[any]int{
+				false:       8,
+				[1]int{-1}:  7,
+				[1]int{100}: 6,
+				"aa":        5,
+				"z":         4,
+				-1:          3,
+				100:         2,
+				10:          1,
+			},
+			expect: []byte{
+				0xa8,
+				0x0a, 0x01,
+				0x18, 0x64, 0x02,
+				0x20, 0x03,
+				0x61, 0x7a, 0x04,
+				0x62, 0x61, 0x61, 0x05,
+				0x81, 0x18, 0x64, 0x06,
+				0x81, 0x20, 0x07,
+				0xf4, 0x08,
+			},
+		},
+		{
+			name:   "nested map",
+			input:  map[string]map[int]bool{"b": {2: true, 1: false}, "a": {}},
+			expect: []byte{0xa2, 0x61, 0x61, 0xa0, 0x61, 0x62, 0xa2, 0x01, 0xf4, 0x02, 0xf5},
+		},
+		{
+			name:   "canonical raw bytes",
+			input:  []cbor.RawBytes{{0xa2, 0x01, 0x02, 0x03, 0x04}},
+			expect: []byte{0x81, 0xa2, 0x01, 0x02, 0x03, 0x04},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := cbor.MarshalCanonical(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.expect) {
+				t.Errorf("expected % x, got % x", test.expect, got)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name  string
+		input cbor.RawBytes
+	}{
+		{name: "non-shortest int", input: cbor.RawBytes{0x18, 0x01}},
+		{name: "non-shortest length", input: cbor.RawBytes{0x59, 0x00, 0x01, 0x00}},
+		{name: "unsorted keys", input: cbor.RawBytes{0xa2, 0x02, 0x00, 0x01, 0x00}},
+		{name: "duplicate keys", input: cbor.RawBytes{0xa2, 0x01, 0x00, 0x01, 0x00}},
+		{name: "length-first key order", input: cbor.RawBytes{0xa2, 0x61, 0x7a, 0x00, 0x18, 0x64, 0x00}},
+		{name: "indefinite string", input: cbor.RawBytes{0x5f, 0x41, 0x01, 0xff}},
+		{name: "float", input: cbor.RawBytes{0xf9, 0x3c, 0x00}},
+		{name: "truncated", input: cbor.RawBytes{0x82, 0x01}},
+		{name: "multiple items", input: cbor.RawBytes{0x01, 0x02}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := cbor.MarshalCanonical(test.input); !errors.Is(err, cbor.ErrNotCanonical) {
+				t.Errorf("expected canonical error, got %v", err)
+			}
+		})
+	}
+}
+
+func FuzzMarshalCanonical(f *testing.F) {
+	f.Add([]byte{0xa2, 0x02, 0x00, 0x01, 0x00})
+	f.Add([]byte{0xa2, 0x61, 0x7a, 0x00, 0x18, 0x64, 0x00})
+	f.Add([]byte{0x83, 0x18, 0x01, 0x5f, 0x41, 0x01, 0xff, 0xc1, 0x1a, 0x00, 0x00, 0x00, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v any
+		if err := cbor.Unmarshal(data, &v); err != nil {
+			return
+		}
+		first, err := cbor.MarshalCanonical(v)
+		if err != nil {
+			return
+		}
+
+		// Re-encoding canonical data must not change it
+		var w any
+		if err := cbor.Unmarshal(first, &w); err != nil {
+			t.Fatalf("error unmarshaling canonical data % x: %v", first, err)
+		}
+		second, err := cbor.MarshalCanonical(w)
+		if err != nil {
+			t.Fatalf("error marshaling canonical data % x: %v", first, err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("canonical encoding is not idempotent: % x != % x", first, second)
+		}
+	})
+}
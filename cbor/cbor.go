@@ -22,6 +22,23 @@ import (
 // map (where each key-value pair counts as two items).
 const MaxArrayDecodeLength = 100_000
 
+// DefaultMaxDepth is the maximum nesting depth of arrays, maps, and tags that
+// a Decoder accepts when [DecoderOptions.MaxDepth] is zero.
+const DefaultMaxDepth = 64
+
+// ErrMaxDepth is returned when decoding an item nested more deeply than
+// [DecoderOptions.MaxDepth] allows.
+var ErrMaxDepth = errors.New("max nesting depth exceeded")
+
+// ErrMaxStringBytes is returned when decoding a byte or text string longer
+// than [DecoderOptions.MaxStringBytes] allows.
+var ErrMaxStringBytes = errors.New("byte/text string exceeds max size")
+
+// stringReadSize is the most memory allocated for a byte or text string ahead
+// of reading its contents, so that a string declaring a length larger than
+// its input does not allocate that length up front.
+const stringReadSize = 64 << 10
+
 // Major types (high 3 bits)
 const (
 	unsignedIntMajorType byte = 0x00
@@ -148,7 +165,9 @@ type StreamUnmarshaler interface {
 }
 
 // RawBytes encodes and decodes untransformed. When encoding, it must contain
-// valid CBOR.
+// valid CBOR. When decoding, it captures exactly one complete data item,
+// including any nested items, so that decoding may be deferred in the same
+// way as with [encoding/json.RawMessage].
 type RawBytes []byte
 
 // MarshalCBOR implements Marshaler.
@@ -218,15 +237,66 @@ func Unmarshal(data []byte, v any) error {
 	return nil
 }
 
+// UnmarshalStrict is like Unmarshal, but decodes with
+// [DecoderOptions.Strict] set, so that data which is not well-formed in its
+// shortest form is rejected along with any trailing data.
+func UnmarshalStrict(data []byte, v any) error {
+	buf := bytes.NewBuffer(data)
+	dec := NewDecoder(buf)
+	dec.Strict = true
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if buf.Len() > 0 {
+		return fmt.Errorf("unmarshal did not consume all data, had extra %d bytes: % x", buf.Len(), buf.Bytes())
+	}
+	return nil
+}
+
 // Decoder iteratively consumes a reader, decoding CBOR types.
 type Decoder struct {
-	r io.Reader
+	r   io.Reader
+	str stringReader // returned by DecodeReader to avoid allocating
 
 	DecoderOptions
 }
 
 // DecoderOptions configure advanced behavior of the Decoder.
-type DecoderOptions struct{}
+type DecoderOptions struct {
+	// Strict rejects integers, lengths, and tags which are not encoded in
+	// their shortest form, as well as maps with duplicate keys. By default,
+	// both are accepted, with the last duplicate key taking effect.
+	//
+	// A Decoder reads one item at a time from a stream, so it cannot reject
+	// trailing data. Use [UnmarshalStrict] to also require that an item is
+	// the only one in its input.
+	Strict bool
+
+	// MaxDepth limits how deeply arrays, maps, and tags may be nested, so
+	// that untrusted input cannot exhaust the stack of the recursive
+	// decoder. Decoding fails with [ErrMaxDepth] when it is exceeded. It
+	// defaults to [DefaultMaxDepth]. If negative, nesting is not limited.
+	//
+	// Nesting is counted across the decoders created by StreamUnmarshaler
+	// implementations from the options they are given.
+	MaxDepth int
+
+	// MaxStringBytes limits the length of byte and text strings, including
+	// all chunks of indefinite length strings, which are decoded into memory.
+	// Decoding fails with [ErrMaxStringBytes] when a string declares or
+	// reaches a longer length, before its contents are read. It defaults to
+	// one less than [MaxArrayDecodeLength]. If negative, length is not
+	// limited. Strings within [RawBytes] and values decoded with
+	// [Unmarshaler] are only limited when it is set.
+	//
+	// Regardless of the limit, strings are read incrementally, so memory is
+	// only allocated for the contents actually read. Strings read with
+	// [Decoder.DecodeReader] are never held in memory and are not limited.
+	MaxStringBytes int64
+
+	// depth is the nesting depth of the item being decoded
+	depth int
+}
 
 // NewDecoder returns a new Decoder. The [io.Reader] is not copied.
 func NewDecoder(r io.Reader) *Decoder { return &Decoder{r: r} }
@@ -285,6 +355,13 @@ func (d *Decoder) decodeRaw() ([]byte, error) {
 func (d *Decoder) decodeRawVal(highThreeBits, lowFiveBits byte, additional []byte) ([]byte, error) {
 	head := append([]byte{(highThreeBits << 5) | lowFiveBits}, additional...)
 
+	// Only strings, arrays, and maps may have an indefinite length and no
+	// item may use the reserved additional info values
+	if lowFiveBits > eightBytesAdditional &&
+		(lowFiveBits != indefiniteLength || highThreeBits < byteStringMajorType || highThreeBits > mapMajorType) {
+		return nil, fmt.Errorf("invalid additional info %x for major type %d", lowFiveBits, highThreeBits)
+	}
+
 	switch highThreeBits {
 	// Types containing only first byte and additional data
 	case unsignedIntMajorType, negativeIntMajorType, simpleMajorType:
@@ -292,19 +369,29 @@ func (d *Decoder) decodeRawVal(highThreeBits, lowFiveBits byte, additional []byt
 
 	// Types containing a well-known size without decoding nested types
 	case byteStringMajorType, textStringMajorType:
-		length, err := decodeLen(highThreeBits, lowFiveBits, additional)
+		if lowFiveBits == indefiniteLength {
+			return d.rawIndefinite(highThreeBits)
+		}
+		length, err := chunkLen(lowFiveBits, additional)
 		if err != nil {
 			return nil, err
 		}
-
-		b := make([]byte, length)
-		if _, err := io.ReadFull(d.r, b); err != nil {
+		if err := d.checkRawStringLen(length); err != nil {
 			return nil, err
 		}
-		return append(head, b...), nil
+		return d.readString(head, length)
 
 	// Types which must be fully decoded to know their size
 	case arrayMajorType, mapMajorType:
+		unnest, err := d.nest()
+		if err != nil {
+			return nil, err
+		}
+		defer unnest()
+
+		if lowFiveBits == indefiniteLength {
+			return d.rawIndefiniteItems(highThreeBits)
+		}
 		length, err := decodeLen(highThreeBits, lowFiveBits, additional)
 		if err != nil {
 			return nil, err
@@ -322,6 +409,12 @@ func (d *Decoder) decodeRawVal(highThreeBits, lowFiveBits byte, additional []byt
 
 	// Tag types are decoded like a simple value followed by another value
 	case tagMajorType:
+		unnest, err := d.nest()
+		if err != nil {
+			return nil, err
+		}
+		defer unnest()
+
 		wrapped, err := d.decodeRaw()
 		if err != nil {
 			return nil, err
@@ -332,6 +425,96 @@ func (d *Decoder) decodeRawVal(highThreeBits, lowFiveBits byte, additional []byt
 	panic("unreachable")
 }
 
+// rawIndefiniteItems reads the items of an indefinite length array or map up
+// to and including the break code.
+func (d *Decoder) rawIndefiniteItems(majorType byte) ([]byte, error) {
+	raw := []byte{majorType<<5 | indefiniteLength}
+	for i := 0; ; i++ {
+		highThreeBits, lowFiveBits, additional, err := d.typeInfo()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if highThreeBits<<5|lowFiveBits == breakCode {
+			if majorType == mapMajorType && i%2 != 0 {
+				return nil, fmt.Errorf("indefinite length map has a key without a value")
+			}
+			return append(raw, breakCode), nil
+		}
+		if i >= MaxArrayDecodeLength {
+			return nil, fmt.Errorf("array/map exceeds max size: %d", i)
+		}
+		b, err := d.decodeRawVal(highThreeBits, lowFiveBits, additional)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding array/map at item %d: %w", i, err)
+		}
+		raw = append(raw, b...)
+	}
+}
+
+// nest increments the nesting depth before decoding the contents of an
+// array, map, or tag, failing if it would exceed MaxDepth. The returned func
+// decrements it again.
+func (d *Decoder) nest() (unnest func(), _ error) {
+	limit := d.MaxDepth
+	if limit == 0 {
+		limit = DefaultMaxDepth
+	}
+	if limit > 0 && d.depth >= limit {
+		return nil, fmt.Errorf("%w: %d", ErrMaxDepth, limit)
+	}
+	d.depth++
+	return func() { d.depth-- }, nil
+}
+
+// stringLimit returns the max length of a byte or text string.
+func (d *Decoder) stringLimit() uint64 {
+	switch {
+	case d.MaxStringBytes == 0:
+		return MaxArrayDecodeLength - 1
+	case d.MaxStringBytes < 0:
+		return math.MaxInt
+	default:
+		return min(uint64(d.MaxStringBytes), math.MaxInt)
+	}
+}
+
+func (d *Decoder) checkStringLen(length uint64) error {
+	if length > d.stringLimit() {
+		return fmt.Errorf("%w: %d", ErrMaxStringBytes, length)
+	}
+	return nil
+}
+
+// checkRawStringLen is like checkStringLen for strings decoded as [RawBytes],
+// which are only limited when MaxStringBytes is set.
+func (d *Decoder) checkRawStringLen(length uint64) error {
+	if d.MaxStringBytes == 0 {
+		return nil
+	}
+	return d.checkStringLen(length)
+}
+
+// readString appends length bytes of string contents to dst. Memory is grown
+// as the contents are read, rather than allocated for the declared length.
+func (d *Decoder) readString(dst []byte, length uint64) ([]byte, error) {
+	for remaining := length; remaining > 0; {
+		n := int(min(remaining, stringReadSize))
+		dst = slices.Grow(dst, n)
+		if _, err := io.ReadFull(d.r, dst[len(dst):len(dst)+n]); err != nil {
+			if errors.Is(err, io.EOF) && remaining < length {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		dst = dst[:len(dst)+n]
+		remaining -= uint64(n)
+	}
+	return dst, nil
+}
+
 func decodeLen(highThreeBits, lowFiveBits byte, additional []byte) (int, error) {
 	length := toU64(additional)
 	if lowFiveBits < 0x18 {
@@ -402,6 +585,16 @@ func (d *Decoder) decodeVal(rv reflect.Value) error {
 		additional = []byte{lowFiveBits}
 	}
 
+	// Arrays, maps, and tags contain nested items
+	switch highThreeBits {
+	case arrayMajorType, mapMajorType, tagMajorType:
+		unnest, err := d.nest()
+		if err != nil {
+			return err
+		}
+		defer unnest()
+	}
+
 	// Dispatch decoding by major type
 	switch highThreeBits {
 	case unsignedIntMajorType:
@@ -412,9 +605,15 @@ func (d *Decoder) decodeVal(rv reflect.Value) error {
 		return d.decodeNegative(rv, additional)
 	case byteStringMajorType:
 		allocateInterface(rv, reflect.TypeOf([]byte(nil)))
+		if lowFiveBits == indefiniteLength {
+			return d.decodeIndefiniteByteSlice(rv, highThreeBits)
+		}
 		return d.decodeByteSlice(rv, additional)
 	case textStringMajorType:
 		allocateInterface(rv, reflect.TypeOf(""))
+		if lowFiveBits == indefiniteLength {
+			return d.decodeIndefiniteByteSlice(rv, highThreeBits)
+		}
 		return d.decodeByteSlice(rv, additional)
 	case arrayMajorType:
 		allocateInterface(rv, reflect.TypeOf([]any(nil)))
@@ -568,14 +767,25 @@ func overflowsInt(i64 int64, kind reflect.Kind) bool {
 
 func (d *Decoder) decodeByteSlice(rv reflect.Value, additional []byte) error {
 	length := toU64(additional)
-	if length > math.MaxInt || length >= MaxArrayDecodeLength {
-		return fmt.Errorf("byte array exceeds max size: %d", length)
+	if err := d.checkStringLen(length); err != nil {
+		return err
 	}
-	bs := make([]byte, length)
-	if _, err := io.ReadFull(d.r, bs); err != nil {
+	bs, err := d.readString(make([]byte, 0, min(length, stringReadSize)), length)
+	if err != nil {
 		return fmt.Errorf("error reading byte/text string: %w", err)
 	}
+	return setByteSlice(rv, bs)
+}
+
+func (d *Decoder) decodeIndefiniteByteSlice(rv reflect.Value, majorType byte) error {
+	bs, err := d.readIndefinite(majorType)
+	if err != nil {
+		return err
+	}
+	return setByteSlice(rv, bs)
+}
 
+func setByteSlice(rv reflect.Value, bs []byte) error {
 	// Note that setting cannot be done with reflect.Value.SetXXX because the
 	// reflect.Value may be an interface and its Elem() is not settable.
 	_, isBytes := rv.Interface().([]byte)
@@ -592,8 +802,8 @@ func (d *Decoder) decodeByteSlice(rv reflect.Value, additional []byte) error {
 	// Support fixed-size array
 	if rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8 {
 		// Ensure array is large enough
-		if rv.Len() < int(length) {
-			return fmt.Errorf("fixed-size array is too small: must be at least length %d", length)
+		if rv.Len() < len(bs) {
+			return fmt.Errorf("fixed-size array is too small: must be at least length %d", len(bs))
 		}
 
 		// Grow decoded byte slice as needed to fit inside fixed array
@@ -839,6 +1049,9 @@ func (d *Decoder) decodeMap(rv reflect.Value, additional []byte) error {
 		if !actualKeyType.Comparable() {
 			return fmt.Errorf("map key type (%s) not comparable", actualKeyType.String())
 		}
+		if d.Strict && rmap.MapIndex(newKey.Elem()).IsValid() {
+			return fmt.Errorf("duplicate map key %d: %v", i, newKey.Elem())
+		}
 		rmap.SetMapIndex(newKey.Elem(), newVal.Elem())
 	}
 
@@ -906,8 +1119,17 @@ func (d *Decoder) typeInfo() (highThreeBits, lowFiveBits byte, additional []byte
 	}
 
 	if _, err := io.ReadFull(d.r, additional); err != nil {
+		// The item has started, so running out of data is never a clean end
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
 		return 0, 0, nil, err
 	}
+	if d.Strict && !(highThreeBits == simpleMajorType && lowFiveBits != oneByteAdditional) {
+		if _, _, err := canonicalArg(lowFiveBits, additional); err != nil {
+			return 0, 0, nil, err
+		}
+	}
 	return highThreeBits, lowFiveBits, additional, nil
 }
 
@@ -1052,9 +1274,9 @@ func toU64(b []byte) uint64 {
 	if len(b) > 8 {
 		panic("too many bytes to decode into a uint64 without overflowing")
 	}
-	padded := make([]byte, 8-len(b))
-	padded = append(padded, b...)
-	return binary.BigEndian.Uint64(padded)
+	var padded [8]byte
+	copy(padded[8-len(b):], b)
+	return binary.BigEndian.Uint64(padded[:])
 }
 
 func u64Bytes(u64 uint64) []byte {
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"runtime"
 	"testing"
 
 	"github.com/fido-device-onboard/go-fdo"
@@ -1981,6 +1982,407 @@ func TestDecodeStream(t *testing.T) {
 	}
 }
 
+func TestDecodeStrict(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		input  []byte
+		expect any
+	}{
+		{name: "uint in one byte", input: []byte{0x18, 0x01}, expect: int64(1)},
+		{name: "uint in two bytes", input: []byte{0x19, 0x00, 0xff}, expect: int64(255)},
+		{name: "uint in four bytes", input: []byte{0x1a, 0x00, 0x00, 0xff, 0xff}, expect: int64(65535)},
+		{name: "uint in eight bytes", input: []byte{0x1b, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff}, expect: int64(4294967295)},
+		{name: "negative int", input: []byte{0x38, 0x00}, expect: int64(-1)},
+		{name: "byte string length", input: []byte{0x58, 0x01, 0xaa}, expect: []byte{0xaa}},
+		{name: "text string length", input: []byte{0x79, 0x00, 0x01, 0x61}, expect: "a"},
+		{name: "array length", input: []byte{0x98, 0x01, 0x01}, expect: []any{int64(1)}},
+		{name: "nested", input: []byte{0x81, 0x18, 0x01}, expect: []any{int64(1)}},
+		{name: "indefinite chunk length", input: []byte{0x5f, 0x58, 0x01, 0xaa, 0xff}, expect: []byte{0xaa}},
+		{name: "duplicate map key", input: []byte{0xa2, 0x01, 0x02, 0x01, 0x03}, expect: map[any]any{int64(1): int64(3)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var got any
+			if err := cbor.Unmarshal(test.input, &got); err != nil {
+				t.Fatalf("default decoding of % x: %v", test.input, err)
+			}
+			if !reflect.DeepEqual(got, test.expect) {
+				t.Errorf("default decoding of % x: expected %#v, got %#v", test.input, test.expect, got)
+			}
+
+			if err := cbor.UnmarshalStrict(test.input, &got); err == nil {
+				t.Errorf("strict decoding of % x: expected error", test.input)
+			}
+		})
+	}
+
+	t.Run("shortest form", func(t *testing.T) {
+		for _, input := range [][]byte{
+			{0x17},
+			{0x18, 0x18},
+			{0x19, 0x01, 0x00},
+			{0x1a, 0x00, 0x01, 0x00, 0x00},
+			{0x1b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00},
+			{0x58, 0x18, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+			{0xa2, 0x01, 0x02, 0x03, 0x04},
+			{0xf5},
+			{0xf6},
+		} {
+			var got any
+			if err := cbor.UnmarshalStrict(input, &got); err != nil {
+				t.Errorf("strict decoding of % x: %v", input, err)
+			}
+		}
+	})
+
+	t.Run("trailing data", func(t *testing.T) {
+		var got int
+		if err := cbor.UnmarshalStrict([]byte{0x01, 0x00}, &got); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("decoder", func(t *testing.T) {
+		dec := cbor.NewDecoder(bytes.NewReader([]byte{0x01, 0x18, 0x01}))
+		dec.Strict = true
+		var got int
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if err := dec.Decode(&got); err == nil {
+			t.Error("expected error decoding second item")
+		}
+	})
+
+	t.Run("typed map key", func(t *testing.T) {
+		var got map[string]int
+		input := []byte{0xa2, 0x61, 0x61, 0x01, 0x61, 0x61, 0x02}
+		if err := cbor.Unmarshal(input, &got); err != nil || got["a"] != 2 {
+			t.Fatalf("default decoding: got %v, %v", got, err)
+		}
+		if err := cbor.UnmarshalStrict(input, &got); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestDecodeMaxDepth(t *testing.T) {
+	// nested returns n levels of the given container heads around 0
+	nested := func(head []byte, n int) []byte {
+		b := append(bytes.Repeat(head, n), 0x00)
+		if head[0] == 0x9f {
+			b = append(b, bytes.Repeat([]byte{0xff}, n)...)
+		}
+		return b
+	}
+
+	for _, test := range []struct {
+		name    string
+		head    []byte
+		rawOnly bool // indefinite arrays are only decoded as raw bytes
+	}{
+		{name: "array", head: []byte{0x81}},
+		{name: "indefinite array", head: []byte{0x9f}, rawOnly: true},
+		{name: "map", head: []byte{0xa1, 0x01}},
+		{name: "tag", head: []byte{0xc1}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Pathological input must fail without exhausting the stack,
+			// whether decoded to values or raw bytes
+			decoders := map[string]func([]byte) error{
+				"raw": func(b []byte) error { var got cbor.RawBytes; return cbor.Unmarshal(b, &got) },
+			}
+			if !test.rawOnly {
+				decoders["any"] = func(b []byte) error { var got any; return cbor.Unmarshal(b, &got) }
+			}
+			for name, decode := range decoders {
+				if err := decode(nested(test.head, cbor.DefaultMaxDepth)); err != nil {
+					t.Fatalf("%s: expected %d levels to decode, got %v", name, cbor.DefaultMaxDepth, err)
+				}
+				if err := decode(nested(test.head, cbor.DefaultMaxDepth+1)); !errors.Is(err, cbor.ErrMaxDepth) {
+					t.Fatalf("%s: expected %d levels to exceed max depth, got %v", name, cbor.DefaultMaxDepth+1, err)
+				}
+				if err := decode(nested(test.head, 1_000_000)); !errors.Is(err, cbor.ErrMaxDepth) {
+					t.Fatalf("%s: expected max depth error, got %v", name, err)
+				}
+			}
+		})
+	}
+
+	t.Run("typed", func(t *testing.T) {
+		var got [][][]int
+		if err := cbor.Unmarshal([]byte{0x81, 0x81, 0x81, 0x01}, &got); err != nil || got[0][0][0] != 1 {
+			t.Fatalf("expected nested arrays to decode, got %v, %v", got, err)
+		}
+	})
+
+	t.Run("option", func(t *testing.T) {
+		input := nested([]byte{0x81}, 3)
+		for _, test := range []struct {
+			maxDepth int
+			ok       bool
+		}{
+			{maxDepth: 2},
+			{maxDepth: 3, ok: true},
+			{maxDepth: -1, ok: true},
+		} {
+			dec := cbor.NewDecoder(bytes.NewReader(input))
+			dec.MaxDepth = test.maxDepth
+			var got any
+			if err := dec.Decode(&got); test.ok && err != nil {
+				t.Errorf("max depth %d: %v", test.maxDepth, err)
+			} else if !test.ok && !errors.Is(err, cbor.ErrMaxDepth) {
+				t.Errorf("max depth %d: expected max depth error, got %v", test.maxDepth, err)
+			}
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		dec := cbor.NewDecoder(bytes.NewReader(nested([]byte{0x81}, 1000)))
+		dec.MaxDepth = -1
+		var got any
+		if err := dec.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("stream unmarshaler", func(t *testing.T) {
+		// [1([[0]])] is nested three deep, counting the outer array within
+		// the decoder created by Tag
+		input := []byte{0x81, 0xc1, 0x81, 0x81, 0x00}
+		for _, test := range []struct {
+			maxDepth int
+			ok       bool
+		}{
+			{maxDepth: 2},
+			{maxDepth: 3, ok: true},
+		} {
+			dec := cbor.NewDecoder(bytes.NewReader(input))
+			dec.MaxDepth = test.maxDepth
+			var got []*cbor.Tag[any]
+			if err := dec.Decode(&got); test.ok && err != nil {
+				t.Errorf("max depth %d: %v", test.maxDepth, err)
+			} else if !test.ok && !errors.Is(err, cbor.ErrMaxDepth) {
+				t.Errorf("max depth %d: expected max depth error, got %v", test.maxDepth, err)
+			}
+		}
+	})
+}
+
+func TestDecodeMaxStringBytes(t *testing.T) {
+	decode := func(input []byte, maxStringBytes int64, v any) error {
+		dec := cbor.NewDecoder(bytes.NewReader(input))
+		dec.MaxStringBytes = maxStringBytes
+		return dec.Decode(v)
+	}
+	// A byte string declaring a length of 2^62 bytes, followed by only three
+	absurd := []byte{0x5b, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 'a', 'b', 'c'}
+
+	t.Run("declared length", func(t *testing.T) {
+		text := append([]byte{0x7b}, absurd[1:]...)
+		for name, test := range map[string]struct {
+			input []byte
+			v     any
+		}{
+			"bytes": {input: absurd, v: new([]byte)},
+			"text":  {input: text, v: new(string)},
+			"any":   {input: absurd, v: new(any)},
+		} {
+			if err := decode(test.input, 0, test.v); !errors.Is(err, cbor.ErrMaxStringBytes) {
+				t.Errorf("%s: expected max string bytes error, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		// Without a limit, the declared length must still not be allocated
+		// before the input runs out
+		for name, v := range map[string]any{
+			"bytes":     new([]byte),
+			"raw bytes": new(cbor.RawBytes),
+		} {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			err := decode(absurd, -1, v)
+
+			runtime.ReadMemStats(&after)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s: expected unexpected EOF, got %v", name, err)
+			}
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+				t.Errorf("%s: decoding a 3 byte string allocated %d bytes", name, alloc)
+			}
+		}
+	})
+
+	t.Run("option", func(t *testing.T) {
+		for name, input := range map[string][]byte{
+			"definite":   {0x44, 0xde, 0xad, 0xbe, 0xef},
+			"indefinite": {0x5f, 0x42, 0xde, 0xad, 0x42, 0xbe, 0xef, 0xff},
+		} {
+			for _, test := range []struct {
+				maxStringBytes int64
+				ok             bool
+			}{
+				{maxStringBytes: 3},
+				{maxStringBytes: 4, ok: true},
+				{maxStringBytes: -1, ok: true},
+			} {
+				var got []byte
+				if err := decode(input, test.maxStringBytes, &got); test.ok && err != nil {
+					t.Errorf("%s: max string bytes %d: %v", name, test.maxStringBytes, err)
+				} else if test.ok && !bytes.Equal(got, []byte{0xde, 0xad, 0xbe, 0xef}) {
+					t.Errorf("%s: max string bytes %d: unexpected contents %x", name, test.maxStringBytes, got)
+				} else if !test.ok && !errors.Is(err, cbor.ErrMaxStringBytes) {
+					t.Errorf("%s: max string bytes %d: expected max string bytes error, got %v", name, test.maxStringBytes, err)
+				}
+			}
+		}
+	})
+
+	t.Run("large", func(t *testing.T) {
+		// Strings larger than the read size are read in several steps
+		data := bytes.Repeat([]byte("Hello World!\n"), 10_000)
+		input, err := cbor.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		if err := decode(input, -1, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("decoded %d bytes, expected %d", len(got), len(data))
+		}
+		var raw cbor.RawBytes
+		if err := decode(input, -1, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(raw, input) {
+			t.Fatalf("decoded %d raw bytes, expected %d", len(raw), len(input))
+		}
+	})
+
+	t.Run("raw bytes", func(t *testing.T) {
+		// Strings within RawBytes are not limited by default
+		data := bytes.Repeat([]byte("Hello World!\n"), 10_000)
+		for name, v := range map[string]any{
+			"bytes":  data,
+			"nested": []any{data, string(data)},
+		} {
+			input, err := cbor.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var raw cbor.RawBytes
+			if err := decode(input, 0, &raw); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(raw, input) {
+				t.Fatalf("%s: decoded %d raw bytes, expected %d", name, len(raw), len(input))
+			}
+			out, err := cbor.Marshal(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, input) {
+				t.Fatalf("%s: round trip encoded %d bytes, expected %d", name, len(out), len(input))
+			}
+		}
+
+		// Unless the limit is set explicitly
+		if err := decode(absurd, 1000, new(cbor.RawBytes)); !errors.Is(err, cbor.ErrMaxStringBytes) {
+			t.Errorf("expected max string bytes error, got %v", err)
+		}
+		if err := decode(absurd, 0, new(cbor.RawBytes)); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected unexpected EOF, got %v", err)
+		}
+	})
+}
+
+func TestRawBytes(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		input []byte
+	}{
+		{name: "int", input: []byte{0x19, 0x01, 0x00}},
+		{name: "nested arrays", input: []byte{0x83, 0x01, 0x82, 0x02, 0x81, 0x03, 0x80}},
+		{name: "map of arrays", input: []byte{0xa2, 0x01, 0x82, 0x02, 0x03, 0x61, 0x61, 0xa1, 0x04, 0x80}},
+		{name: "tag", input: []byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}},
+		{name: "nested tags", input: []byte{0xd8, 0x18, 0xc1, 0x82, 0x01, 0xd8, 0x20, 0x61, 0x61}},
+		{name: "tagged array", input: []byte{0xd9, 0xd9, 0xf7, 0x82, 0x01, 0xc1, 0x02}},
+		{name: "indefinite string", input: []byte{0x7f, 0x61, 0x61, 0x61, 0x62, 0xff}},
+		{name: "indefinite array", input: []byte{0x9f, 0x01, 0x9f, 0x02, 0xff, 0x82, 0x03, 0x04, 0xff}},
+		{name: "indefinite map", input: []byte{0xbf, 0x01, 0x9f, 0xff, 0x02, 0xbf, 0xff, 0xff}},
+		{name: "float", input: []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Exactly one item must be consumed from the stream
+			r := bytes.NewReader(append(bytes.Clone(test.input), 0x07))
+			dec := cbor.NewDecoder(r)
+			var raw cbor.RawBytes
+			if err := dec.Decode(&raw); err != nil {
+				t.Fatalf("error decoding % x: %v", test.input, err)
+			}
+			if !bytes.Equal(raw, test.input) {
+				t.Fatalf("decoding % x; got % x", test.input, []byte(raw))
+			}
+			var next int
+			if err := dec.Decode(&next); err != nil || next != 7 {
+				t.Fatalf("expected following item to decode as 7, got %d, %v", next, err)
+			}
+
+			got, err := cbor.Marshal(struct{ A, B cbor.RawBytes }{A: raw, B: raw})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expect := append(append([]byte{0x82}, test.input...), test.input...); !bytes.Equal(got, expect) {
+				t.Errorf("expected % x, got % x", expect, got)
+			}
+		})
+	}
+
+	t.Run("deferred decoding", func(t *testing.T) {
+		type message struct {
+			Name string
+			Body cbor.RawBytes
+		}
+		input := []byte{0x82, 0x63, 0x61, 0x6e, 0x79, 0xc1, 0x82, 0x01, 0x02}
+		var msg message
+		if err := cbor.Unmarshal(input, &msg); err != nil {
+			t.Fatal(err)
+		}
+		var body cbor.Tag[[]int]
+		if err := cbor.Unmarshal(msg.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Num != 1 || !reflect.DeepEqual(body.Val, []int{1, 2}) {
+			t.Errorf("expected 1([1, 2]), got %d(%v)", body.Num, body.Val)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, input := range [][]byte{
+			{0x82, 0x01},                   // truncated array
+			{0xc1},                         // tag without value
+			{0x9f, 0x01},                   // unterminated indefinite array
+			{0xbf, 0x01, 0xff},             // indefinite map missing a value
+			{0x1f},                         // indefinite int
+			{0xdf, 0x01},                   // indefinite tag
+			{0x1c},                         // reserved additional info
+			{0xff},                         // break outside of an indefinite item
+			{0x81, 0xff},                   // break in a definite array
+			{0x9f, 0x5f, 0x41, 0x01, 0xff}, // unterminated nested string
+		} {
+			var raw cbor.RawBytes
+			if err := cbor.Unmarshal(input, &raw); err == nil {
+				t.Errorf("decoding % x; expected error, got % x", input, []byte(raw))
+			}
+		}
+	})
+}
+
 func TestDecodeOVHeaderX5Chain(t *testing.T) {
 	body, err := hex.DecodeString("861865501C0282BE2AAF453396261E1EFD36E4EB818482055574686F73742E646F636B65722E696E7465726E616C820343191F90820C4101820443191F90653132333435830102815902D6308202D2308201BAA0030201020208446783815695490B300D06092A864886F70D01010B050030173115301306035504030C0C46646F456E746974792043413020170D3233303930353230343635365A180F32303533303333313230343635365A30173115301306035504030C0C46646F456E7469747920434130820122300D06092A864886F70D01010105000382010F003082010A0282010100C07036212B6A05C285F04B7485B3D0EFEA9EFB8C960F554FEB65A1914F9C1970D9288C762B6E37BA7FFE288C78078597DA6B6B10C4D61F6AFF1B6F85F45AE153E2084BEBE09F366ABD66D409DA6ED1BBD07375A1C506A2F1A5F1E90FD3689904FDCEC5D6CC81071A51C32A02FE2E15CD681884E97C1107FA579DC48F30E8FB25F6BA24187CCFF6CBFF9CD4B956D7747BC018C85BEA95CE9348CB5487B0608338E519E279B68062215940ECC996CEF7D24806E63D2FC69E7C06631A2C3305F6F32397F0AF7B15A876AF092256C5384A8353488FAB807969AFF06F1D0310CED956949AD67FC5AAC2A7A176AE2DB605CC1990E14C500267596799679BE3DC337BC70203010001A320301E300F0603551D130101FF040530030101FF300B0603551D0F040403020186300D06092A864886F70D01010B0500038201010067746B8BB923FCAFF0A96ECB2FDF0624508117C32DC3F8CD08BB22D34A2186F9C1FA419EDCC55AA00B46CBCDF4AF32538053551CA31DC9C7582DF75C11D478DEB76B3E6AE37CED3799ACEA0FAFB9890AE06D21F664A50B27051D95BF5E8E80CCCA141175D5FB9EE070AB0FBB595B842B7F27362CB38A3D1CC4F8A282444D06CA27D9110B6041B0F64A2D6F6C2DBCA02BC6E7F28AAD0967781707F2270BEB9910309BBF78E6B2B583BA62D9DE05191A3F144ABD8D5C471A680616FC00F5F802560D7282F036D3A4C6800C3FECF5E2C6C6C8F345A16AE4AC40C2425D0FD603959FBECFA644D1473373FF4DD14762229EE53E7306C7920D5A5567537CDCEEB63EFBF6")
 	if err != nil {
@@ -28,10 +28,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"iter"
-	"maps"
-	"slices"
-	"sort"
 	"strconv"
 	"unicode"
 
@@ -44,19 +40,14 @@ var (
 	ErrInvalidEncodingType = errors.New("cdn: invalid encoding type")
 )
 
-// FromCBOR re-encodes CBOR bytes as a diagnostic string.
+// FromCBOR re-encodes CBOR bytes as a diagnostic string, as rendered by
+// [cbor.Diagnose]. Invalid input fails with ErrInvalidInput.
 func FromCBOR(c []byte) (string, error) {
-	var v any
-	if err := cbor.Unmarshal(c, &v); err != nil {
+	s, err := cbor.Diagnose(c)
+	if err != nil {
 		return "", fmt.Errorf("%w: %w", ErrInvalidInput, err)
 	}
-
-	var b bytes.Buffer
-	if err := encodeValue(&b, v); err != nil {
-		return "", err
-	}
-
-	return b.String(), nil
+	return s, nil
 }
 
 // ToCBOR marshals a diagnostic string into CBOR.
@@ -74,78 +65,6 @@ func ToCBOR(s string) ([]byte, error) {
 	return cb, err
 }
 
-func encodeValue(b *bytes.Buffer, v any) error { //nolint:gocyclo
-	switch v := v.(type) {
-	default:
-		return ErrInvalidEncodingType
-
-	case []byte:
-		_, _ = b.WriteString("h'")
-		_, _ = hex.NewEncoder(b).Write(v)
-		_, _ = b.WriteString("'")
-
-	case string:
-		_, _ = fmt.Fprintf(b, "%q", v)
-
-	case bool:
-		_, _ = fmt.Fprintf(b, "%t", v)
-
-	case nil:
-		_, _ = b.WriteString("null")
-
-	case int64, uint64:
-		_, _ = fmt.Fprintf(b, "%d", v)
-
-	case []any:
-		_, _ = b.WriteString("[")
-		for index, element := range v {
-			if index > 0 {
-				_, _ = b.WriteString(", ")
-			}
-			if err := encodeValue(b, element); err != nil {
-				return err
-			}
-		}
-		_, _ = b.WriteString("]")
-
-	case map[any]any:
-		_, _ = b.WriteString("{")
-		c := 0
-		for key, value := range sortMap(v) {
-			if c > 0 {
-				_, _ = b.WriteString(", ")
-			}
-			if err := encodeValue(b, key); err != nil {
-				return err
-			}
-			_, _ = b.WriteString(": ")
-			if err := encodeValue(b, value); err != nil {
-				return err
-			}
-			c++
-
-		}
-		_, _ = b.WriteString("}")
-
-	case cbor.Tag[cbor.RawBytes]:
-		_, _ = b.WriteString(strconv.FormatUint(v.Num, 10))
-		_, _ = b.WriteString("(")
-
-		var val any
-		if err := cbor.Unmarshal(v.Val, &val); err != nil {
-			return err
-		}
-		if err := encodeValue(b, val); err != nil {
-			return err
-		}
-
-		_, _ = b.WriteString(")")
-	}
-
-	return nil
-
-}
-
 func decodeValue(rd io.Reader) (any, error) { //nolint:gocyclo
 	r := bufio.NewReader(rd)
 
@@ -494,32 +413,3 @@ func discardSpaces(r *bufio.Reader) error {
 	}
 
 }
-
-func sortMap(m map[any]any) iter.Seq2[any, any] {
-	keys := slices.Collect(maps.Keys(m))
-
-	cborKeys := make([][]byte, len(keys))
-	for i, k := range keys {
-		cborKey, err := cbor.Marshal(k)
-		if err != nil {
-			panic(err)
-		}
-		cborKeys[i] = cborKey
-	}
-
-	indices := make([]int, len(keys))
-	for i := range keys {
-		indices[i] = i
-	}
-	sort.Slice(indices, cbor.BytewiseLexicalSort(indices, cborKeys))
-
-	return func(yield func(k, v any) bool) {
-		for _, i := range indices {
-			k := keys[i]
-
-			if !yield(k, m[k]) {
-				return
-			}
-		}
-	}
-}
@@ -4,7 +4,9 @@
 package cdn_test
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"testing"
 
 	"github.com/fido-device-onboard/go-fdo/cbor/cdn"
@@ -467,3 +469,114 @@ func FuzzToCBOR(f *testing.F) {
 		_, _ = cdn.ToCBOR(data)
 	})
 }
+
+func TestFromCBORVectors(t *testing.T) {
+	// Examples from RFC 8949 Appendix A
+	for _, test := range []struct {
+		hex, want string
+	}{
+		{"00", "0"},
+		{"17", "23"},
+		{"1818", "24"},
+		{"1b000000e8d4a51000", "1000000000000"},
+		{"1bffffffffffffffff", "18446744073709551615"},
+		{"20", "-1"},
+		{"3903e7", "-1000"},
+		{"3bffffffffffffffff", "-18446744073709551616"},
+		{"c249010000000000000000", "2(h'010000000000000000')"},
+		{"f90000", "0.0"},
+		{"f98000", "-0.0"},
+		{"f93c00", "1.0"},
+		{"fb3ff199999999999a", "1.1"},
+		{"f93e00", "1.5"},
+		{"f97bff", "65504.0"},
+		{"fa47c35000", "100000.0"},
+		{"fb7e37e43c8800759c", "1.0e+300"},
+		{"f90001", "5.960464477539063e-08"},
+		{"f9c400", "-4.0"},
+		{"f97c00", "Infinity"},
+		{"f97e00", "NaN"},
+		{"fbfff0000000000000", "-Infinity"},
+		{"f4", "false"},
+		{"f5", "true"},
+		{"f6", "null"},
+		{"f7", "undefined"},
+		{"f0", "simple(16)"},
+		{"f8ff", "simple(255)"},
+		{"c074323031332d30332d32315432303a30343a30305a", `0("2013-03-21T20:04:00Z")`},
+		{"c11a514b67b0", "1(1363896240)"},
+		{"d74401020304", "23(h'01020304')"},
+		{"d818456449455446", "24(h'6449455446')"},
+		{"40", "h''"},
+		{"4401020304", "h'01020304'"},
+		{"60", `""`},
+		{"6449455446", `"IETF"`},
+		{"62225c", `"\"\\"`},
+		{"80", "[]"},
+		{"83010203", "[1, 2, 3]"},
+		{"8301820203820405", "[1, [2, 3], [4, 5]]"},
+		{"a0", "{}"},
+		{"a201020304", "{1: 2, 3: 4}"},
+		{"a26161016162820203", `{"a": 1, "b": [2, 3]}`},
+		{"826161a161626163", `["a", {"b": "c"}]`},
+		{"5f42010243030405ff", "(_ h'0102', h'030405')"},
+		{"7f657374726561646d696e67ff", `(_ "strea", "ming")`},
+		{"5fff", "''_"},
+		{"7fff", `""_`},
+		{"9fff", "[_ ]"},
+		{"9f018202039f0405ffff", "[_ 1, [2, 3], [_ 4, 5]]"},
+		{"9f01820203820405ff", "[_ 1, [2, 3], [4, 5]]"},
+		{"83018202039f0405ff", "[1, [2, 3], [_ 4, 5]]"},
+		{"bf61610161629f0203ffff", `{_ "a": 1, "b": [_ 2, 3]}`},
+		{"826161bf61626163ff", `["a", {_ "b": "c"}]`},
+		{"bf6346756ef563416d7421ff", `{_ "Fun": true, "Amt": -2}`},
+		// Keys are rendered in encoded order, including duplicates
+		{"a203040102", "{3: 4, 1: 2}"},
+		{"a201020103", "{1: 2, 1: 3}"},
+	} {
+		b, err := hex.DecodeString(test.hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := cdn.FromCBOR(b)
+		if err != nil {
+			t.Errorf("%s: %v", test.hex, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.hex, got, test.want)
+		}
+	}
+}
+
+func TestFromCBORInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",                 // empty
+		"0101",             // trailing data
+		"18",               // truncated argument
+		"4401",             // truncated byte string
+		"9f01",             // unterminated indefinite array
+		"ff",               // unexpected break
+		"8201ff",           // break in definite array
+		"1c",               // reserved additional info
+		"1f",               // indefinite integer
+		"5f01ff",           // integer chunk in byte string
+		"5f6161ff",         // text chunk in byte string
+		"5f5fffff",         // nested indefinite byte string
+		"f818",             // two byte encoding of simple value below 32
+		"5bffffffffffffff", // length exceeds input
+	} {
+		b, err := hex.DecodeString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := cdn.FromCBOR(b); !errors.Is(err, cdn.ErrInvalidInput) {
+			t.Errorf("%s: expected invalid input error, got %q (err=%v)", input, got, err)
+		}
+	}
+
+	// Deeply nested input is rejected rather than exhausting the stack
+	if _, err := cdn.FromCBOR(bytes.Repeat([]byte{0x81}, 100000)); !errors.Is(err, cdn.ErrInvalidInput) {
+		t.Errorf("expected nesting error, got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Diagnose renders a single encoded data item in the diagnostic notation of
+// RFC 8949 Section 8, e.g. for logging service info in a readable form.
+//
+// Items are rendered in the order they are encoded, so that, for example,
+// duplicate or unsorted map keys are visible. Byte strings are rendered as
+// h'...', indefinite length items are marked with an underscore, e.g.
+// [_ 1, 2] and (_ h'01', h'02'), and simple values other than false, true,
+// null, and undefined are rendered as simple(n). The input must contain
+// exactly one data item.
+func Diagnose(b []byte) (string, error) {
+	var s bytes.Buffer
+	r := bytes.NewReader(b)
+	if err := diagItem(&s, r, 0); err != nil {
+		return "", err
+	}
+	if r.Len() > 0 {
+		return "", fmt.Errorf("%d bytes of trailing data", r.Len())
+	}
+	return s.String(), nil
+}
+
+// maxDiagDepth limits the nesting of arrays, maps, and tags, so that malformed
+// input cannot exhaust the stack.
+const maxDiagDepth = 1000
+
+func diagItem(b *bytes.Buffer, r *bytes.Reader, depth int) error { //nolint:gocyclo
+	if depth > maxDiagDepth {
+		return fmt.Errorf("nesting exceeds %d levels", maxDiagDepth)
+	}
+	major, info, arg, err := diagHead(r)
+	if err != nil {
+		return err
+	}
+	indefinite := info == 31
+
+	switch major {
+	case 0:
+		_, _ = b.WriteString(strconv.FormatUint(arg, 10))
+
+	case 1:
+		if arg == math.MaxUint64 {
+			_, _ = b.WriteString("-18446744073709551616")
+		} else {
+			_, _ = fmt.Fprintf(b, "-%d", arg+1)
+		}
+
+	case 2, 3:
+		if !indefinite {
+			return diagString(b, r, major, arg)
+		}
+		if diagBreak(r) {
+			if major == 2 {
+				_, _ = b.WriteString("''_")
+			} else {
+				_, _ = b.WriteString(`""_`)
+			}
+			return nil
+		}
+		_, _ = b.WriteString("(_ ")
+		for i := 0; !diagBreak(r); i++ {
+			chunkMajor, chunkInfo, chunkLen, err := diagHead(r)
+			if err != nil {
+				return err
+			}
+			if chunkMajor != major || chunkInfo == 31 {
+				return fmt.Errorf("invalid chunk of indefinite length string")
+			}
+			if i > 0 {
+				_, _ = b.WriteString(", ")
+			}
+			if err := diagString(b, r, major, chunkLen); err != nil {
+				return err
+			}
+		}
+		_, _ = b.WriteString(")")
+
+	case 4, 5:
+		open, closing := "[", "]"
+		if major == 5 {
+			open, closing = "{", "}"
+		}
+		_, _ = b.WriteString(open)
+		if indefinite {
+			_, _ = b.WriteString("_ ")
+		}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && diagBreak(r) {
+				break
+			}
+			if i > 0 {
+				_, _ = b.WriteString(", ")
+			}
+			if err := diagItem(b, r, depth+1); err != nil {
+				return err
+			}
+			if major == 5 {
+				_, _ = b.WriteString(": ")
+				if err := diagItem(b, r, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		_, _ = b.WriteString(closing)
+
+	case 6:
+		_, _ = fmt.Fprintf(b, "%d(", arg)
+		if err := diagItem(b, r, depth+1); err != nil {
+			return err
+		}
+		_, _ = b.WriteString(")")
+
+	case 7:
+		return diagSimple(b, info, arg)
+	}
+
+	return nil
+}
+
+// diagHead reads the initial byte and argument of a data item. For floats,
+// the argument is the raw bits.
+func diagHead(r *bytes.Reader) (major, info byte, arg uint64, _ error) {
+	ib, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	major, info = ib>>5, ib&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		buf := make([]byte, 1<<(info-24))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, 0, 0, io.ErrUnexpectedEOF
+		}
+		for _, c := range buf {
+			arg = arg<<8 | uint64(c)
+		}
+		return major, info, arg, nil
+	case info == 31 && (major >= 2 && major <= 5 || major == 7):
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("invalid additional info %d for major type %d", info, major)
+	}
+}
+
+// diagBreak consumes the next byte if it is a break stop code, ending an
+// indefinite length item.
+func diagBreak(r *bytes.Reader) bool {
+	c, err := r.ReadByte()
+	if err != nil {
+		return false
+	}
+	if c != 0xff {
+		_ = r.UnreadByte()
+	}
+	return c == 0xff
+}
+
+func diagString(b *bytes.Buffer, r *bytes.Reader, major byte, length uint64) error {
+	if length > uint64(r.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, length)
+	_, _ = r.Read(buf)
+	if major == 2 {
+		_, _ = b.WriteString("h'")
+		_, _ = hex.NewEncoder(b).Write(buf)
+		_, _ = b.WriteString("'")
+		return nil
+	}
+	_, _ = fmt.Fprintf(b, "%q", buf)
+	return nil
+}
+
+func diagSimple(b *bytes.Buffer, info byte, arg uint64) error {
+	switch info {
+	case 20:
+		_, _ = b.WriteString("false")
+	case 21:
+		_, _ = b.WriteString("true")
+	case 22:
+		_, _ = b.WriteString("null")
+	case 23:
+		_, _ = b.WriteString("undefined")
+	case 24:
+		if arg < 32 {
+			return fmt.Errorf("invalid two byte encoding of simple value %d", arg)
+		}
+		_, _ = fmt.Fprintf(b, "simple(%d)", arg)
+	case 25:
+		diagFloat(b, halfToFloat64(uint16(arg)))
+	case 26:
+		diagFloat(b, float64(math.Float32frombits(uint32(arg))))
+	case 27:
+		diagFloat(b, math.Float64frombits(arg))
+	case 31:
+		return fmt.Errorf("unexpected break")
+	default:
+		_, _ = fmt.Fprintf(b, "simple(%d)", info)
+	}
+	return nil
+}
+
+func diagFloat(b *bytes.Buffer, f float64) {
+	switch {
+	case math.IsNaN(f):
+		_, _ = b.WriteString("NaN")
+	case math.IsInf(f, 1):
+		_, _ = b.WriteString("Infinity")
+	case math.IsInf(f, -1):
+		_, _ = b.WriteString("-Infinity")
+	default:
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		// Always include a fraction, so that floats are distinct from ints
+		if mant, exp, ok := strings.Cut(s, "e"); !strings.Contains(mant, ".") {
+			s = mant + ".0"
+			if ok {
+				s += "e" + exp
+			}
+		}
+		_, _ = b.WriteString(s)
+	}
+}
+
+// halfToFloat64 converts an IEEE 754 half precision float.
+func halfToFloat64(h uint16) float64 {
+	sign, exp, frac := h>>15, int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 31:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if sign != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package cbor_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+func TestDiagnose(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		v    any
+		want string
+	}{
+		{name: "service info", v: []any{"fdo.upload:data", []byte{0xde, 0xad}}, want: `["fdo.upload:data", h'dead']`},
+		{name: "map", v: map[string]int{"a": 1, "b": -2}, want: `{"a": 1, "b": -2}`},
+		{name: "tag", v: cbor.Tag[[]byte]{Num: 2, Val: []byte{0x01}}, want: "2(h'01')"},
+		{name: "simple", v: []any{true, nil}, want: "[true, null]"},
+	} {
+		b, err := cbor.Marshal(test.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := cbor.Diagnose(b); err != nil || got != test.want {
+			t.Errorf("%s: expected %s, got %s (err=%v)", test.name, test.want, got, err)
+		}
+	}
+
+	// Indefinite length items
+	for input, want := range map[string]string{
+		"5f42010243030405ff": "(_ h'0102', h'030405')",
+		"9f0102ff":           "[_ 1, 2]",
+		"bf6161f5ff":         `{_ "a": true}`,
+	} {
+		b, err := hex.DecodeString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := cbor.Diagnose(b); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s (err=%v)", input, want, got, err)
+		}
+	}
+
+	for _, input := range []string{"", "0101", "4401", "9f01"} {
+		b, err := hex.DecodeString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := cbor.Diagnose(b); err == nil {
+			t.Errorf("%s: expected error, got %s", input, got)
+		}
+	}
+}
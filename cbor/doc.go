@@ -7,7 +7,8 @@ Binary Object Representation (CBOR).
 
 Not supported:
 
-  - Indefinite length arrays, maps, byte strings, or text strings
+  - Indefinite length arrays or maps
+  - Encoding indefinite length byte strings or text strings
   - Simple values other than bool, null, and undefined
   - Numbers greater than 64 bits
   - Decoding structs with more than one omittable field
@@ -19,6 +20,12 @@ Not supported:
 However, the Marshaler/Unmarshaler interfaces allow any determinate sized
 CBOR item to be encoded to/from any Go type.
 
+Indefinite length byte and text strings are decoded like their definite length
+counterparts. To avoid buffering large strings, [Decoder.DecodeReader] reads
+their contents one chunk at a time.
+
+[Diagnose] renders encoded data in diagnostic notation for debugging.
+
 Specifically, >1 omittable struct fields (i.e. `omitempty`) is not supported,
 because handling this case is not generally solvable and depends on the
 specification of the API being implemented.
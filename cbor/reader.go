@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package cbor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Indefinite length strings (RFC 8949 section 3.2.3)
+const (
+	indefiniteLength byte = 0x1f
+	breakCode        byte = 0xff
+)
+
+// DecodeReader ensures the next type to decode is a text or byte string and
+// returns a reader over its contents. Indefinite length strings are read one
+// chunk at a time, so the contents are never held in memory as a whole and
+// the length of the string is not limited by MaxArrayDecodeLength.
+//
+// The returned reader must be read until it returns io.EOF before the Decoder
+// is used again. If the underlying reader ends before the end of the string,
+// io.ErrUnexpectedEOF is returned.
+//
+// If the next value is the undefined or null simple value, err will wrap
+// ErrNullOrUndefined.
+func (d *Decoder) DecodeReader() (io.Reader, error) {
+	highThreeBits, lowFiveBits, additional, err := d.typeInfo()
+	if err != nil {
+		return nil, err
+	}
+	if highThreeBits == simpleMajorType && (lowFiveBits == undefinedVal || lowFiveBits == nullVal) {
+		return nil, fmt.Errorf("unexpected type: %x: %w", highThreeBits, ErrNullOrUndefined)
+	}
+	if highThreeBits != byteStringMajorType && highThreeBits != textStringMajorType {
+		return nil, fmt.Errorf("unexpected type: %x", highThreeBits)
+	}
+	if lowFiveBits == indefiniteLength {
+		d.str = stringReader{r: d, majorType: highThreeBits}
+		return &d.str, nil
+	}
+	length, err := chunkLen(lowFiveBits, additional)
+	if err != nil {
+		return nil, err
+	}
+	d.str = stringReader{r: d, majorType: highThreeBits, remaining: length, last: true}
+	return &d.str, nil
+}
+
+// chunkLen returns the length of a definite length string.
+func chunkLen(lowFiveBits byte, additional []byte) (uint64, error) {
+	if lowFiveBits < oneByteAdditional {
+		return uint64(lowFiveBits), nil
+	}
+	if lowFiveBits > eightBytesAdditional {
+		return 0, fmt.Errorf("invalid additional info for string: %x", lowFiveBits)
+	}
+	return toU64(additional), nil
+}
+
+// stringReader reads the contents of a definite or indefinite length string.
+// For indefinite length strings, each chunk header is consumed when the
+// previous chunk has been fully read.
+type stringReader struct {
+	r         *Decoder
+	majorType byte
+
+	remaining uint64 // bytes left in the current chunk
+	last      bool   // no chunks follow the current one
+}
+
+func (s *stringReader) Read(p []byte) (int, error) {
+	for s.remaining == 0 {
+		if s.last {
+			return 0, io.EOF
+		}
+		if err := s.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.r.Read(p)
+	s.remaining -= uint64(n)
+	if errors.Is(err, io.EOF) {
+		err = nil
+		if s.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (s *stringReader) nextChunk() error {
+	highThreeBits, lowFiveBits, additional, err := s.r.typeInfo()
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	if highThreeBits<<5|lowFiveBits == breakCode {
+		s.last = true
+		return nil
+	}
+	if highThreeBits != s.majorType || lowFiveBits == indefiniteLength {
+		return fmt.Errorf("invalid chunk of indefinite length string: major type %x, additional info %x",
+			highThreeBits, lowFiveBits)
+	}
+	s.remaining, err = chunkLen(lowFiveBits, additional)
+	return err
+}
+
+// readIndefinite reads the contents of an indefinite length string whose
+// initial byte has already been consumed.
+func (d *Decoder) readIndefinite(majorType byte) ([]byte, error) {
+	var r io.Reader = &stringReader{r: d, majorType: majorType}
+	limit := d.stringLimit()
+	if limit < math.MaxInt64 {
+		r = io.LimitReader(r, int64(limit)+1)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading byte/text string: %w", err)
+	}
+	if err := d.checkStringLen(uint64(len(b))); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// rawIndefinite reads the raw encoding of an indefinite length string whose
+// initial byte has already been consumed, including the break code.
+func (d *Decoder) rawIndefinite(majorType byte) ([]byte, error) {
+	raw := []byte{majorType<<5 | indefiniteLength}
+	for {
+		highThreeBits, lowFiveBits, additional, err := d.typeInfo()
+		if err != nil {
+			return nil, err
+		}
+		if highThreeBits<<5|lowFiveBits == breakCode {
+			return append(raw, breakCode), nil
+		}
+		if highThreeBits != majorType || lowFiveBits == indefiniteLength {
+			return nil, fmt.Errorf("invalid chunk of indefinite length string: major type %x, additional info %x",
+				highThreeBits, lowFiveBits)
+		}
+		length, err := chunkLen(lowFiveBits, additional)
+		if err != nil {
+			return nil, err
+		}
+		if length > math.MaxInt || uint64(len(raw)) > math.MaxInt-length {
+			return nil, fmt.Errorf("%w: %d", ErrMaxStringBytes, length)
+		}
+		if err := d.checkRawStringLen(uint64(len(raw)) + length); err != nil {
+			return nil, err
+		}
+		raw = append(raw, highThreeBits<<5|lowFiveBits)
+		raw = append(raw, additional...)
+		if raw, err = d.readString(raw, length); err != nil {
+			return nil, err
+		}
+	}
+}
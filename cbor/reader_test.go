@@ -0,0 +1,241 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package cbor_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+func TestDecodeReader(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		input  []byte
+		expect []byte
+	}{
+		{name: "empty", input: []byte{0x40}, expect: []byte{}},
+		{name: "definite", input: []byte{0x44, 0x01, 0x02, 0x03, 0x04}, expect: []byte{0x01, 0x02, 0x03, 0x04}},
+		{name: "text", input: []byte{0x64, 0x49, 0x45, 0x54, 0x46}, expect: []byte("IETF")},
+		{name: "indefinite empty", input: []byte{0x5f, 0xff}, expect: []byte{}},
+		{name: "indefinite empty chunks", input: []byte{0x5f, 0x40, 0x40, 0xff}, expect: []byte{}},
+		{
+			name:   "indefinite",
+			input:  []byte{0x5f, 0x42, 0x01, 0x02, 0x43, 0x03, 0x04, 0x05, 0xff},
+			expect: []byte{0x01, 0x02, 0x03, 0x04, 0x05},
+		},
+		{
+			name:   "indefinite text",
+			input:  []byte{0x7f, 0x65, 0x73, 0x74, 0x72, 0x65, 0x61, 0x64, 0x6d, 0x69, 0x6e, 0x67, 0xff},
+			expect: []byte("streaming"),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for name, wrap := range map[string]func(io.Reader) io.Reader{
+				"whole":    func(r io.Reader) io.Reader { return r },
+				"one byte": iotest.OneByteReader,
+				"half":     iotest.HalfReader,
+				"eof":      iotest.DataErrReader,
+			} {
+				// Trailing data must not be consumed
+				input := append(bytes.Clone(test.input), 0xf6)
+				dec := cbor.NewDecoder(wrap(bytes.NewReader(input)))
+				r, err := dec.DecodeReader()
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				got, err := io.ReadAll(iotest.OneByteReader(r))
+				if err != nil {
+					t.Fatalf("%s: error reading % x: %v", name, test.input, err)
+				}
+				if !bytes.Equal(got, test.expect) {
+					t.Errorf("%s: reading % x; expected % x, got % x", name, test.input, test.expect, got)
+				}
+
+				var null *int
+				if err := dec.Decode(&null); err != nil {
+					t.Fatalf("%s: error decoding trailing value: %v", name, err)
+				}
+			}
+		})
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		for _, input := range [][]byte{
+			{0x44, 0x01, 0x02},
+			{0x5f, 0x42, 0x01},
+			{0x5f, 0x42, 0x01, 0x02},
+			{0x5f, 0x58},
+		} {
+			r, err := cbor.NewDecoder(bytes.NewReader(input)).DecodeReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("reading % x; expected unexpected EOF, got %v", input, err)
+			}
+		}
+		if _, err := cbor.NewDecoder(bytes.NewReader([]byte{0x59, 0x01})).DecodeReader(); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected unexpected EOF for truncated header, got %v", err)
+		}
+	})
+
+	t.Run("invalid chunk", func(t *testing.T) {
+		for _, input := range [][]byte{
+			{0x5f, 0x61, 0x61, 0xff},       // text chunk in byte string
+			{0x5f, 0x5f, 0x41, 0x01, 0xff}, // nested indefinite string
+			{0x5f, 0x01, 0xff},             // integer chunk
+		} {
+			r, err := cbor.NewDecoder(bytes.NewReader(input)).DecodeReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Errorf("reading % x; expected error", input)
+			}
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		if _, err := cbor.NewDecoder(bytes.NewReader([]byte{0x01})).DecodeReader(); err == nil {
+			t.Error("expected error")
+		}
+		if _, err := cbor.NewDecoder(bytes.NewReader([]byte{0xf6})).DecodeReader(); !errors.Is(err, cbor.ErrNullOrUndefined) {
+			t.Errorf("expected null error, got %v", err)
+		}
+	})
+}
+
+func TestDecodeIndefiniteString(t *testing.T) {
+	input := []byte{0x5f, 0x42, 0x01, 0x02, 0x43, 0x03, 0x04, 0x05, 0xff}
+
+	t.Run("byte slice", func(t *testing.T) {
+		var got []byte
+		if err := cbor.Unmarshal(input, &got); err != nil {
+			t.Fatal(err)
+		}
+		if expect := []byte{0x01, 0x02, 0x03, 0x04, 0x05}; !bytes.Equal(got, expect) {
+			t.Errorf("expected % x, got % x", expect, got)
+		}
+	})
+
+	t.Run("fixed array", func(t *testing.T) {
+		var got [6]byte
+		if err := cbor.Unmarshal(input, &got); err != nil {
+			t.Fatal(err)
+		}
+		if expect := [6]byte{0x01, 0x02, 0x03, 0x04, 0x05}; got != expect {
+			t.Errorf("expected % x, got % x", expect, got)
+		}
+	})
+
+	t.Run("string", func(t *testing.T) {
+		var got string
+		if err := cbor.Unmarshal([]byte{0x7f, 0x62, 0x49, 0x45, 0x62, 0x54, 0x46, 0xff}, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != "IETF" {
+			t.Errorf("expected IETF, got %s", got)
+		}
+	})
+
+	t.Run("any", func(t *testing.T) {
+		var got any
+		if err := cbor.Unmarshal(input, &got); err != nil {
+			t.Fatal(err)
+		}
+		if expect := []byte{0x01, 0x02, 0x03, 0x04, 0x05}; !bytes.Equal(got.([]byte), expect) {
+			t.Errorf("expected % x, got % x", expect, got)
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		var got []cbor.RawBytes
+		if err := cbor.Unmarshal(append([]byte{0x82}, append(bytes.Clone(input), 0x01)...), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || !bytes.Equal(got[0], input) {
+			t.Errorf("expected [% x 01], got % x", input, got)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		var buf bytes.Buffer
+		buf.WriteByte(0x5f)
+		chunk, err := cbor.Marshal(make([]byte, 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range cbor.MaxArrayDecodeLength / 1000 {
+			buf.Write(chunk)
+		}
+		buf.WriteByte(0xff)
+		var got []byte
+		if err := cbor.Unmarshal(buf.Bytes(), &got); err == nil {
+			t.Error("expected max size error")
+		}
+	})
+}
+
+func TestDecodeReaderBoundedMemory(t *testing.T) {
+	const size = 10 << 20
+	for _, test := range []struct {
+		name   string
+		header []byte
+		chunk  []byte
+		footer []byte
+	}{
+		{name: "definite", header: []byte{0x5a, 0x00, 0xa0, 0x00, 0x00}},
+		{name: "indefinite", header: []byte{0x5f}, chunk: []byte{0x59, 0x04, 0x00}, footer: []byte{0xff}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Generate the encoded string without holding it in memory
+			readers := []io.Reader{bytes.NewReader(test.header)}
+			if test.chunk == nil {
+				readers = append(readers, io.LimitReader(zeroReader{}, size))
+			} else {
+				for range size / 1024 {
+					readers = append(readers, bytes.NewReader(test.chunk), io.LimitReader(zeroReader{}, 1024))
+				}
+			}
+			readers = append(readers, bytes.NewReader(test.footer))
+			input := io.MultiReader(readers...)
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			r, err := cbor.NewDecoder(input).DecodeReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := sha256.New()
+			n, err := io.CopyBuffer(h, r, make([]byte, 32*1024))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runtime.ReadMemStats(&after)
+			if n != size {
+				t.Errorf("expected to read %d bytes, got %d", size, n)
+			}
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+				t.Errorf("reading %d bytes allocated %d bytes", size, alloc)
+			}
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -6,6 +6,7 @@ package fdo_test
 import (
 	"context"
 	"crypto/x509"
+	"fmt"
 	"io"
 	"iter"
 	"runtime"
@@ -17,6 +18,7 @@ import (
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
 	"github.com/fido-device-onboard/go-fdo/fdotest"
+	"github.com/fido-device-onboard/go-fdo/kex"
 	"github.com/fido-device-onboard/go-fdo/plugin"
 	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
@@ -63,6 +65,76 @@ func TestClientWithMockModule(t *testing.T) {
 	}
 }
 
+func TestClientOwnerModuleCipherSuite(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[kex.CipherSuiteID]bool)
+	ownerModule := &fdotest.MockOwnerModule{
+		ProduceInfoFunc: func(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+			cipher, ok := ctx.Value(serviceinfo.CipherSuiteKey{}).(kex.CipherSuiteID)
+			if !ok {
+				return false, false, fmt.Errorf("cipher suite missing from context")
+			}
+			mu.Lock()
+			seen[cipher] = true
+			mu.Unlock()
+			return false, true, nil
+		},
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			mockModuleName: &fdotest.MockDeviceModule{},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield(mockModuleName, ownerModule)
+			}
+		},
+	})
+
+	// The test suite negotiates A128GCM for every key exchange
+	if len(seen) != 1 || !seen[kex.A128GcmCipher] {
+		t.Errorf("expected owner module to see %s, got %v", kex.A128GcmCipher, seen)
+	}
+}
+
+func TestClientOwnerModuleDevmod(t *testing.T) {
+	var mu sync.Mutex
+	var seen []serviceinfo.Devmod
+	ownerModule := &fdotest.MockOwnerModule{
+		ProduceInfoFunc: func(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+			devmod, ok := ctx.Value(serviceinfo.DevmodKey{}).(serviceinfo.Devmod)
+			if !ok {
+				return false, false, fmt.Errorf("devmod missing from context")
+			}
+			mu.Lock()
+			seen = append(seen, devmod)
+			mu.Unlock()
+			return false, true, nil
+		},
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			mockModuleName: &fdotest.MockDeviceModule{},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield(mockModuleName, ownerModule)
+			}
+		},
+	})
+
+	if len(seen) == 0 {
+		t.Fatal("expected owner module to be called")
+	}
+	for _, devmod := range seen {
+		if devmod.Os != runtime.GOOS || devmod.Arch != runtime.GOARCH || devmod.Device != "go-validation" {
+			t.Fatalf("expected devmod sent by the test device, got %+v", devmod)
+		}
+	}
+}
+
 func TestClientWithMockModuleAndAutoUnchunking(t *testing.T) {
 	deviceModule := &fdotest.MockDeviceModule{
 		ReceiveFunc: func(ctx context.Context, messageName string, messageBody io.Reader, respond func(message string) io.Writer, yield func()) error {
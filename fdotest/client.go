@@ -100,6 +100,10 @@ func RunClientTestSuite(t *testing.T, conf Config) {
 	if conf.NoDebug {
 		level = slog.LevelInfo
 	}
+	// Restore the default logger, so that it does not write to the log of a
+	// completed test
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
 	slog.SetDefault(slog.New(slog.NewTextHandler(TestingLog(t), &slog.HandlerOptions{Level: level})))
 
 	if conf.State == nil {
@@ -49,10 +49,20 @@ type RunCommand struct {
 	argBody     []byte
 	sentExecute bool
 	done        bool
+	exitCode    int
 }
 
 var _ serviceinfo.OwnerModule = (*RunCommand)(nil)
 
+// ExitCode returns the exit code reported by the device. It is only valid,
+// indicated by ok, once ProduceInfo has reported that the module is done.
+func (c *RunCommand) ExitCode() (code int, ok bool) {
+	if !c.done {
+		return 0, false
+	}
+	return c.exitCode, true
+}
+
 // HandleInfo implements serviceinfo.OwnerModule.
 func (c *RunCommand) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
 	if err := c.handleInfo(ctx, messageName, messageBody); err != nil {
@@ -70,7 +80,7 @@ func (c *RunCommand) handleInfo(ctx context.Context, messageName string, message
 			return fmt.Errorf("error decoding message %s: %w", messageName, err)
 		}
 		if !deviceActive {
-			return fmt.Errorf("device service info module is not active")
+			return ErrModuleInactive
 		}
 		return nil
 
@@ -114,7 +124,7 @@ func (c *RunCommand) handleInfo(ctx context.Context, messageName string, message
 		}
 
 		c.cleanup()
-		c.done = true
+		c.done, c.exitCode = true, code
 		return nil
 
 	default:
@@ -0,0 +1,143 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/fsim"
+	"github.com/fido-device-onboard/go-fdo/fsim/fsimtest"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// fakeCommand simulates the device side of fdo.command, reporting fixed
+// output and an exit code as soon as the command is executed.
+type fakeCommand struct {
+	Stdout, Stderr string
+	ExitCode       int
+
+	command  string
+	args     cbor.Bstr[[]string]
+	mayFail  bool
+	stdout   bool
+	stderr   bool
+	executed bool
+	reported bool
+}
+
+func (c *fakeCommand) Transition(bool) error { return nil }
+
+func (c *fakeCommand) Receive(_ context.Context, messageName string, messageBody io.Reader, _ func(string) io.Writer, _ func()) error {
+	dec := cbor.NewDecoder(messageBody)
+	switch messageName {
+	case "command":
+		return dec.Decode(&c.command)
+	case "args":
+		return dec.Decode(&c.args)
+	case "may_fail":
+		return dec.Decode(&c.mayFail)
+	case "return_stdout":
+		return dec.Decode(&c.stdout)
+	case "return_stderr":
+		return dec.Decode(&c.stderr)
+	case "execute":
+		c.executed = true
+		return nil
+	default:
+		return fmt.Errorf("unknown message %s", messageName)
+	}
+}
+
+func (c *fakeCommand) Yield(_ context.Context, respond func(string) io.Writer, _ func()) error {
+	if !c.executed || c.reported {
+		return nil
+	}
+	c.reported = true
+	if c.ExitCode != 0 && !c.mayFail {
+		return fmt.Errorf("command failed with exit code: %d", c.ExitCode)
+	}
+	if c.stdout {
+		if err := cbor.NewEncoder(respond("stdout")).Encode([]byte(c.Stdout)); err != nil {
+			return err
+		}
+	}
+	if c.stderr {
+		if err := cbor.NewEncoder(respond("stderr")).Encode([]byte(c.Stderr)); err != nil {
+			return err
+		}
+	}
+	return cbor.NewEncoder(respond("exitcode")).Encode(c.ExitCode)
+}
+
+var _ serviceinfo.DeviceModule = (*fakeCommand)(nil)
+
+func TestRunCommand(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mayFail  bool
+		capture  bool
+		exitCode int
+	}{
+		{name: "success"},
+		{name: "captured output", capture: true},
+		{name: "may fail", mayFail: true, capture: true, exitCode: 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			device := &fakeCommand{Stdout: "out\n", Stderr: "err\n", ExitCode: test.exitCode}
+			exitChan := make(chan int, 1)
+			var stdout, stderr bytes.Buffer
+			owner := &fsim.RunCommand{
+				Command:  "sh",
+				Args:     []string{"-c", "echo out; echo err >&2"},
+				MayFail:  test.mayFail,
+				ExitChan: exitChan,
+			}
+			if test.capture {
+				owner.Stdout, owner.Stderr = &stdout, &stderr
+			}
+			if _, ok := owner.ExitCode(); ok {
+				t.Fatal("expected no exit code before the command runs")
+			}
+
+			if err := fsimtest.RunExchange(t.Context(), "fdo.command", owner, device); err != nil {
+				t.Fatal(err)
+			}
+
+			if device.command != owner.Command || !slices.Equal(device.args.Val, owner.Args) {
+				t.Errorf("device received command %q %q", device.command, device.args.Val)
+			}
+			if device.mayFail != test.mayFail || device.stdout != test.capture || device.stderr != test.capture {
+				t.Errorf("device received may_fail=%t, return_stdout=%t, return_stderr=%t",
+					device.mayFail, device.stdout, device.stderr)
+			}
+			if code, ok := owner.ExitCode(); !ok || code != test.exitCode {
+				t.Errorf("expected exit code %d, got %d (ok=%t)", test.exitCode, code, ok)
+			}
+			if code, ok := <-exitChan; !ok || code != test.exitCode {
+				t.Errorf("expected exit code %d on channel, got %d (ok=%t)", test.exitCode, code, ok)
+			}
+			if test.capture && (stdout.String() != device.Stdout || stderr.String() != device.Stderr) {
+				t.Errorf("expected stdout %q and stderr %q, got %q and %q",
+					device.Stdout, device.Stderr, stdout.String(), stderr.String())
+			}
+		})
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		device := &fakeCommand{ExitCode: 1}
+		owner := &fsim.RunCommand{Command: "false"}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.command", owner, device); err == nil {
+			t.Fatal("expected device error for failed command")
+		}
+		if _, ok := owner.ExitCode(); ok {
+			t.Error("expected no exit code for failed command")
+		}
+	})
+}
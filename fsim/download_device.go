@@ -33,6 +33,22 @@ type Download struct {
 	// corresponding message written.
 	ErrorLog io.Writer
 
+	// ResumeFrom optionally returns the partial file of a previous,
+	// interrupted download of the named file when the owner asks to resume
+	// it (see DownloadContents.Resume). The file must be open for reading and
+	// writing and is used in place of a new temp file. Its contents are
+	// hashed, its size is reported to the owner as the offset to resume from,
+	// and the remaining data is appended to it.
+	//
+	// If nil, or if the returned file is nil, an offset of zero is reported
+	// and the download starts from the beginning. A partial file larger than
+	// the length of the download is truncated.
+	//
+	// The partial file is closed but not removed when the download is
+	// interrupted, so that it can be resumed again, unless the completed
+	// download fails verification.
+	ResumeFrom func(name string) (*os.File, error)
+
 	// TODO: Configurable timeout?
 
 	// Message data
@@ -42,6 +58,7 @@ type Download struct {
 
 	// Internal state
 	temp    *os.File
+	resumed bool // temp was returned by ResumeFrom
 	hash    hash.Hash
 	written int
 }
@@ -74,6 +91,16 @@ func (d *Download) receive(messageName string, messageBody io.Reader, respond fu
 	case "name":
 		return cbor.NewDecoder(messageBody).Decode(&d.name)
 
+	case "resume":
+		var resume bool
+		if err := cbor.NewDecoder(messageBody).Decode(&resume); err != nil {
+			return err
+		}
+		if err := d.resume(); err != nil {
+			return err
+		}
+		return cbor.NewEncoder(respond("offset")).Encode(d.written)
+
 	case "data":
 		if err := d.createTemp(); err != nil {
 			return err
@@ -112,6 +139,48 @@ func (d *Download) receive(messageName string, messageBody io.Reader, respond fu
 	}
 }
 
+// resume uses the partial file returned by ResumeFrom, if any, so that the
+// download continues from its end.
+func (d *Download) resume() error {
+	if d.ResumeFrom == nil || d.temp != nil {
+		return nil
+	}
+	if d.name == "" {
+		return fmt.Errorf("name not sent before resuming download")
+	}
+	f, err := d.ResumeFrom(d.name)
+	if err != nil {
+		return fmt.Errorf("error opening partial download of %q: %w", d.name, err)
+	}
+	if f == nil {
+		return nil
+	}
+	d.temp, d.resumed = f, true
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking partial download of %q: %w", d.name, err)
+	}
+	n, err := io.Copy(d.hash, f)
+	if err != nil {
+		return fmt.Errorf("error hashing partial download of %q: %w", d.name, err)
+	}
+	if n > int64(d.length) {
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("error truncating partial download of %q: %w", d.name, err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking partial download of %q: %w", d.name, err)
+		}
+		d.hash.Reset()
+		n = 0
+	}
+	d.written = int(n)
+	if debugEnabled() {
+		slog.Default().WithGroup("fdo.download").Debug("resuming", "written", d.written, "length", d.length)
+	}
+	return nil
+}
+
 func (d *Download) createTemp() error {
 	if d.temp != nil {
 		return nil
@@ -132,14 +201,17 @@ func (d *Download) createTemp() error {
 func (d *Download) finalize(respond func(string) io.Writer) error {
 	defer d.reset()
 
-	// Validate file length and checksum
+	// Validate file length and checksum. A partial file which fails
+	// verification cannot be resumed, so it is removed even if resumed.
 	if d.written > d.length {
+		d.resumed = false
 		if d.ErrorLog != nil {
 			_, _ = fmt.Fprintf(d.ErrorLog, "[file=%s] %d bytes written, expected a length of %d\n", d.name, d.written, d.length)
 		}
 		return cbor.NewEncoder(respond("done")).Encode(-1)
 	}
 	if hashed := d.hash.Sum(nil); len(d.sha384) > 0 && !bytes.Equal(hashed, d.sha384) {
+		d.resumed = false
 		if d.ErrorLog != nil {
 			_, _ = fmt.Fprintf(d.ErrorLog, "[file=%s] checksum failed verification\nexp: %x\ngot: %x\n", d.name, d.sha384, hashed)
 		}
@@ -171,13 +243,15 @@ func (d *Download) finalize(respond func(string) io.Writer) error {
 func (d *Download) reset() {
 	if d.temp != nil {
 		_ = d.temp.Close()
-		_ = os.Remove(d.temp.Name())
+		if !d.resumed {
+			_ = os.Remove(d.temp.Name())
+		}
 	}
 	if d.hash == nil {
 		d.hash = sha512.New384()
 	}
 	d.hash.Reset()
-	d.name, d.length, d.sha384, d.temp, d.written = "", 0, nil, nil, 0
+	d.name, d.length, d.sha384, d.temp, d.resumed, d.written = "", 0, nil, nil, false, 0
 }
 
 // Yield implements serviceinfo.DeviceModule.
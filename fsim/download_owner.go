@@ -8,6 +8,8 @@ import (
 	"crypto/sha512"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
@@ -24,10 +26,22 @@ type DownloadContents[T io.ReadSeeker] struct {
 	MustDownload bool
 	// Defaults to 1014, by spec
 	ChunkSize int
+	// Resume asks the device how many bytes of the file it already has, e.g.
+	// from a download interrupted by a dropped TO2 session, so that only the
+	// remaining data is sent. The sha-384 still covers the whole file.
+	//
+	// This is an extension of fdo.download, so it must only be set for devices
+	// which support it, such as Download: after the name, length, and
+	// sha-384, the owner sends "resume" and waits for the device to respond
+	// with "offset", the number of bytes it has, before sending data.
+	Resume bool
 
 	// internal state
 	started bool
+	resumed bool // offset received
+	sent    bool // any data sent
 	chunk   []byte
+	length  int64
 	index   int64
 	done    bool
 }
@@ -43,10 +57,24 @@ func (d *DownloadContents[T]) HandleInfo(ctx context.Context, messageName string
 			return fmt.Errorf("error decoding message %s: %w", messageName, err)
 		}
 		if !deviceActive {
-			return fmt.Errorf("device service info module is not active")
+			return ErrModuleInactive
 		}
 		return nil
 
+	case "offset":
+		if !d.Resume || !d.started || d.resumed {
+			return fmt.Errorf("unexpected message %q", messageName)
+		}
+		var offset int64
+		if err := cbor.NewDecoder(messageBody).Decode(&offset); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if offset < 0 || offset > d.length {
+			return fmt.Errorf("device reported offset %d to resume download of %q, but it is only %d bytes", offset, d.Name, d.length)
+		}
+		d.index, d.resumed = offset, true
+		return nil
+
 	case "done":
 		defer func() {
 			if closer, ok := any(d.Contents).(io.Closer); ok {
@@ -80,6 +108,10 @@ func (d *DownloadContents[T]) ProduceInfo(ctx context.Context, producer *service
 	}
 
 	if d.started {
+		if d.Resume && !d.resumed {
+			// Wait for the device to report its offset
+			return false, false, nil
+		}
 		return d.sendData(producer)
 	}
 
@@ -96,7 +128,12 @@ func (d *DownloadContents[T]) ProduceInfo(ctx context.Context, producer *service
 		"length":  length,
 		"sha-384": sha384.Sum(nil)[:],
 	}
-	for _, messageName := range []string{"active", "name", "length", "sha-384"} {
+	messageNames := []string{"active", "name", "length", "sha-384"}
+	if d.Resume {
+		messageVal["resume"] = true
+		messageNames = append(messageNames, "resume")
+	}
+	for _, messageName := range messageNames {
 		messageBody, err := cbor.Marshal(messageVal[messageName])
 		if err != nil {
 			return false, false, err
@@ -121,6 +158,7 @@ func (d *DownloadContents[T]) ProduceInfo(ctx context.Context, producer *service
 		maxChunkSize = (1 << 16) - 1
 	}
 	d.chunk = make([]byte, maxChunkSize)
+	d.length = length
 	d.started = true
 	return false, false, nil
 }
@@ -139,10 +177,11 @@ func (d *DownloadContents[T]) sendData(producer *serviceinfo.Producer) (blockPee
 	n, err := d.Contents.Read(d.chunk[:min(available, len(d.chunk))])
 	if err != nil && err != io.EOF {
 		return false, false, fmt.Errorf("error reading chunk of %q contents: %w", d.Name, err)
-	} else if n == 0 {
+	} else if n == 0 && (d.sent || !d.resumed) {
 		return false, false, nil
 	}
-	d.index += int64(n)
+	// When the device already has the whole file, an empty chunk is sent so
+	// that it completes the download
 
 	// Marshal chunk
 	messageBody, err := cbor.Marshal(d.chunk[:n])
@@ -150,11 +189,62 @@ func (d *DownloadContents[T]) sendData(producer *serviceinfo.Producer) (blockPee
 		return false, false, err
 	}
 
-	// Check that there's enough space to send the message
-	if len(messageBody) > producer.Available(messageName) {
-		return false, false, nil
+	// Write the message, or send the same chunk in the next round when there
+	// is not enough space
+	full, err := producer.TryWriteChunk(messageName, messageBody)
+	if err != nil || full {
+		return false, false, err
+	}
+	d.index += int64(n)
+	d.sent = true
+	return false, false, nil
+}
+
+// DownloadRequest implements an owner module for fdo.download which sends the
+// contents of a local file to the device.
+type DownloadRequest struct {
+	// Name of the file on the device
+	Name string
+	// Path of the local file to send
+	Path string
+	// MustDownload causes the module to fail if the device reports that it
+	// could not download the file.
+	MustDownload bool
+	// Maximum size of each data chunk. Chunks are also limited by the space
+	// available in each service info message. Defaults to 1014, by spec.
+	ChunkSize int
+	// Resume sends only the data the device does not already have. It must
+	// only be set for devices which support it. See DownloadContents.Resume.
+	Resume bool
+
+	// internal state
+	contents *DownloadContents[*os.File]
+}
+
+var _ serviceinfo.OwnerModule = (*DownloadRequest)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (d *DownloadRequest) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	if d.contents == nil {
+		return fmt.Errorf("unexpected message %q before download of %q was started", messageName, d.Name)
 	}
+	return d.contents.HandleInfo(ctx, messageName, messageBody)
+}
 
-	// Write the message
-	return false, false, producer.WriteChunk(messageName, messageBody)
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (d *DownloadRequest) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	if d.contents == nil {
+		f, err := os.Open(filepath.Clean(d.Path))
+		if err != nil {
+			return false, false, fmt.Errorf("error opening %q for download: %w", d.Path, err)
+		}
+		d.contents = &DownloadContents[*os.File]{
+			Name:         d.Name,
+			Contents:     f,
+			MustDownload: d.MustDownload,
+			ChunkSize:    d.ChunkSize,
+			Resume:       d.Resume,
+		}
+	}
+	return d.contents.ProduceInfo(ctx, producer)
 }
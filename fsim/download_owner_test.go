@@ -0,0 +1,267 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/fsim"
+	"github.com/fido-device-onboard/go-fdo/fsim/fsimtest"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// fakeResumeDownload simulates the device side of fdo.download with resume
+// support, already holding the first bytes of the file.
+type fakeResumeDownload struct {
+	Have []byte
+
+	length   int64
+	sha384   []byte
+	received []byte
+}
+
+func (d *fakeResumeDownload) Transition(bool) error { return nil }
+
+func (d *fakeResumeDownload) Receive(_ context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, _ func()) error {
+	dec := cbor.NewDecoder(messageBody)
+	switch messageName {
+	case "name":
+		var name string
+		return dec.Decode(&name)
+	case "length":
+		return dec.Decode(&d.length)
+	case "sha-384":
+		return dec.Decode(&d.sha384)
+	case "resume":
+		var resume bool
+		if err := dec.Decode(&resume); err != nil {
+			return err
+		}
+		return cbor.NewEncoder(respond("offset")).Encode(len(d.Have))
+	case "data":
+		var chunk []byte
+		if err := dec.Decode(&chunk); err != nil {
+			return err
+		}
+		d.received = append(d.received, chunk...)
+		file := append(bytes.Clone(d.Have), d.received...)
+		if int64(len(file)) < d.length {
+			return nil
+		}
+		if sum := sha512.Sum384(file); !bytes.Equal(sum[:], d.sha384) {
+			return cbor.NewEncoder(respond("done")).Encode(-1)
+		}
+		return cbor.NewEncoder(respond("done")).Encode(len(file))
+	default:
+		return fmt.Errorf("unknown message %s", messageName)
+	}
+}
+
+func (d *fakeResumeDownload) Yield(context.Context, func(string) io.Writer, func()) error { return nil }
+
+var _ serviceinfo.DeviceModule = (*fakeResumeDownload)(nil)
+
+func TestDownloadResume(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	for _, test := range []struct {
+		name   string
+		offset int
+	}{
+		{name: "start", offset: 0},
+		{name: "partial", offset: 1000},
+		{name: "complete", offset: len(data)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			device := &fakeResumeDownload{Have: data[:test.offset]}
+			owner := &fsim.DownloadContents[*bytes.Reader]{
+				Name:         "file.bin",
+				Contents:     bytes.NewReader(data),
+				MustDownload: true,
+				Resume:       true,
+			}
+			if err := fsimtest.RunExchange(t.Context(), "fdo.download", owner, device); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(device.received, data[test.offset:]) {
+				t.Fatalf("expected %d bytes from offset %d, got %d bytes", len(data)-test.offset, test.offset, len(device.received))
+			}
+		})
+
+		t.Run(test.name+" device module", func(t *testing.T) {
+			dir := t.TempDir()
+			partial, err := os.Create(filepath.Join(dir, "partial"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := partial.Write(data[:test.offset]); err != nil {
+				t.Fatal(err)
+			}
+			var resumed string
+			device := &fsim.Download{
+				NameToPath: func(name string) string { return filepath.Join(dir, name) },
+				ResumeFrom: func(name string) (*os.File, error) {
+					resumed = name
+					return partial, nil
+				},
+			}
+			owner := &fsim.DownloadContents[*bytes.Reader]{
+				Name:         "file.bin",
+				Contents:     bytes.NewReader(data),
+				MustDownload: true,
+				Resume:       true,
+			}
+			if err := fsimtest.RunExchange(t.Context(), "fdo.download", owner, device); err != nil {
+				t.Fatal(err)
+			}
+			if resumed != "file.bin" {
+				t.Errorf("expected ResumeFrom to be called with %q, got %q", "file.bin", resumed)
+			}
+			// Data sent from any offset other than the partial file's size
+			// would fail verification on the device
+			got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("downloaded contents did not match: got %d bytes, expected %d", len(got), len(data))
+			}
+		})
+	}
+
+	t.Run("device module without partial file", func(t *testing.T) {
+		dir := t.TempDir()
+		device := &fsim.Download{
+			NameToPath: func(name string) string { return filepath.Join(dir, name) },
+			ResumeFrom: func(string) (*os.File, error) { return nil, nil },
+		}
+		owner := &fsim.DownloadContents[*bytes.Reader]{
+			Name:         "file.bin",
+			Contents:     bytes.NewReader(data),
+			MustDownload: true,
+			Resume:       true,
+		}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.download", owner, device); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("expected full download, got %d bytes, %v", len(got), err)
+		}
+	})
+
+	t.Run("device module with oversized partial file", func(t *testing.T) {
+		dir := t.TempDir()
+		partial, err := os.Create(filepath.Join(dir, "partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := partial.Write(append(bytes.Clone(data), "extra"...)); err != nil {
+			t.Fatal(err)
+		}
+		device := &fsim.Download{
+			NameToPath: func(name string) string { return filepath.Join(dir, name) },
+			ResumeFrom: func(string) (*os.File, error) { return partial, nil },
+		}
+		owner := &fsim.DownloadContents[*bytes.Reader]{
+			Name:         "file.bin",
+			Contents:     bytes.NewReader(data),
+			MustDownload: true,
+			Resume:       true,
+		}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.download", owner, device); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("expected the partial file to be replaced, got %d bytes, %v", len(got), err)
+		}
+	})
+
+	t.Run("device module interrupted", func(t *testing.T) {
+		for _, test := range []struct {
+			name   string
+			sha384 []byte
+			keep   bool
+		}{
+			{name: "interrupted", keep: true},
+			{name: "failed verification", sha384: make([]byte, sha512.Size384)},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "partial")
+				partial, err := os.Create(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := partial.Write(data[:len(data)/2]); err != nil {
+					t.Fatal(err)
+				}
+				device := &fsim.Download{
+					NameToPath: func(name string) string { return filepath.Join(t.TempDir(), name) },
+					ResumeFrom: func(string) (*os.File, error) { return partial, nil },
+				}
+				receive := func(name string, body any) {
+					t.Helper()
+					b, err := cbor.Marshal(body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := device.Receive(t.Context(), name, bytes.NewReader(b),
+						func(string) io.Writer { return io.Discard }, func() {}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := device.Transition(true); err != nil {
+					t.Fatal(err)
+				}
+				receive("name", "file.bin")
+				receive("length", len(data))
+				if test.sha384 != nil {
+					receive("sha-384", test.sha384)
+				}
+				receive("resume", true)
+				if !test.keep {
+					receive("data", data[len(data)/2:])
+				}
+				if err := device.Transition(false); err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := os.ReadFile(path)
+				switch {
+				case test.keep && err != nil:
+					t.Fatalf("expected partial file to be kept for the next session: %v", err)
+				case test.keep && !bytes.Equal(got, data[:len(data)/2]):
+					t.Fatalf("expected partial file to be unchanged, got %d bytes", len(got))
+				case !test.keep && !errors.Is(err, os.ErrNotExist):
+					t.Fatalf("expected partial file failing verification to be removed, got %v", err)
+				}
+			})
+		}
+	})
+
+	t.Run("offset exceeds length", func(t *testing.T) {
+		device := &fakeResumeDownload{Have: append(bytes.Clone(data), 0)}
+		owner := &fsim.DownloadContents[*bytes.Reader]{
+			Name:     "file.bin",
+			Contents: bytes.NewReader(data),
+			Resume:   true,
+		}
+		err := fsimtest.RunExchange(t.Context(), "fdo.download", owner, device)
+		if err == nil || !strings.Contains(err.Error(), "offset") {
+			t.Fatalf("expected offset error, got %v", err)
+		}
+		if len(device.received) > 0 {
+			t.Fatalf("expected no data to be sent, got %d bytes", len(device.received))
+		}
+	})
+}
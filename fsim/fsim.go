@@ -8,9 +8,16 @@ package fsim
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 )
 
+// ErrModuleInactive is returned by the HandleInfo method of owner modules when
+// the device sends active=false, i.e. it does not support or has disabled the
+// module. Unlike other errors, it is not a protocol error, but the device
+// declining the module, which callers may treat as a no-op.
+var ErrModuleInactive = errors.New("device service info module is not active")
+
 func debugEnabled() bool {
 	return slog.Default().Enabled(context.Background(), slog.LevelDebug)
 }
@@ -246,6 +246,83 @@ func TestClientWithMockDownloadOwner(t *testing.T) {
 	})
 }
 
+func TestClientWithDownloadRequest(t *testing.T) {
+	if err := os.MkdirAll("testdata/downloads", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("Hello World!\n"), 1024)
+	path := filepath.Join(t.TempDir(), "file.test")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.download": &fsim.Download{
+				CreateTemp: func() (*os.File, error) {
+					return os.CreateTemp("testdata", "fdo.download_*")
+				},
+				NameToPath: func(name string) string {
+					return filepath.Join("testdata", "downloads", name)
+				},
+				ErrorLog: fdotest.TestingLog(t),
+			},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.download", &fsim.DownloadRequest{
+					Name:         "request.test",
+					Path:         path,
+					MustDownload: true,
+					ChunkSize:    500,
+				})
+			}
+		},
+	})
+
+	got, err := os.ReadFile("testdata/downloads/request.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("download contents did not match expected")
+	}
+}
+
+func TestClientWithMultiUpload(t *testing.T) {
+	first := bytes.Repeat([]byte("Hello World!\n"), 1024)
+	second := bytes.Repeat([]byte("Goodbye World!\n"), 512)
+	dir := t.TempDir()
+
+	fdotest.RunClientTestSuite(t, fdotest.Config{
+		DeviceModules: map[string]serviceinfo.DeviceModule{
+			"fdo.upload": &fsim.Upload{FS: fstest.MapFS{
+				"first.test":  &fstest.MapFile{Data: first, Mode: 0777},
+				"second.test": &fstest.MapFile{Data: second, Mode: 0777},
+			}},
+		},
+		OwnerModules: func(ctx context.Context, replacementGUID protocol.GUID, info string, chain []*x509.Certificate, devmod serviceinfo.Devmod, supportedMods []string) iter.Seq2[string, serviceinfo.OwnerModule] {
+			return func(yield func(string, serviceinfo.OwnerModule) bool) {
+				yield("fdo.upload", &fsim.MultiUpload{Requests: []*fsim.UploadRequest{
+					{Dir: dir, Name: "first.test"},
+					{Dir: dir, Name: "second.test", HashAlg: protocol.Sha256Hash},
+				}})
+			}
+		},
+	})
+
+	for name, data := range map[string][]byte{"first.test": first, "second.test": second} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("upload contents of %q did not match expected", name)
+		}
+	}
+}
+
 func TestClientWithCommandModule(t *testing.T) {
 	type runData struct {
 		outbuf   bytes.Buffer
@@ -0,0 +1,164 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+// Package fsimtest contains test harnesses for service info modules.
+package fsimtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// MaxIdleRounds is the number of consecutive rounds in which neither module
+// sends any service info before RunExchange reports a deadlock. Each call to
+// the owner module's ProduceInfo which blocks its peer without sending any
+// service info also counts as an idle round.
+const MaxIdleRounds = 100
+
+// ErrDeadlock is returned by RunExchange when neither module makes progress.
+var ErrDeadlock = errors.New("service info exchange deadlocked")
+
+// RunExchange drives an owner module against a device module until the owner
+// module is done, without running a full TO2 session.
+//
+// Each round, the owner module produces service info, respecting the default
+// MTU, and continues to do so while it blocks its peer. The device module then
+// receives each message, followed by a call to Yield, and its responses are
+// given to the owner module in the next round. Responses written after the
+// device module yields are delayed by a round. As in TO2, consecutive
+// responses with the same message name are concatenated and "active" messages
+// are handled automatically.
+//
+// Device modules must respond from within Receive or Yield, as modules which
+// respond asynchronously cannot be detected by the exchange.
+func RunExchange(ctx context.Context, moduleName string, owner serviceinfo.OwnerModule, device serviceinfo.DeviceModule) error {
+	var (
+		pending [][]*serviceinfo.KV // device responses, one slice per round
+		idle    int
+	)
+	for {
+		// Deliver the device responses for this round to the owner
+		var responses []*serviceinfo.KV
+		if len(pending) > 0 {
+			responses, pending = pending[0], pending[1:]
+		}
+		for _, kv := range responses {
+			if err := owner.HandleInfo(ctx, kv.Key, bytes.NewReader(kv.Val)); err != nil {
+				return fmt.Errorf("owner module: error handling %q: %w", kv.Key, err)
+			}
+		}
+
+		// Produce owner service info until the owner stops blocking its peer
+		var requests []*serviceinfo.KV
+		for {
+			producer := serviceinfo.NewProducer(moduleName, serviceinfo.DefaultMTU)
+			blockPeer, done, err := owner.ProduceInfo(ctx, producer)
+			if err != nil {
+				return fmt.Errorf("owner module: %w", err)
+			}
+			if done {
+				return nil
+			}
+			produced := producer.ServiceInfo()
+			requests = append(requests, produced...)
+			if !blockPeer {
+				break
+			}
+
+			// The device cannot respond while it is blocked, so the owner
+			// must make progress on its own
+			if len(produced) > 0 {
+				idle = 0
+			} else if idle++; idle >= MaxIdleRounds {
+				return ErrDeadlock
+			}
+		}
+
+		// Deliver owner service info to the device
+		d := &deviceRound{moduleName: moduleName}
+		for _, kv := range requests {
+			if err := d.receive(ctx, device, kv); err != nil {
+				return fmt.Errorf("device module: error handling %q: %w", kv.Key, err)
+			}
+		}
+		if err := device.Yield(ctx, d.respond, d.yield); err != nil {
+			return fmt.Errorf("device module: %w", err)
+		}
+		d.yield()
+		for i, round := range d.rounds {
+			if i < len(pending) {
+				pending[i] = append(pending[i], round...)
+			} else {
+				pending = append(pending, round)
+			}
+		}
+
+		// Detect when neither side is making progress
+		if len(requests) == 0 && len(responses) == 0 && len(pending) == 0 {
+			idle++
+		} else {
+			idle = 0
+		}
+		if idle >= MaxIdleRounds {
+			return ErrDeadlock
+		}
+	}
+}
+
+// deviceRound collects the responses of a device module during one round.
+type deviceRound struct {
+	moduleName string
+	current    []*serviceinfo.KV
+	rounds     [][]*serviceinfo.KV
+}
+
+func (d *deviceRound) receive(ctx context.Context, device serviceinfo.DeviceModule, kv *serviceinfo.KV) error {
+	messageName, ok := strings.CutPrefix(kv.Key, d.moduleName+":")
+	if !ok {
+		return fmt.Errorf("unexpected key %q", kv.Key)
+	}
+	if messageName != "active" {
+		return device.Receive(ctx, messageName, bytes.NewReader(kv.Val), d.respond, d.yield)
+	}
+
+	var active bool
+	if err := cbor.Unmarshal(kv.Val, &active); err != nil {
+		return err
+	}
+	if err := device.Transition(active); err != nil {
+		return err
+	}
+	return cbor.NewEncoder(d.respond("active")).Encode(active)
+}
+
+// respond starts a new response, unless the previous response had the same
+// message name, in which case writes are concatenated.
+func (d *deviceRound) respond(messageName string) io.Writer {
+	if n := len(d.current); n == 0 || d.current[n-1].Key != messageName {
+		d.current = append(d.current, &serviceinfo.KV{Key: messageName})
+	}
+	return kvWriter{d.current[len(d.current)-1]}
+}
+
+// yield ends the current round of responses.
+func (d *deviceRound) yield() {
+	if len(d.current) == 0 {
+		return
+	}
+	d.rounds = append(d.rounds, d.current)
+	d.current = nil
+}
+
+type kvWriter struct{ kv *serviceinfo.KV }
+
+func (w kvWriter) Write(p []byte) (int, error) {
+	w.kv.Val = append(w.kv.Val, p...)
+	return len(p), nil
+}
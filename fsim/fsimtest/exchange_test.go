@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsimtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/fdotest"
+	"github.com/fido-device-onboard/go-fdo/fsim/fsimtest"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+func TestRunExchangeDeadlock(t *testing.T) {
+	// The owner waits for a message which the device never sends
+	owner := &fdotest.MockOwnerModule{
+		ProduceInfoFunc: func(context.Context, *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+			return false, false, nil
+		},
+	}
+	err := fsimtest.RunExchange(t.Context(), "test", owner, &fdotest.MockDeviceModule{})
+	if !errors.Is(err, fsimtest.ErrDeadlock) {
+		t.Fatalf("expected deadlock, got %v", err)
+	}
+}
+
+func TestRunExchangeBlockedDeadlock(t *testing.T) {
+	// The owner blocks its peer forever without sending anything
+	owner := &fdotest.MockOwnerModule{
+		ProduceInfoFunc: func(context.Context, *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+			return true, false, nil
+		},
+	}
+	err := fsimtest.RunExchange(t.Context(), "test", owner, &fdotest.MockDeviceModule{})
+	if !errors.Is(err, fsimtest.ErrDeadlock) {
+		t.Fatalf("expected deadlock, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ package fsim
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/sha512"
 	"fmt"
 	"io"
@@ -16,11 +17,21 @@ import (
 
 // Upload implements https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.upload.md
 // and should be registered to the "fdo.upload" module.
+//
+// Upload drives the device side of an upload requested by an [UploadRequest]:
+// when the owner sends a name, the file is read from FS and its length, data,
+// and digest (if requested with need-sha) are sent in response.
 type Upload struct {
+	// FS is the source of uploaded files, which are opened by the name sent
+	// by the owner. Use [os.DirFS] to upload files from a local directory.
 	FS fs.FS
 
+	// Maximum size of each data chunk. Defaults to 1014, by spec. Larger
+	// chunks are split across service info messages by the device service.
+	ChunkSize int
+
 	// Internal state
-	needSha bool
+	sha string // name of digest message to send, if any
 }
 
 var _ serviceinfo.DeviceModule = (*Upload)(nil)
@@ -50,7 +61,27 @@ func (u *Upload) receive(messageName string, messageBody io.Reader, respond func
 		return nil
 
 	case "need-sha":
-		return cbor.NewDecoder(messageBody).Decode(&u.needSha)
+		// By spec, need-sha is a bool requesting SHA-384. As an extension, a
+		// digest message name may be given to request an alternative hash.
+		var needSha any
+		if err := cbor.NewDecoder(messageBody).Decode(&needSha); err != nil {
+			return err
+		}
+		switch v := needSha.(type) {
+		case bool:
+			u.sha = ""
+			if v {
+				u.sha = "sha-384"
+			}
+		case string:
+			if v != "sha-256" && v != "sha-384" {
+				return fmt.Errorf("unsupported need-sha digest %q", v)
+			}
+			u.sha = v
+		default:
+			return fmt.Errorf("invalid need-sha value of type %T", needSha)
+		}
+		return nil
 
 	default:
 		u.reset()
@@ -76,10 +107,18 @@ func (u *Upload) upload(name string, respond func(string) io.Writer, yield func(
 	}
 	yield()
 
-	chunk := make([]byte, 1014)
-	hash := sha512.New384()
+	chunkSize := 1014
+	if u.ChunkSize > 0 {
+		chunkSize = u.ChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	newHash := sha512.New384
+	if u.sha == "sha-256" {
+		newHash = sha256.New
+	}
+	hash := newHash()
 	for i := stat.Size(); i > 0; {
-		n, err := f.Read(chunk[:min(1014, i)])
+		n, err := f.Read(chunk[:min(int64(chunkSize), i)])
 		if err != nil {
 			return err
 		}
@@ -95,13 +134,13 @@ func (u *Upload) upload(name string, respond func(string) io.Writer, yield func(
 		yield()
 	}
 
-	if !u.needSha {
+	if u.sha == "" {
 		return nil
 	}
-	return cbor.NewEncoder(respond("sha-384")).Encode(hash.Sum(nil))
+	return cbor.NewEncoder(respond(u.sha)).Encode(hash.Sum(nil))
 }
 
-func (u *Upload) reset() { u.needSha = false }
+func (u *Upload) reset() { u.sha = "" }
 
 // Yield implements DeviceModule.
 func (u *Upload) Yield(ctx context.Context, respond func(message string) io.Writer, yield func()) error {
@@ -5,17 +5,32 @@ package fsim
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
-	"crypto/sha512"
+	"crypto"
+	"crypto/rand"
+	_ "crypto/sha256" // Register hash function
+	_ "crypto/sha512" // Register hash function
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/protocol"
 	"github.com/fido-device-onboard/go-fdo/serviceinfo"
 )
 
@@ -23,35 +38,733 @@ import (
 // https://github.com/fido-alliance/fdo-sim/blob/main/fsim-repository/fdo.upload.md
 
 // UploadRequest implements the fdo.upload owner module.
+//
+// An UploadRequest handles a single upload and must not be used concurrently.
+// To upload another file with the same configuration, call Reset once the
+// previous upload has completed.
+//
+// No file descriptors are held once an upload has failed or completed. When
+// HandleInfo or ProduceInfo returns an error, the temp file is closed and
+// removed, or the sink is closed with the error, before returning. If
+// ResumeFrom is set, the temp file is only removed if the upload failed
+// verification. Dir is only opened while a file is placed or checked and is
+// closed before the call that placed it returns.
 type UploadRequest struct {
 	// Directory to place uploaded file
 	Dir string
 
+	// Dest optionally places uploaded files in a filesystem other than Dir,
+	// such as an in-memory or virtual filesystem. Uploads are then always
+	// copied from the temp file, Path in the result is relative to Dest, and
+	// MinFreeBytes is ignored. Owner is not supported and previous ownership
+	// is not preserved, unless Dest implements
+	// Lchown(name string, uid, gid int) error.
+	Dest DestFS
+
 	// Name to use in upload request
+	//
+	// The fdo.upload spec does not have the device echo the name back, so
+	// the file is identified by the module alone. A device which does send a
+	// "name" message must send exactly this name, otherwise the upload fails
+	// with [ErrNameMismatch].
 	Name string
 
 	// Optional name to use on local filesystem
+	//
+	// If the destination is an existing named pipe (FIFO), e.g. one drained
+	// by another process, the verified upload is written into it once a
+	// reader has opened it, rather than replacing it, and no backup is made.
 	Rename string
 
+	// AllowExtensions optionally restricts the names uploads are placed
+	// under, e.g. []string{".log", ".tar.gz"}, so that executables or
+	// dotfiles are not written into Dir. The base name of the destination,
+	// Rename or the base of Name, must end in one of the extensions, compared
+	// without regard to case, and must not begin with a dot. Otherwise, the
+	// upload fails with [ErrNameNotAllowed] before anything in Dir is
+	// changed. It is ignored when a Sink is used.
+	AllowExtensions []string
+
 	// CreateTemp optionally overrides the behavior of how the module creates a
 	// temporary file to download to.
 	CreateTemp func() (*os.File, error)
 
+	// CreateTempFor optionally overrides the behavior of how the module
+	// creates a temporary file, given the name of the file on the device and
+	// the length it reported. This allows the temp file to be created in Dir,
+	// so that it is renamed rather than copied into place, and preallocated
+	// to fail early when space is insufficient. CreateTempFor takes precedence
+	// over CreateTemp.
+	CreateTempFor func(name string, size int64) (*os.File, error)
+
+	// TempDir optionally sets the directory in which temp files are created
+	// when neither CreateTemp nor CreateTempFor is set. If empty, the default
+	// directory for temporary files is used, which is often on a different
+	// filesystem than Dir and requires the upload to be copied into place.
+	// Setting TempDir to Dir ensures that uploads are atomically renamed.
+	TempDir string
+
+	// PredictableTemp names the temp file after the upload, as reported by
+	// TempPath, instead of with a random suffix, so that a temp file left
+	// behind by a crash can be found after a restart, to be resumed with
+	// ResumeFrom or removed. It takes effect when neither CreateTemp nor
+	// CreateTempFor is set, and the temp file is created in TempDir or, if
+	// empty, Dir rather than the shared default temp directory.
+	//
+	// Uploads of different names never share a temp file, but uploads of the
+	// same Name to the same directory must not run concurrently, as a stale
+	// temp file is replaced. Random names, the default, have neither problem
+	// and leave nothing for other users of the directory to predict.
+	PredictableTemp bool
+
+	// CopyBufferSize optionally sets the size of the buffer used to copy the
+	// temp file to its destination when it cannot be renamed, or when
+	// appending. Larger buffers may improve throughput of large files on fast
+	// storage. Setting it disables copying within the kernel, where the
+	// platform supports it. If zero or negative, [io.Copy] is used.
+	CopyBufferSize int
+
+	// Metadata optionally sends additional messages, such as a content type,
+	// to devices which expect them. Each key is sent as a message name, in
+	// sorted order, after the "name" message. Keys must be valid message names,
+	// per [serviceinfo.ValidateMessageName], which do not collide with
+	// fdo.upload messages and values must be marshalable to CBOR.
+	Metadata map[string]any
+
+	// Compression optionally decompresses uploads which the device compressed
+	// before sending, e.g. [CompressionGzip]. The length and digest sent by
+	// the device cover the compressed data, as sent in "data" messages, which
+	// is verified before being decompressed into place. MaxBytes also limits
+	// the decompressed size. Compression is not supported with a Sink.
+	Compression string
+
+	// NewDecompressor optionally overrides how decompressing readers are
+	// created. It is required for algorithms other than gzip, such as
+	// [CompressionZstd], which is not implemented by the standard library.
+	NewDecompressor func(compression string, r io.Reader) (io.ReadCloser, error)
+
+	// Sink optionally streams the uploaded data to a writer, such as object
+	// storage, instead of a file in Dir. When set, Dir, Rename, CreateTemp,
+	// ResumeFrom, MinFreeBytes, Sync, Mode, Overwrite, and MaxBackups are
+	// ignored.
+	//
+	// Data is written to the sink as it is received, before the digest can be
+	// verified. The writer is closed once the upload completes. If the upload
+	// fails and the writer implements CloseWithError(error) error, such as
+	// [*io.PipeWriter], then it is closed with the error instead, so that
+	// unverified data is not committed.
+	Sink func(name string) (io.WriteCloser, error)
+
+	// ResumeFrom optionally restores the state of a previously interrupted
+	// upload of the named file. It is called once, before the first data
+	// chunk is written, and returns the number of bytes already received, the
+	// running hash (see HashAlg) of those bytes, and the partial file, which will be
+	// appended to. If f is nil, the upload starts from the beginning.
+	//
+	// The fdo.upload module has no message for requesting a starting offset,
+	// so the device always sends the file from its first byte. The first
+	// offset bytes of data are discarded rather than written again.
+	//
+	// If the resumed state cannot be used, because offset is larger than the
+	// length reported by the device or does not match the size of f, then f is
+	// truncated and the upload restarts from the beginning.
+	//
+	// When ResumeFrom is set, the temp file is kept rather than removed if the
+	// upload is interrupted, e.g. by a canceled context or an idle timeout,
+	// so that it may be resumed. It is still removed if the upload fails
+	// verification with [ErrSHAMismatch], [ErrLengthExceeded], or
+	// [ErrShortUpload], as the data received cannot be resumed from.
+	ResumeFrom func(name string) (offset int64, h hash.Hash, f *os.File, _ error)
+
+	// MaxBytes optionally limits the size of the uploaded file. An upload is
+	// rejected as soon as the device reports or sends more bytes than the
+	// limit. Zero means no limit.
+	MaxBytes int64
+
+	// AllowShort accepts uploads where the device sends its digest before
+	// sending as many bytes as it reported in the length message, for devices
+	// which stream data of unknown length. By default such uploads fail with
+	// [ErrShortUpload]. The digest must be sent last for a short upload to be
+	// detected.
+	AllowShort bool
+
+	// MinFreeBytes, if positive, enables a check when the device reports the
+	// file length that the filesystem containing Dir will have at least
+	// MinFreeBytes remaining after the upload. The check is skipped on
+	// platforms where free space cannot be determined.
+	MinFreeBytes int64
+
+	// OnProgress, if set, is called after each chunk of data is written and
+	// once more when the upload completes successfully. Total is the length
+	// reported by the device. Calls are never made concurrently.
+	OnProgress func(name string, written, total int64)
+
+	// OnChunk, if set, is called after each chunk of data is written with the
+	// digest of all data written so far, computed with the hash selected by
+	// HashAlg, e.g. to compare a known prefix and reject a bad upload early.
+	// If it returns an error, the upload fails with an error wrapping
+	// [ErrRejected]. Computing the digest does not disturb the running hash,
+	// but costs a copy of its state and the hashing of one final block per
+	// chunk.
+	OnChunk func(name string, written int64, digest []byte) error
+
+	// PreCommit, if set, is called with the path of the verified temp file
+	// (after decompression, if any) before it is moved into place, e.g. to
+	// scan it for malware. If it returns an error, the temp file is removed,
+	// the destination is not touched, and the upload fails with an error
+	// wrapping [ErrRejected]. PreCommit is not called when a Sink is used.
+	PreCommit func(tempPath string, meta UploadMeta) error
+
+	// HashAlg selects the digest the device is asked to send, either
+	// protocol.Sha256Hash or protocol.Sha384Hash. Defaults to SHA-384.
+	//
+	// SHA-384 is requested with a need-sha value of true, per spec. SHA-256 is
+	// requested with a need-sha value of "sha-256" and must be supported by
+	// the device module.
+	HashAlg protocol.HashAlg
+
+	// DigestMessageName optionally overrides the name of the message in which
+	// the device sends the digest, for devices which use a non-standard name
+	// such as "hash". The name is sent as the need-sha value, in place of
+	// true or "sha-256", and HashAlg still selects the hash function. It must
+	// be a valid message name which does not collide with other fdo.upload
+	// messages or Metadata keys. Defaults to "sha-384" or "sha-256", per
+	// HashAlg.
+	DigestMessageName string
+
+	// ExpectedSHA384 optionally pins the SHA-384 digest of the data sent by
+	// the device, e.g. when the file must match a known artifact. The data is
+	// verified against it in addition to the digest reported by the device,
+	// so that a device cannot substitute other content with a self-consistent
+	// digest. A mismatch fails the upload with [ErrSHAMismatch]. It requires
+	// HashAlg to select SHA-384.
+	ExpectedSHA384 []byte
+
+	// VerifyHash optionally computes an additional digest of the data sent by
+	// the device, e.g. SHA-512 or BLAKE2, for the owner's own records. It does
+	// not change the digest requested from or verified against the device.
+	// The digest is reported by Result as VerifyDigest.
+	VerifyHash func() hash.Hash
+
+	// QuarantineDir optionally keeps the data of an upload which fails digest
+	// verification for inspection, rather than removing it. The temp file is
+	// moved into QuarantineDir, named by the escaped Name with the time of the
+	// failure inserted before its extension, e.g.
+	// "logs%2Fdevice.20060102150405.000000.log", before the upload fails with
+	// [ErrSHAMismatch]. The directory must exist when the upload is
+	// requested. It is ignored when a Sink is used.
+	QuarantineDir string
+
+	// Sync causes the uploaded file and the directory containing it to be
+	// flushed to stable storage before the module completes, so that a
+	// successful upload survives power loss, at the cost of throughput.
+	Sync bool
+
+	// Mode sets the permissions of the uploaded file when it does not replace
+	// an existing file. When an existing file is replaced, its permissions
+	// (and ownership, where supported) are preserved. Defaults to 0600.
+	Mode os.FileMode
+
+	// Overwrite sets the policy for replacing an existing file. By default, it
+	// is replaced, and only backed up if MaxBackups or BackupNamer enable
+	// backups.
+	Overwrite OverwritePolicy
+
+	// MaxBackups controls whether an existing file is backed up before being
+	// replaced. Backups are named by inserting the modification time of the
+	// replaced file before its extension, e.g. "name.20060102150405.000000.ext".
+	//
+	// If zero, the existing file is overwritten without a backup, unless
+	// Overwrite is OverwriteBackup, in which case only the most recent backup
+	// is kept. If positive, the oldest backups beyond MaxBackups are deleted
+	// after each successful upload. If negative, all backups are kept.
+	MaxBackups int
+
+	// BackupNamer optionally overrides how backups are named, given the name of
+	// the file being replaced within Dir and its info. Setting BackupNamer
+	// enables backups, even if MaxBackups is zero, but only backups using the
+	// default naming are pruned.
+	//
+	// The returned name must be a local path within Dir which is not already
+	// in use. Missing parent directories are created, so backups may be moved
+	// into a subdirectory. If the returned name is empty, the existing file is
+	// deleted by being replaced without a backup.
+	BackupNamer func(name string, info os.FileInfo) (string, error)
+
+	// Owner optionally sets the owner and group of the uploaded file, taking
+	// precedence over those of any replaced file. Changing ownership usually
+	// requires privileges and is not supported on all platforms.
+	Owner *FileOwner
+
+	// WriteMode controls what happens when the destination already exists.
+	// By default, it is replaced.
+	WriteMode WriteMode
+
+	// CreateDirs causes any missing parent directories of the destination
+	// within Dir to be created, with permissions DirMode, so that Rename may
+	// place the file into a new subdirectory. Directories are created through
+	// an [os.Root], so they cannot escape Dir. If false, the upload fails when
+	// the parent directory does not exist.
+	CreateDirs bool
+
+	// DirMode sets the permissions of directories created for the upload or
+	// its backups. They are applied exactly, regardless of the umask, when
+	// the DestFS supports Chmod(name string, mode fs.FileMode) error, as the
+	// default [os.Root] does. Existing directories are not modified. Defaults
+	// to 0700.
+	DirMode os.FileMode
+
+	// IdleTimeout optionally fails the upload if no service info is received
+	// from the device for the given duration after the upload is requested.
+	// The temp file of an idle upload is removed. If zero, uploads never time
+	// out.
+	IdleTimeout time.Duration
+
+	// MaxBytesPerSecond optionally limits the rate at which data is written,
+	// allowing bursts of up to one second of data. Handling of data messages
+	// is delayed to stay under the limit. Zero means no limit.
+	MaxBytesPerSecond int64
+
+	// Backpressure optionally reports whether the owner is falling behind in
+	// handling the upload, e.g. a bounded disk writer is full or an fsync is
+	// pending. While the upload is in progress and Backpressure returns true,
+	// ProduceInfo returns blockPeer, so that the device sends no service info
+	// in the next exchange and may not send more data until Backpressure
+	// returns false. The idle timeout is restarted while the device is
+	// blocked, but MaxDuration still applies.
+	Backpressure func() bool
+
+	// Gate optionally pauses uploads, e.g. during a maintenance window. The
+	// upload is always requested, but while Gate returns false, ProduceInfo
+	// returns blockPeer so that the device stays in the session but sends no
+	// more data. Gate is checked again in the next exchange. The idle timeout
+	// is restarted while paused, but MaxDuration still applies.
+	Gate func() bool
+
+	// MaxDuration optionally limits the total time an upload may take from
+	// when it is requested, regardless of progress. An upload which takes
+	// longer fails with [ErrDeadlineExceeded] and its temp file is removed.
+	// Zero means no limit.
+	MaxDuration time.Duration
+
+	// DigestTimeout limits how long the device may take to send the digest
+	// once all data has been received, i.e. the reported length was reached
+	// or an empty chunk ended the data, so that a device which never
+	// completes the upload does not hold the module indefinitely. The upload
+	// then fails with [ErrMissingDigest] and its temp file is removed. Time
+	// while the device is blocked by Gate or Backpressure is not counted.
+	// Defaults to one minute. If negative, the digest is awaited
+	// indefinitely.
+	DigestTimeout time.Duration
+
+	// MinCipherStrength optionally requires the TO2 session to be encrypted
+	// with a key of at least this many bits, e.g. 256 to refuse AES-128
+	// cipher suites. The cipher suite is read from the context with
+	// [serviceinfo.CipherSuiteKey]. If it is weaker or missing, the upload is
+	// never requested and fails with [ErrWeakCipher]. Zero means no minimum.
+	MinCipherStrength int
+
+	// ShouldUpload, if set, is called with the devmod reported by the device
+	// before the upload is requested. If it returns false, the module
+	// completes without requesting the file and Result reports it as
+	// Skipped. The devmod is read from the context with
+	// [serviceinfo.DevmodKey]. If it is missing, the upload fails rather than
+	// guessing whether the file applies.
+	ShouldUpload func(devmod serviceinfo.Devmod) bool
+
+	// AllowInactive treats a device which declines the fdo.upload module, by
+	// sending active=false, as having no file to upload: the module completes
+	// without error and Result reports the upload as Skipped. It is counted
+	// by Metrics as neither succeeded nor failed. Otherwise, the upload fails
+	// with [ErrModuleInactive].
+	AllowInactive bool
+
+	// WriteReceipt enables writing an [UploadReceipt] as JSON next to the
+	// uploaded file once it is in place. The receipt is named by appending
+	// ReceiptSuffix to the name of the uploaded file. Receipts are not
+	// written when a Sink is used. Failing to write the receipt does not fail
+	// the upload, but is logged and reported by [UploadResult.ReceiptErr].
+	//
+	// When the upload replaces a file which is backed up, the receipt also
+	// records the backup and its SHA-384, which is computed by reading the
+	// file before it is moved aside. This requires files opened from Dest,
+	// if set, to implement [io.Reader].
+	WriteReceipt bool
+
+	// ReceiptSuffix defaults to ".receipt.json".
+	ReceiptSuffix string
+
+	// DryRun, if set, receives and verifies the upload, but only checks that
+	// it could be placed in Dir rather than placing it. The temp file is
+	// removed and Dir, including any existing file and its backups, is left
+	// unchanged. The result still reports the would-be path. No receipt is
+	// written. DryRun is ignored when a Sink is used.
+	DryRun bool
+
+	// Logger receives debug events as the upload progresses, grouped under
+	// "fdo.upload", and errors which cannot be returned in full, such as
+	// failing to restore a backup or to remove a temp file. If nil, nothing
+	// is logged.
+	Logger *slog.Logger
+
+	// Metrics optionally counts uploads started, succeeded, and failed, and
+	// bytes written. Defaults to [NopMetrics].
+	Metrics Metrics
+
 	// internal state
-	requested bool
-	length    int64
-	written   int64
-	sha384    []byte
+	requested    bool
+	reported     bool   // success or failure has been counted
+	dest         string // Rename or the base of Name
+	backup       string // backup of the replaced file, within Dir
+	backupDigest string // SHA-384 of backup, for the receipt
+	dir          string // Dir, resolved by resolvedDir
+	started      time.Time
+	deadline     time.Time
+	dataReceived time.Time // when all data was received without a digest
+	hasLength    bool
+	done         bool
+	length       int64
+	written      int64
+	skip         int64
+	digest       []byte
+	// digestFirst is set when the digest was received before any data
+	digestFirst bool
+	// dataEnded is set when an empty data chunk marks the end of data
+	dataEnded bool
+	// chunkDigest is the digest the device sent for the next data message,
+	// which is hashed by chunkHash as it is received
+	chunkDigest []byte
+	chunkHash   hash.Hash
+
+	limiter tokenBucket
 
-	once sync.Once
-	temp *os.File
-	hash hash.Hash
+	once   sync.Once
+	temp   *os.File
+	sink   io.WriteCloser
+	out    io.Writer // temp or sink
+	hash   hash.Hash
+	extra  hash.Hash // created by VerifyHash
+	buf    []byte    // for copying data chunks
+	method string    // how the file was placed
+	result *UploadResult
+
+	// status is a snapshot of the state and aborted is set by Abort, both
+	// guarded by mu so that they may be accessed concurrently
+	mu      sync.Mutex
+	status  UploadStatus
+	aborted bool
 }
 
 var _ serviceinfo.OwnerModule = (*UploadRequest)(nil)
+var _ serviceinfo.ProgressReporter = (*UploadRequest)(nil)
+
+// Compression algorithms for UploadRequest.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Kinds of upload failures, which may be checked with [errors.Is].
+var (
+	ErrSHAMismatch       = errors.New("digest mismatch")
+	ErrLengthExceeded    = errors.New("length exceeded")
+	ErrShortUpload       = errors.New("fewer bytes than length")
+	ErrIdleTimeout       = errors.New("idle timeout")
+	ErrDeadlineExceeded  = errors.New("upload deadline exceeded")
+	ErrFileExists        = errors.New("destination file exists")
+	ErrPathTraversal     = errors.New("path traversal")
+	ErrNameNotAllowed    = errors.New("name not allowed")
+	ErrNameMismatch      = errors.New("name mismatch")
+	ErrRejected          = errors.New("rejected before commit")
+	ErrIncompleteChunk   = errors.New("incomplete chunk")
+	ErrMissingDigest     = errors.New("missing digest")
+	ErrDiskFull          = errors.New("disk full")
+	ErrIO                = errors.New("i/o error")
+	ErrDeviceAbort       = errors.New("device aborted")
+	ErrWeakCipher        = errors.New("cipher suite too weak")
+	ErrUnexpectedMessage = errors.New("unexpected message")
+	ErrAborted           = errors.New("aborted")
+)
+
+// DeviceAbortError is the reason given by the device for aborting an upload,
+// with an "error" or "abort" message. It is wrapped by an UploadError with
+// the Kind [ErrDeviceAbort].
+type DeviceAbortError struct {
+	// Message sent by the device
+	Message string
+}
+
+func (e *DeviceAbortError) Error() string { return "device reported error: " + e.Message }
+
+// UploadError describes a failed upload. It wraps both Kind and Err.
+type UploadError struct {
+	// Name of the uploaded file on the device
+	Name string
+	// Op is the step of the upload that failed, e.g. "verify"
+	Op string
+	// Kind is one of the ErrXXX sentinel errors
+	Kind error
+	// Err is an optional error providing further detail
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("upload of %q: %s: %v", e.Name, e.Op, e.Kind)
+	}
+	return fmt.Sprintf("upload of %q: %s: %v", e.Name, e.Op, e.Err)
+}
+
+// Unwrap returns Kind and, if set, Err.
+func (e *UploadError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// marshalMetadata validates and marshals Metadata, sorted by key.
+func (u *UploadRequest) marshalMetadata() ([]*serviceinfo.KV, error) {
+	var kvs []*serviceinfo.KV
+	for _, key := range slices.Sorted(maps.Keys(u.Metadata)) {
+		if !isMetadataKey(key) {
+			return nil, fmt.Errorf("upload of %q: invalid metadata key %q", u.Name, key)
+		}
+		val, err := cbor.Marshal(u.Metadata[key])
+		if err != nil {
+			return nil, fmt.Errorf("upload of %q: error marshaling metadata %q: %w", u.Name, key, err)
+		}
+		kvs = append(kvs, &serviceinfo.KV{Key: key, Val: val})
+	}
+	return kvs, nil
+}
+
+// isMetadataKey reports whether key is a valid service info message name
+// which is not used by fdo.upload.
+func isMetadataKey(key string) bool {
+	switch key {
+	case "active", "need-sha", "name", "length", "data", "sha-256", "sha-384", "chunk-sha-256", "chunk-sha-384",
+		"error", "abort":
+		return false
+	}
+	return serviceinfo.ValidateMessageName(key) == nil
+}
+
+// WriteMode controls how an upload is written when its destination exists.
+type WriteMode int
+
+const (
+	// WriteReplace replaces the existing file, as set by the Overwrite
+	// policy.
+	WriteReplace WriteMode = iota
+	// WriteAppend appends the upload to the existing file without a backup.
+	// The digest is verified against the uploaded data only and the upload
+	// result size is that of the appended data.
+	WriteAppend
+	// WriteFail fails the upload with [ErrFileExists].
+	WriteFail
+)
+
+// FileOwner identifies the owner and group of a file. A UID or GID of -1
+// leaves it unchanged.
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// UploadMeta describes a verified upload which has not yet been moved into
+// place. See UploadRequest.PreCommit.
+type UploadMeta struct {
+	// Name of the file on the device
+	Name string
+	// Rename is the destination of the file, relative to Dir
+	Rename string
+	// Length is the size of the temp file in bytes
+	Length int64
+	// DigestAlg is the name of the digest message, e.g. "sha-384"
+	DigestAlg string
+	// Digest sent by the device and verified against the received data. When
+	// the upload is compressed, it is the digest of the compressed data.
+	Digest []byte
+}
+
+// UploadResult describes a completed upload.
+type UploadResult struct {
+	// Absolute path of the uploaded file, relative to Dest if set, and empty
+	// when a Sink is used
+	Path string
+
+	// Number of bytes written
+	Size int64
+
+	// Method used to place the file in its destination: "rename" when the
+	// temp file was on the same filesystem as Dir, "copy" when it was not or
+	// Dest is set, "append" for WriteAppend, or "stream" when the destination
+	// is an existing named pipe. It is empty when a Sink is used or for a
+	// DryRun.
+	Method string
+
+	// VerifyDigest is the digest computed by VerifyHash, hex encoded, or
+	// empty if VerifyHash is not set
+	VerifyDigest string
+
+	// ReceiptErr is the error writing the receipt when WriteReceipt is set.
+	// The uploaded file is in place regardless.
+	ReceiptErr error
+
+	// Skipped is set when ShouldUpload returned false, so the file was never
+	// requested, or when the device declined the module and AllowInactive is
+	// set
+	Skipped bool
+}
+
+// Reset clears the state of the previous upload, including its result, so
+// that the UploadRequest can be used again, typically after changing Name.
+// The configuration fields are not modified. If an upload is in progress, it
+// is interrupted as if its context were canceled.
+func (u *UploadRequest) Reset() {
+	if !u.done {
+		u.cleanup(context.Canceled)
+	}
+	u.requested, u.reported, u.dest, u.dir = false, false, "", ""
+	u.started, u.deadline, u.dataReceived = time.Time{}, time.Time{}, time.Time{}
+	u.hasLength, u.done = false, false
+	u.length, u.written, u.skip = 0, 0, 0
+	u.digest, u.digestFirst, u.dataEnded = nil, false, false
+	u.chunkDigest, u.chunkHash = nil, nil
+	u.limiter = tokenBucket{}
+	u.once = sync.Once{}
+	u.temp, u.sink, u.out, u.hash, u.extra = nil, nil, nil, nil, nil
+	u.result, u.method = nil, ""
+	u.backup, u.backupDigest = "", ""
+	u.mu.Lock()
+	u.aborted = false
+	u.mu.Unlock()
+	u.updateStatus()
+}
+
+// Abort stops the upload without affecting the rest of the TO2 session. The
+// next call to HandleInfo or ProduceInfo, or the data message being handled,
+// fails with [ErrAborted] and removes the temp file. Abort has no effect once
+// the upload is done. Unlike the other methods, it may be called at any time,
+// including concurrently with HandleInfo and ProduceInfo.
+func (u *UploadRequest) Abort() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.aborted = true
+}
+
+// checkAborted fails the upload if Abort has been called.
+func (u *UploadRequest) checkAborted(op string) error {
+	u.mu.Lock()
+	aborted := u.aborted
+	u.mu.Unlock()
+	if !aborted || u.done {
+		return nil
+	}
+	return &UploadError{Name: u.Name, Op: op, Kind: ErrAborted, Err: errors.New("upload aborted by owner")}
+}
+
+// UploadStatus is a snapshot of the progress of an upload, e.g. for logging
+// or diagnosing a stalled upload.
+type UploadStatus struct {
+	// Requested is set once the upload has been requested from the device
+	Requested bool
+
+	// Length reported by the device, valid only if HasLength is set
+	Length    int64
+	HasLength bool
+
+	// Number of bytes of data written so far
+	Written int64
+
+	// HaveDigest is set once the digest has been received
+	HaveDigest bool
+
+	// Done is set once the upload has been verified and placed
+	Done bool
+}
+
+// Status returns the progress of the upload as of the last message handled or
+// produced. Unlike the other methods, it may be called at any time, including
+// concurrently with HandleInfo and ProduceInfo.
+func (u *UploadRequest) Status() UploadStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.status
+}
+
+// Progress implements serviceinfo.ProgressReporter, reporting the bytes of
+// data written and the length reported by the device, or -1 if the device has
+// not yet sent the length.
+func (u *UploadRequest) Progress() (done, total int64) {
+	status := u.Status()
+	if !status.HasLength {
+		return status.Written, -1
+	}
+	return status.Written, status.Length
+}
+
+// updateStatus publishes the current state for Status.
+func (u *UploadRequest) updateStatus() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status = UploadStatus{
+		Requested:  u.requested,
+		Length:     u.length,
+		HasLength:  u.hasLength,
+		Written:    u.written,
+		HaveDigest: len(u.digest) > 0,
+		Done:       u.done,
+	}
+}
+
+// Result returns the outcome of the upload. It is only valid, indicated by ok,
+// once ProduceInfo has reported that the module is done.
+func (u *UploadRequest) Result() (result UploadResult, ok bool) {
+	if u.result == nil {
+		return UploadResult{}, false
+	}
+	return *u.result, true
+}
 
 // HandleInfo implements serviceinfo.OwnerModule.
+//
+// Each call handles a single message, so control messages may be interleaved
+// with data messages. The length and digest may each be sent before, between,
+// or after data messages, and may be repeated with the same value, but a
+// value which changes fails the upload with [ErrUnexpectedMessage], as does
+// data following an empty data chunk or any message other than "active" once
+// the upload is complete.
+//
+// A device may also have data verified as it arrives by sending a digest
+// message prefixed with "chunk-", e.g. "chunk-sha-384", before a data
+// message. Its body is the digest of the data in the next data message, using
+// the same algorithm as the digest of the whole file. A chunk which does not
+// match fails the upload with [ErrSHAMismatch] and its offset once the data
+// message is handled. Without chunk digests, or in addition to them, the
+// whole file is verified against its digest.
 func (u *UploadRequest) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	err := u.handleInfo(ctx, messageName, messageBody)
+	if err != nil {
+		u.cleanup(err)
+	}
+	u.count(err)
+	u.updateStatus()
+	return err
+}
+
+func (u *UploadRequest) handleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	u.resetIdle()
+
+	if err := u.checkAborted(messageName); err != nil {
+		return err
+	}
+	if u.done && messageName != "active" {
+		return &UploadError{Name: u.Name, Op: messageName, Kind: ErrUnexpectedMessage,
+			Err: errors.New("message received after upload completed")}
+	}
+
 	switch messageName {
 	case "active":
 		var deviceActive bool
@@ -59,111 +772,1375 @@ func (u *UploadRequest) HandleInfo(ctx context.Context, messageName string, mess
 			return fmt.Errorf("error decoding message %s: %w", messageName, err)
 		}
 		if !deviceActive {
-			return fmt.Errorf("device service info module is not active")
+			return u.inactive()
 		}
 		return nil
 
-	case "length":
-		if err := cbor.NewDecoder(messageBody).Decode(&u.length); err != nil {
+	case "name":
+		var name string
+		if err := cbor.NewDecoder(messageBody).Decode(&name); err != nil {
 			return fmt.Errorf("error decoding message %s: %w", messageName, err)
 		}
+		if name != u.Name {
+			return &UploadError{Name: u.Name, Op: "name", Kind: ErrNameMismatch,
+				Err: fmt.Errorf("device sent name %q", name)}
+		}
 		return nil
 
+	case "length":
+		var length int64
+		if err := decodeStrict(messageBody, &length); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if length < 0 {
+			return fmt.Errorf("upload of %q: invalid length %d", u.Name, length)
+		}
+		if u.hasLength && length != u.length {
+			return &UploadError{Name: u.Name, Op: "length", Kind: ErrUnexpectedMessage,
+				Err: fmt.Errorf("length changed from %d to %d", u.length, length)}
+		}
+		u.length, u.hasLength = length, true
+		u.debug("length received", "length", u.length)
+		if u.MaxBytes > 0 && u.length > u.MaxBytes {
+			return &UploadError{Name: u.Name, Op: "length", Kind: ErrLengthExceeded,
+				Err: fmt.Errorf("length %d exceeds max of %d bytes", u.length, u.MaxBytes)}
+		}
+		if u.MinFreeBytes > 0 && u.Sink == nil && u.Dest == nil {
+			if err := u.checkFreeSpace(ctx); err != nil {
+				return err
+			}
+		}
+		// Data may have been sent before its length
+		return u.finalizeIfReady(ctx)
+
 	case "data":
 		var err error
 		u.once.Do(func() {
-			createTemp := u.CreateTemp
-			if createTemp == nil {
-				createTemp = func() (*os.File, error) {
-					return os.CreateTemp("", "fdo.upload_*")
-				}
+			if err = u.openTemp(); err == nil {
+				u.debug("receiving data", "offset", u.written)
 			}
-			u.temp, err = createTemp()
-			u.hash = sha512.New384()
 		})
 		if err != nil {
-			return fmt.Errorf("error creating temp file for upload of %q: %w", u.Name, err)
+			return fmt.Errorf("error opening destination for upload of %q: %w", u.Name, err)
 		}
-		var chunk []byte
+		offset := u.written - u.skip
+		// Chunks are streamed from the message body, rather than decoded into
+		// memory, so that indefinite length byte strings are not buffered
+		dec := cbor.NewDecoder(messageBody)
 		for {
-			if err := cbor.NewDecoder(messageBody).Decode(&chunk); errors.Is(err, io.EOF) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			if err := u.checkDeadline("data"); err != nil {
+				return err
+			}
+			if err := u.checkAborted("data"); err != nil {
+				return err
+			}
+			chunk, err := dec.DecodeReader()
+			if errors.Is(err, io.EOF) {
 				break
+			} else if errors.Is(err, io.ErrUnexpectedEOF) {
+				return u.incompleteChunk(err)
 			} else if err != nil {
 				return fmt.Errorf("error decoding message %s: %w", messageName, err)
 			}
-			n, err := io.MultiWriter(u.temp, u.hash).Write(chunk)
+			if u.dataEnded {
+				return &UploadError{Name: u.Name, Op: "data", Kind: ErrUnexpectedMessage,
+					Err: errors.New("data received after an empty chunk ended the data")}
+			}
+			n, err := u.writeChunk(ctx, chunk)
 			if err != nil {
-				return fmt.Errorf("error writing upload data chunk of %q: %w", u.Name, err)
+				return err
+			}
+			if n == 0 {
+				u.dataEnded = true
+			}
+			if u.OnChunk != nil {
+				if err := u.OnChunk(u.Name, u.written, u.hash.Sum(nil)); err != nil {
+					return &UploadError{Name: u.Name, Op: "data", Kind: ErrRejected, Err: err}
+				}
+			}
+			if u.OnProgress != nil {
+				u.OnProgress(u.Name, u.written, u.length)
 			}
-			u.written += int64(n)
 		}
-		return nil
+		if err := u.verifyChunk(offset); err != nil {
+			return err
+		}
+		return u.finalizeIfReady(ctx)
 
-	case "sha-384":
-		if err := cbor.NewDecoder(messageBody).Decode(&u.sha384); err != nil {
+	case "error", "abort":
+		// The reason is usually text, but any value is reported
+		var reason any
+		if err := cbor.NewDecoder(messageBody).Decode(&reason); err != nil {
 			return fmt.Errorf("error decoding message %s: %w", messageName, err)
 		}
-		return nil
+		msg, ok := reason.(string)
+		if !ok {
+			msg = fmt.Sprint(reason)
+		}
+		return &UploadError{Name: u.Name, Op: messageName, Kind: ErrDeviceAbort, Err: &DeviceAbortError{Message: msg}}
+
+	case "sha-256", "sha-384":
+		return u.handleDigest(ctx, messageName, messageBody)
 
 	default:
+		if digestName, _, err := u.digestAlg(); err == nil && messageName == digestName {
+			return u.handleDigest(ctx, messageName, messageBody)
+		} else if err == nil && messageName == "chunk-"+digestName {
+			return u.handleChunkDigest(messageName, messageBody)
+		}
 		return fmt.Errorf("unsupported message %q", messageName)
 	}
 }
 
-// ProduceInfo implements serviceinfo.OwnerModule.
-func (u *UploadRequest) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
-	if !u.requested {
-		return u.request(producer)
+// handleChunkDigest receives the digest of the data in the next data message.
+func (u *UploadRequest) handleChunkDigest(messageName string, messageBody io.Reader) error {
+	_, hashFunc, err := u.digestAlg()
+	if err != nil {
+		return err
 	}
-	if len(u.sha384) > 0 && u.length > 0 && u.written >= u.length {
-		return u.finalize()
+	var digest []byte
+	if err := decodeStrict(messageBody, &digest); err != nil {
+		return fmt.Errorf("error decoding message %s: %w", messageName, err)
 	}
-	return false, false, nil
+	if len(digest) != hashFunc.Size() {
+		return fmt.Errorf("upload of %q: invalid digest length for %s: got %d bytes, expected %d",
+			u.Name, messageName, len(digest), hashFunc.Size())
+	}
+	if u.chunkDigest != nil {
+		return &UploadError{Name: u.Name, Op: messageName, Kind: ErrUnexpectedMessage,
+			Err: errors.New("chunk digest received before data for the previous chunk digest")}
+	}
+	u.chunkDigest, u.chunkHash = digest, hashFunc.New()
+	return nil
 }
 
-func (u *UploadRequest) request(producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
-	// Marshal message bodies
-	trueBody, err := cbor.Marshal(true)
+// verifyChunk checks the data message starting at offset against the chunk
+// digest sent before it, if any.
+func (u *UploadRequest) verifyChunk(offset int64) error {
+	if u.chunkDigest == nil {
+		return nil
+	}
+	expect, got := u.chunkDigest, u.chunkHash.Sum(nil)
+	u.chunkDigest, u.chunkHash = nil, nil
+	if !bytes.Equal(got, expect) {
+		return &UploadError{Name: u.Name, Op: "data", Kind: ErrSHAMismatch,
+			Err: fmt.Errorf("chunk at offset %d does not match its digest", offset)}
+	}
+	u.debug("chunk verified", "offset", offset)
+	return nil
+}
+
+// decodeStrict decodes a message body which must contain exactly one value in
+// its shortest form. It is used for the length and digest, which the upload
+// is verified against.
+func decodeStrict(messageBody io.Reader, v any) error {
+	body, err := io.ReadAll(messageBody)
 	if err != nil {
-		return false, false, err
+		return err
 	}
-	nameBody, err := cbor.Marshal(u.Name)
+	return cbor.UnmarshalStrict(body, v)
+}
+
+func (u *UploadRequest) handleDigest(ctx context.Context, messageName string, messageBody io.Reader) error {
+	digestName, hashFunc, err := u.digestAlg()
 	if err != nil {
-		return false, false, err
+		return err
+	}
+	if messageName != digestName {
+		return fmt.Errorf("upload of %q: received %s digest, expected %s", u.Name, messageName, digestName)
+	}
+	var digest []byte
+	if err := decodeStrict(messageBody, &digest); err != nil {
+		return fmt.Errorf("error decoding message %s: %w", messageName, err)
+	}
+	if len(digest) != hashFunc.Size() {
+		return fmt.Errorf("upload of %q: invalid digest length for %s: got %d bytes, expected %d",
+			u.Name, messageName, len(digest), hashFunc.Size())
 	}
+	if u.digest != nil {
+		if !bytes.Equal(digest, u.digest) {
+			return &UploadError{Name: u.Name, Op: messageName, Kind: ErrUnexpectedMessage,
+				Err: errors.New("digest changed")}
+		}
+		return nil
+	}
+	u.digest = digest
+	// A digest sent before any data is followed by the full length of data
+	u.digestFirst = u.written == 0 && (u.length > 0 || !u.hasLength)
+	return u.finalizeIfReady(ctx)
+}
 
-	// Send upload messages
-	if err := producer.WriteChunk("active", trueBody); err != nil {
-		return false, false, err
+// writeChunk copies one chunk of data to the destination and the running
+// hash, using a fixed size buffer, and returns the size of the chunk.
+func (u *UploadRequest) writeChunk(ctx context.Context, chunk io.Reader) (int64, error) {
+	if u.buf == nil {
+		u.buf = make([]byte, 32*1024)
 	}
-	if err := producer.WriteChunk("need-sha", trueBody); err != nil {
-		return false, false, err
+	var total int64
+	for {
+		n, readErr := chunk.Read(u.buf)
+		if u.chunkHash != nil {
+			_, _ = u.chunkHash.Write(u.buf[:n])
+		}
+		if err := u.writeData(ctx, u.buf[:n]); err != nil {
+			return total, err
+		}
+		total += int64(n)
+		if errors.Is(readErr, io.EOF) {
+			return total, nil
+		} else if errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return total, u.incompleteChunk(readErr)
+		} else if readErr != nil {
+			return total, fmt.Errorf("error decoding message data: %w", readErr)
+		}
 	}
-	if err := producer.WriteChunk("name", nameBody); err != nil {
-		return false, false, err
+}
+
+// writeError classifies a failure to write upload data as [ErrDiskFull], when
+// the filesystem reports that it is out of space or quota, or [ErrIO].
+func (u *UploadRequest) writeError(op string, err error) error {
+	kind := ErrIO
+	if isDiskFull(err) {
+		kind = ErrDiskFull
 	}
+	return &UploadError{Name: u.Name, Op: op, Kind: kind, Err: err}
+}
 
-	u.requested = true
-	return false, false, nil
+// incompleteChunk fails the upload when a data message ends before the chunk
+// it declares. Each message is received whole, so the missing bytes will not
+// follow in a later message.
+func (u *UploadRequest) incompleteChunk(err error) error {
+	return &UploadError{Name: u.Name, Op: "data", Kind: ErrIncompleteChunk,
+		Err: fmt.Errorf("data message ended after %d bytes of upload: %w", u.written, err)}
 }
 
-func (u *UploadRequest) finalize() (blockPeer, moduleDone bool, _ error) {
-	if u.written > u.length {
-		return false, false, fmt.Errorf("uploaded file %q: received %d bytes, expected %d", u.Name, u.written, u.length)
+func (u *UploadRequest) writeData(ctx context.Context, p []byte) error {
+	if u.skip > 0 {
+		n := min(u.skip, int64(len(p)))
+		p, u.skip = p[n:], u.skip-n
+	}
+	if len(p) == 0 {
+		return nil
 	}
-	if !bytes.Equal(u.sha384, u.hash.Sum(nil)[:]) {
-		return false, false, fmt.Errorf("uploaded file %q: SHA-384 did not match", u.Name)
+	if u.MaxBytes > 0 && u.written+int64(len(p)) > u.MaxBytes {
+		return &UploadError{Name: u.Name, Op: "data", Kind: ErrLengthExceeded,
+			Err: fmt.Errorf("received more than max of %d bytes", u.MaxBytes)}
 	}
-	if err := u.temp.Close(); err != nil {
-		return false, false, fmt.Errorf("error closing temp file for upload %q: %w", u.Name, err)
+	if err := u.limiter.wait(ctx, u.MaxBytesPerSecond, len(p)); err != nil {
+		return err
 	}
-	// TODO: Enforce chroot-like security
-	if u.Rename == "" {
-		u.Rename = filepath.Base(u.Name)
+	w := io.MultiWriter(u.out, u.hash)
+	if u.extra != nil {
+		w = io.MultiWriter(u.out, u.hash, u.extra)
 	}
-	oldpath, newpath := u.temp.Name(), filepath.Join(u.Dir, u.Rename)
-	if err := os.Rename(oldpath, newpath); err != nil {
-		return false, false, fmt.Errorf("error renaming temp file %q to %q: %w", oldpath, newpath, err)
+	n, err := w.Write(p)
+	if err != nil {
+		return u.writeError("data", fmt.Errorf("error writing data chunk: %w", err))
 	}
-	return false, true, nil
+	u.written += int64(n)
+	u.metrics().AddBytes(int64(n))
+	return nil
+}
+
+// debug logs an event of the upload, if debug logging is enabled.
+func (u *UploadRequest) debug(msg string, args ...any) {
+	u.log(slog.LevelDebug, msg, args...)
+}
+
+func (u *UploadRequest) log(level slog.Level, msg string, args ...any) {
+	if u.Logger == nil || !u.Logger.Enabled(context.Background(), level) {
+		return
+	}
+	u.Logger.WithGroup("fdo.upload").Log(context.Background(), level, msg, append([]any{"name", u.Name}, args...)...)
+}
+
+// removeTemp removes a temp file which is no longer needed. Failures are
+// logged, rather than returned, so that orphaned temp files are visible
+// without masking the outcome of the upload. A file which no longer exists,
+// e.g. because it was already removed, is not a failure.
+func (u *UploadRequest) removeTemp(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		u.log(slog.LevelWarn, "error removing temp file", "file", path, "error", err)
+	}
+}
+
+// cleanup closes the temp file of an upload which failed with err and,
+// unless it may be resumed, removes it. A temp file which failed
+// verification would not verify when resumed either, so it is always
+// removed.
+func (u *UploadRequest) cleanup(err error) {
+	if u.sink != nil {
+		u.closeSink(fmt.Errorf("upload of %q was interrupted", u.Name))
+		return
+	}
+	if u.temp == nil {
+		return
+	}
+	_ = u.temp.Close()
+	if u.ResumeFrom == nil || verificationFailed(err) {
+		u.removeTemp(u.temp.Name())
+	}
+	u.temp = nil
+}
+
+// verificationFailed reports whether err is due to the received data not
+// matching the length or digest which the device reported.
+func verificationFailed(err error) bool {
+	return errors.Is(err, ErrSHAMismatch) || errors.Is(err, ErrLengthExceeded) || errors.Is(err, ErrShortUpload)
+}
+
+// digestAlg returns the name of the digest message and its hash function.
+func (u *UploadRequest) digestAlg() (messageName string, hashFunc crypto.Hash, _ error) {
+	switch u.HashAlg {
+	case 0, protocol.Sha384Hash:
+		messageName, hashFunc = "sha-384", crypto.SHA384
+	case protocol.Sha256Hash:
+		messageName, hashFunc = "sha-256", crypto.SHA256
+	default:
+		return "", 0, fmt.Errorf("unsupported upload hash algorithm: %d", u.HashAlg)
+	}
+	if len(u.ExpectedSHA384) > 0 && (hashFunc != crypto.SHA384 || len(u.ExpectedSHA384) != hashFunc.Size()) {
+		return "", 0, fmt.Errorf("expected SHA-384 digest requires SHA-384 hash algorithm and %d bytes, got %s and %d bytes",
+			crypto.SHA384.Size(), hashFunc, len(u.ExpectedSHA384))
+	}
+	if u.DigestMessageName == "" || u.DigestMessageName == messageName {
+		return messageName, hashFunc, nil
+	}
+	if _, ok := u.Metadata[u.DigestMessageName]; ok || !isMetadataKey(u.DigestMessageName) {
+		return "", 0, fmt.Errorf("invalid upload digest message name %q", u.DigestMessageName)
+	}
+	return u.DigestMessageName, hashFunc, nil
+}
+
+func (u *UploadRequest) checkFreeSpace(ctx context.Context) error {
+	dir, err := u.resolvedDir()
+	if err != nil {
+		return err
+	}
+	available, ok, err := freeSpace(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("error checking free space in %q: %w", u.Dir, err)
+	}
+	if ok && u.length > available-u.MinFreeBytes {
+		return fmt.Errorf("upload of %q: requested %d bytes, but %q has %d bytes available (minimum free %d)",
+			u.Name, u.length, u.Dir, available, u.MinFreeBytes)
+	}
+	return nil
+}
+
+// openTemp opens the sink or temp file that data will be written to.
+func (u *UploadRequest) openTemp() error {
+	_, hashFunc, err := u.digestAlg()
+	if err != nil {
+		return err
+	}
+	if u.VerifyHash != nil {
+		u.extra = u.VerifyHash()
+	}
+	if u.Sink != nil {
+		if u.Compression != "" {
+			return fmt.Errorf("decompression is not supported with a sink")
+		}
+		u.sink, err = u.Sink(u.Name)
+		u.out, u.hash = u.sink, hashFunc.New()
+		return err
+	}
+
+	if u.Dest == nil {
+		if _, err := u.resolvedDir(); err != nil {
+			return err
+		}
+	}
+
+	if u.ResumeFrom != nil {
+		offset, h, f, err := u.ResumeFrom(u.Name)
+		if err != nil {
+			return fmt.Errorf("error resuming upload: %w", err)
+		}
+		if f != nil {
+			u.temp, u.out = f, f
+			return u.resume(offset, h)
+		}
+	}
+
+	switch {
+	case u.CreateTempFor != nil:
+		u.temp, err = u.CreateTempFor(u.Name, u.length)
+	case u.CreateTemp != nil:
+		u.temp, err = u.CreateTemp()
+	case u.PredictableTemp:
+		u.temp, err = u.createPredictableTemp()
+	default:
+		u.temp, err = os.CreateTemp(u.TempDir, "fdo.upload_*")
+	}
+	u.out, u.hash = u.temp, hashFunc.New()
+	return err
+}
+
+// resolvedDir returns Dir as an absolute path with symlinks resolved. It is
+// resolved once per upload, at the latest when data is first received, so
+// that the os.Root and the paths used to rename into it agree on the
+// directory, even if Dir is a symlink which is changed during the upload.
+func (u *UploadRequest) resolvedDir() (string, error) {
+	if u.dir != "" {
+		return u.dir, nil
+	}
+	dir, err := filepath.Abs(u.Dir)
+	if err != nil {
+		return "", fmt.Errorf("error resolving upload directory %q: %w", u.Dir, err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", fmt.Errorf("error resolving upload directory %q: %w", u.Dir, err)
+	}
+	u.dir = dir
+	return dir, nil
+}
+
+// TempPath returns the path of the temp file used when PredictableTemp is
+// set: ".fdo.upload.<Name>.partial" in TempDir or Dir, with Name escaped so
+// that it is a single path element. It returns an empty string if
+// PredictableTemp is not set.
+func (u *UploadRequest) TempPath() string {
+	if !u.PredictableTemp {
+		return ""
+	}
+	return filepath.Join(cmp.Or(u.TempDir, u.Dir), ".fdo.upload."+url.PathEscape(u.Name)+".partial")
+}
+
+// createPredictableTemp creates the temp file at TempPath, replacing any
+// stale temp file without following a symlink in its place.
+func (u *UploadRequest) createPredictableTemp() (*os.File, error) {
+	path := u.TempPath()
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error removing stale temp file: %w", err)
+	}
+	return os.OpenFile(filepath.Clean(path), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+}
+
+// resume seeks the temp file to the end of previously received data or, if
+// the resumed state is inconsistent, truncates it to restart the upload.
+func (u *UploadRequest) resume(offset int64, h hash.Hash) error {
+	stat, err := u.temp.Stat()
+	if err != nil {
+		return err
+	}
+	if h == nil || offset < 0 || offset != stat.Size() || (u.length > 0 && offset > u.length) {
+		_, hashFunc, err := u.digestAlg()
+		if err != nil {
+			return err
+		}
+		if err := u.temp.Truncate(0); err != nil {
+			return err
+		}
+		offset, h = 0, hashFunc.New()
+	}
+	if _, err := u.temp.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// The additional digest is not saved, so previously received data is
+	// hashed again
+	if u.extra != nil && offset > 0 {
+		if _, err := io.Copy(u.extra, io.NewSectionReader(u.temp, 0, offset)); err != nil {
+			return fmt.Errorf("error hashing previously received data: %w", err)
+		}
+	}
+	u.hash, u.written, u.skip = h, offset, offset
+	return nil
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (u *UploadRequest) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	blockPeer, moduleDone, err := u.produceInfo(ctx, producer)
+	if err != nil {
+		u.cleanup(err)
+	}
+	u.count(err)
+	u.updateStatus()
+	return blockPeer, moduleDone, err
+}
+
+func (u *UploadRequest) produceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	if err := u.checkAborted("produce"); err != nil {
+		return false, false, err
+	}
+	if !u.requested {
+		if err := u.checkCipher(ctx); err != nil {
+			return false, false, err
+		}
+		if skip, err := u.shouldSkip(ctx); err != nil || skip {
+			return false, skip, err
+		}
+		if err := u.checkQuarantine(); err != nil {
+			return false, false, err
+		}
+		return u.request(producer)
+	}
+	if u.done {
+		return false, true, nil
+	}
+	if err := u.checkDeadline("produce"); err != nil {
+		return false, false, err
+	}
+	if u.paused() {
+		return true, false, nil
+	}
+	if err := u.checkDigestTimeout(); err != nil {
+		return false, false, err
+	}
+	if !u.deadline.IsZero() && time.Now().After(u.deadline) {
+		return false, false, &UploadError{Name: u.Name, Op: "produce", Kind: ErrIdleTimeout,
+			Err: fmt.Errorf("timed out after %s without a message from the device", u.IdleTimeout)}
+	}
+	if u.Backpressure != nil && u.Backpressure() {
+		u.blocked()
+		return true, false, nil
+	}
+	return false, false, nil
+}
+
+// shouldSkip reports whether ShouldUpload rejects the devmod of the device, marking
+// the upload done without a file.
+func (u *UploadRequest) shouldSkip(ctx context.Context) (bool, error) {
+	if u.ShouldUpload == nil {
+		return false, nil
+	}
+	devmod, ok := ctx.Value(serviceinfo.DevmodKey{}).(serviceinfo.Devmod)
+	if !ok {
+		return false, fmt.Errorf("upload of %q: devmod of the device is unknown", u.Name)
+	}
+	if u.ShouldUpload(devmod) {
+		return false, nil
+	}
+	u.debug("upload skipped", "os", devmod.Os, "arch", devmod.Arch, "device", devmod.Device)
+	u.done, u.result = true, &UploadResult{Skipped: true}
+	return true, nil
+}
+
+// inactive handles the device declining the module, failing the upload
+// unless AllowInactive is set.
+func (u *UploadRequest) inactive() error {
+	if !u.AllowInactive {
+		return &UploadError{Name: u.Name, Op: "active", Kind: ErrModuleInactive,
+			Err: errors.New("device declined the upload")}
+	}
+	u.cleanup(ErrModuleInactive)
+	u.debug("upload declined by device")
+	u.done, u.reported, u.result = true, true, &UploadResult{Skipped: true}
+	return nil
+}
+
+// checkCipher enforces MinCipherStrength against the cipher suite of the TO2
+// session.
+func (u *UploadRequest) checkCipher(ctx context.Context) error {
+	if u.MinCipherStrength <= 0 {
+		return nil
+	}
+	id, ok := ctx.Value(serviceinfo.CipherSuiteKey{}).(kex.CipherSuiteID)
+	if !ok {
+		return &UploadError{Name: u.Name, Op: "request", Kind: ErrWeakCipher,
+			Err: errors.New("cipher suite of the TO2 session is unknown")}
+	}
+	if bits := int(id.Suite().EncryptAlg.KeySize()) * 8; bits < u.MinCipherStrength {
+		return &UploadError{Name: u.Name, Op: "request", Kind: ErrWeakCipher,
+			Err: fmt.Errorf("cipher suite %s uses a %d bit key, at least %d bits required", id, bits, u.MinCipherStrength)}
+	}
+	return nil
+}
+
+// finalizeIfReady finalizes the upload as soon as both the digest and all
+// data have been received, so that the upload completes in the same round.
+//
+// By spec, the digest is sent after all data, but it may also be sent first,
+// in which case the upload is finalized once the reported length has been
+// received. The length is optional and may be sent at any point. If the
+// digest is sent first and no length has been sent, the device must end the
+// data with an empty data chunk.
+func (u *UploadRequest) finalizeIfReady(ctx context.Context) error {
+	if u.done {
+		return nil
+	}
+	if len(u.digest) == 0 {
+		if u.dataReceived.IsZero() && (u.dataEnded || u.hasLength && u.written >= u.length) {
+			u.dataReceived = time.Now()
+		}
+		return nil
+	}
+	if u.digestFirst && u.hasLength && u.written < u.length {
+		return nil
+	}
+	if u.digestFirst && !u.hasLength && !u.dataEnded {
+		return nil
+	}
+	if u.chunkDigest != nil {
+		return &UploadError{Name: u.Name, Op: "data", Kind: ErrUnexpectedMessage,
+			Err: errors.New("chunk digest was not followed by data")}
+	}
+	_, done, err := u.finalize(ctx)
+	u.done = done
+	return err
+}
+
+func (u *UploadRequest) request(producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	// Marshal message bodies
+	trueBody, err := cbor.Marshal(true)
+	if err != nil {
+		return false, false, err
+	}
+	nameBody, err := cbor.Marshal(u.Name)
+	if err != nil {
+		return false, false, err
+	}
+	needShaBody := trueBody
+	if digestName, _, err := u.digestAlg(); err != nil {
+		return false, false, err
+	} else if digestName != "sha-384" {
+		if needShaBody, err = cbor.Marshal(digestName); err != nil {
+			return false, false, err
+		}
+	}
+
+	metadata, err := u.marshalMetadata()
+	if err != nil {
+		return false, false, err
+	}
+
+	// Send upload messages, which must all be sent in the same round
+	msgs := append([]*serviceinfo.KV{
+		{Key: "active", Val: trueBody},
+		{Key: "need-sha", Val: needShaBody},
+		{Key: "name", Val: nameBody},
+	}, metadata...)
+	n, err := producer.WriteChunks(msgs...)
+	if err != nil {
+		return false, false, err
+	}
+	if n < len(msgs) {
+		return false, false, fmt.Errorf("upload of %q: request does not fit in one round: %s: %w", u.Name, msgs[n].Key,
+			serviceinfo.ErrChunkTooLarge{Size: len(msgs[n].Val), Limit: max(producer.MaxChunk(msgs[n].Key), 0)})
+	}
+
+	u.requested = true
+	u.started = time.Now()
+	u.metrics().IncStarted()
+	u.resetIdle()
+	digestName, _, _ := u.digestAlg()
+	u.debug("request sent", "digest", digestName)
+	return false, false, nil
+}
+
+func (u *UploadRequest) finalize(ctx context.Context) (blockPeer, moduleDone bool, _ error) {
+	if u.Sink == nil {
+		u.dest = u.Rename
+		if u.dest == "" {
+			u.dest = filepath.Base(u.Name)
+		}
+		if err := validateRename(u.dest); err != nil {
+			return false, false, &UploadError{Name: u.Name, Op: "validate destination", Kind: ErrPathTraversal, Err: err}
+		}
+		if err := checkExtension(u.dest, u.AllowExtensions); err != nil {
+			return false, false, &UploadError{Name: u.Name, Op: "validate destination", Kind: ErrNameNotAllowed, Err: err}
+		}
+	}
+
+	// Open the destination if no data was sent, i.e. the file is empty
+	var err error
+	u.once.Do(func() { err = u.openTemp() })
+	if err != nil {
+		return false, false, fmt.Errorf("error opening destination for upload of %q: %w", u.Name, err)
+	}
+
+	// The length sent by the device is authoritative
+	if u.hasLength && u.written > u.length {
+		return false, false, &UploadError{Name: u.Name, Op: "verify", Kind: ErrLengthExceeded,
+			Err: fmt.Errorf("received %d bytes, expected %d", u.written, u.length)}
+	}
+	if u.hasLength && u.written < u.length && !u.AllowShort {
+		return false, false, &UploadError{Name: u.Name, Op: "verify", Kind: ErrShortUpload,
+			Err: fmt.Errorf("received %d bytes, expected %d", u.written, u.length)}
+	}
+	sum := u.hash.Sum(nil)
+	if !bytes.Equal(u.digest, sum) {
+		digestName, _, _ := u.digestAlg()
+		return false, false, u.verifyFailed(&UploadError{Name: u.Name, Op: "verify", Kind: ErrSHAMismatch,
+			Err: fmt.Errorf("%s did not match", digestName)})
+	}
+	if len(u.ExpectedSHA384) > 0 && !bytes.Equal(u.ExpectedSHA384, sum) {
+		return false, false, u.verifyFailed(&UploadError{Name: u.Name, Op: "verify", Kind: ErrSHAMismatch,
+			Err: errors.New("sha-384 did not match the expected digest")})
+	}
+	u.debug("digest verified", "written", u.written)
+	if u.sink != nil {
+		return u.finalizeSink()
+	}
+	if u.Sync {
+		if err := u.temp.Sync(); err != nil {
+			return false, false, u.writeError("sync", fmt.Errorf("error syncing temp file: %w", err))
+		}
+	}
+	if err := u.temp.Close(); err != nil {
+		return false, false, u.writeError("close", fmt.Errorf("error closing temp file: %w", err))
+	}
+	tempPath, size := u.temp.Name(), u.written
+	if u.Compression != "" {
+		if tempPath, size, err = u.decompress(tempPath); err != nil {
+			return false, false, err
+		}
+	}
+	if u.PreCommit != nil {
+		digestName, _, _ := u.digestAlg()
+		meta := UploadMeta{Name: u.Name, Rename: u.dest, Length: size, DigestAlg: digestName, Digest: bytes.Clone(u.digest)}
+		if err := u.PreCommit(tempPath, meta); err != nil {
+			u.removeTemp(tempPath)
+			return false, false, &UploadError{Name: u.Name, Op: "pre-commit", Kind: ErrRejected, Err: err}
+		}
+	}
+	place := u.place
+	if u.DryRun {
+		place = u.dryRun
+	}
+	if err := place(ctx, tempPath); err != nil {
+		// The compressed temp file is removed by cleanup
+		if tempPath != u.temp.Name() {
+			u.removeTemp(tempPath)
+		}
+		return false, false, err
+	}
+	path := u.dest
+	if u.Dest == nil {
+		path = filepath.Join(u.Dir, u.dest)
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	u.result = &UploadResult{Path: path, Size: size, Method: u.method, VerifyDigest: u.verifyDigest()}
+	u.debug("upload complete", "path", path, "size", size)
+	if u.WriteReceipt && !u.DryRun {
+		// The file is already in place, so the upload has still succeeded
+		if err := u.writeReceipt(); err != nil {
+			u.result.ReceiptErr = fmt.Errorf("error writing receipt for upload %q: %w", u.Name, err)
+			u.log(slog.LevelError, "error writing receipt", "file", u.dest, "error", err)
+		}
+	}
+	if u.OnProgress != nil {
+		u.OnProgress(u.Name, u.written, u.length)
+	}
+	return false, true, nil
+}
+
+// verifyFailed closes the sink or quarantines the temp file of an upload
+// which failed digest verification and returns err.
+func (u *UploadRequest) verifyFailed(err error) error {
+	if u.sink != nil {
+		u.closeSink(err)
+		return err
+	}
+	if u.QuarantineDir == "" || u.temp == nil {
+		return err
+	}
+	_ = u.temp.Close()
+	tempPath := u.temp.Name()
+	path, qerr := u.quarantine(tempPath, time.Now())
+	if qerr != nil {
+		// Removed by cleanup instead
+		u.log(slog.LevelError, "error quarantining upload", "file", tempPath, "error", qerr)
+		return err
+	}
+	u.temp = nil
+	u.log(slog.LevelWarn, "upload quarantined", "path", path, "error", err)
+	return err
+}
+
+// validateRename checks that name refers to a file within the upload
+// directory.
+func validateRename(name string) error {
+	switch {
+	case strings.ContainsRune(name, 0):
+		return fmt.Errorf("destination name %q contains a NUL byte", name)
+	case strings.TrimSpace(name) == "":
+		return fmt.Errorf("destination name %q is empty", name)
+	case os.IsPathSeparator(name[len(name)-1]):
+		return fmt.Errorf("destination name %q ends in a path separator", name)
+	case filepath.Clean(name) == ".":
+		return fmt.Errorf("destination name %q refers to the upload directory", name)
+	case !filepath.IsLocal(name):
+		return fmt.Errorf("destination name %q is not a local path", name)
+	}
+	return nil
+}
+
+// checkExtension checks name against AllowExtensions, if any are given.
+func checkExtension(name string, allow []string) error {
+	if len(allow) == 0 {
+		return nil
+	}
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") {
+		return fmt.Errorf("destination name %q is a dotfile", name)
+	}
+	for _, ext := range allow {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if len(base) > len(ext) && strings.EqualFold(base[len(base)-len(ext):], ext) {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination name %q does not have an allowed extension %q", name, allow)
+}
+
+// decompress replaces the verified, compressed temp file with a decompressed
+// temp file in the same directory, returning its path and size.
+func (u *UploadRequest) decompress(src string) (string, int64, error) {
+	newDecompressor := u.NewDecompressor
+	if newDecompressor == nil {
+		newDecompressor = func(compression string, r io.Reader) (io.ReadCloser, error) {
+			if compression != CompressionGzip {
+				return nil, fmt.Errorf("unsupported compression %q", compression)
+			}
+			return gzip.NewReader(r)
+		}
+	}
+
+	in, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening temp file for upload %q: %w", u.Name, err)
+	}
+	defer func() { _ = in.Close() }()
+	r, err := newDecompressor(u.Compression, in)
+	if err != nil {
+		return "", 0, fmt.Errorf("error decompressing upload %q: %w", u.Name, err)
+	}
+	defer func() { _ = r.Close() }()
+
+	out, err := os.CreateTemp(filepath.Dir(src), "fdo.upload_*")
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating temp file for decompressed upload %q: %w", u.Name, err)
+	}
+	size, err := u.copyDecompressed(out, r)
+	if err != nil {
+		_ = out.Close()
+		u.removeTemp(out.Name())
+		return "", 0, err
+	}
+	if err := out.Close(); err != nil {
+		u.removeTemp(out.Name())
+		return "", 0, fmt.Errorf("error closing temp file for decompressed upload %q: %w", u.Name, err)
+	}
+	u.removeTemp(src)
+	return out.Name(), size, nil
+}
+
+func (u *UploadRequest) copyDecompressed(out *os.File, r io.Reader) (int64, error) {
+	if u.MaxBytes > 0 {
+		r = io.LimitReader(r, u.MaxBytes+1)
+	}
+	size, err := io.Copy(out, r)
+	if err != nil {
+		return 0, fmt.Errorf("error decompressing upload %q: %w", u.Name, err)
+	}
+	if u.MaxBytes > 0 && size > u.MaxBytes {
+		return 0, &UploadError{Name: u.Name, Op: "decompress", Kind: ErrLengthExceeded,
+			Err: fmt.Errorf("decompressed more than max of %d bytes", u.MaxBytes)}
+	}
+	if u.Sync {
+		if err := out.Sync(); err != nil {
+			return 0, fmt.Errorf("error syncing temp file for decompressed upload %q: %w", u.Name, err)
+		}
+	}
+	return size, nil
+}
+
+// verifyDigest returns the hex encoded digest computed by VerifyHash, or an
+// empty string if it is not set.
+func (u *UploadRequest) verifyDigest() string {
+	if u.extra == nil {
+		return ""
+	}
+	return hex.EncodeToString(u.extra.Sum(nil))
+}
+
+func (u *UploadRequest) finalizeSink() (blockPeer, moduleDone bool, _ error) {
+	err := u.sink.Close()
+	u.sink = nil
+	if err != nil {
+		return false, false, fmt.Errorf("error closing sink for upload %q: %w", u.Name, err)
+	}
+	u.result = &UploadResult{Size: u.written, VerifyDigest: u.verifyDigest()}
+	u.debug("upload complete", "size", u.written)
+	if u.OnProgress != nil {
+		u.OnProgress(u.Name, u.written, u.length)
+	}
+	return false, true, nil
+}
+
+// closeSink closes the sink of a failed upload, passing it the error if
+// supported.
+func (u *UploadRequest) closeSink(err error) {
+	if closer, ok := u.sink.(interface{ CloseWithError(error) error }); ok {
+		_ = closer.CloseWithError(err)
+	} else {
+		_ = u.sink.Close()
+	}
+	u.sink = nil
+}
+
+// place moves the completed temp file to its destination within Dir, or Dest
+// if set. When the temp file is on the same filesystem as Dir it is renamed,
+// otherwise it is copied through the DestFS, by default an [os.Root], and
+// then removed. Either the new file is fully in place or the previous file is
+// left intact.
+func (u *UploadRequest) place(ctx context.Context, tempPath string) error {
+	root, closeRoot, err := u.openDest()
+	if err != nil {
+		return err
+	}
+	defer closeRoot()
+
+	perm, prev, err := u.checkDest(root)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(u.dest); u.CreateDirs && dir != "." {
+		if err := u.mkdirAll(root, dir); err != nil {
+			return fmt.Errorf("error creating destination directory %q: %w", dir, err)
+		}
+	}
+	if prev != nil && prev.Mode()&fs.ModeNamedPipe != 0 {
+		u.method = "stream"
+		u.debug("placing file", "method", u.method, "file", u.dest)
+		return u.streamInto(ctx, root, tempPath)
+	}
+	if prev != nil && u.WriteMode == WriteAppend {
+		u.method = "append"
+		u.debug("placing file", "method", u.method, "file", u.dest)
+		return u.appendInto(root, tempPath)
+	}
+
+	// A temp file created directly in Dir can always be renamed, even where
+	// devices cannot be compared
+	r, rename := root.(rootFS)
+	if rename && filepath.Dir(tempPath) != filepath.Clean(u.Dir) {
+		dir, err := u.resolvedDir()
+		if err != nil {
+			return err
+		}
+		if rename, err = sameFilesystem(ctx, tempPath, dir); err != nil {
+			return err
+		}
+	}
+
+	var backup string
+	if prev != nil && u.backupsEnabled() {
+		if backup, err = u.backupName(root, prev); err != nil {
+			return err
+		}
+	}
+	if backup != "" {
+		var digest string
+		if u.WriteReceipt {
+			if digest, err = sha384File(root, u.dest); err != nil {
+				return fmt.Errorf("error hashing %q before backing it up: %w", u.dest, err)
+			}
+		}
+		if err := root.Rename(u.dest, backup); err != nil {
+			return fmt.Errorf("error backing up %q to %q: %w", u.dest, backup, err)
+		}
+		u.backup, u.backupDigest = backup, digest
+		u.debug("backup created", "file", u.dest, "backup", backup, "sha384", digest)
+	}
+
+	if rename {
+		u.method = "rename"
+		u.debug("placing file", "method", u.method, "file", u.dest)
+		err = u.renameInto(r.Root, tempPath, perm, prev)
+	} else {
+		u.method = "copy"
+		u.debug("placing file", "method", u.method, "file", u.dest)
+		err = u.copyInto(root, tempPath, perm, prev)
+	}
+	if err != nil {
+		// Put the previous file back so that a failed upload leaves the
+		// destination unchanged
+		if backup != "" {
+			if restoreErr := root.Rename(backup, u.dest); restoreErr != nil {
+				u.log(slog.LevelError, "error restoring backup, previous file is only present as backup",
+					"file", u.dest, "backup", backup, "error", restoreErr)
+				err = errors.Join(err, fmt.Errorf("error restoring backup %q to %q: %w", backup, u.dest, restoreErr))
+			} else {
+				u.debug("backup restored", "file", u.dest, "backup", backup)
+			}
+			u.backup, u.backupDigest = "", ""
+		}
+		return err
+	}
+	u.pruneBackups(root)
+	return u.syncDir(root)
+}
+
+// statContext runs a filesystem call which may block indefinitely, such as a
+// stat on a stalled network filesystem, returning ctx.Err() if ctx is done
+// first. The call is left to finish in the background and its result is
+// discarded.
+func statContext(ctx context.Context, stat func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- stat() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkDest returns the permissions for the destination file and the file it
+// replaces, if any, failing if the destination may not be written.
+func (u *UploadRequest) checkDest(root DestFS) (os.FileMode, os.FileInfo, error) {
+	// Match the permissions of any file being replaced
+	perm, prev, err := u.destPerm(root)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error checking existing file %q: %w", u.dest, err)
+	}
+	if prev == nil {
+		return perm, nil, nil
+	}
+
+	// Refuse to replace or back up a symlink, which may have been planted to
+	// redirect the upload
+	if prev.Mode()&fs.ModeSymlink != 0 {
+		return 0, nil, &UploadError{Name: u.Name, Op: "place", Kind: ErrPathTraversal,
+			Err: fmt.Errorf("destination %q is a symlink", u.dest)}
+	}
+
+	switch u.Overwrite {
+	case OverwriteReplace, OverwriteBackup:
+	case OverwriteDeny:
+		return 0, nil, &UploadError{Name: u.Name, Op: "place", Kind: ErrFileExists,
+			Err: fmt.Errorf("destination %q already exists and may not be overwritten", u.dest)}
+	default:
+		return 0, nil, fmt.Errorf("invalid overwrite policy %d", u.Overwrite)
+	}
+	switch u.WriteMode {
+	case WriteReplace, WriteAppend:
+		return perm, prev, nil
+	case WriteFail:
+		return 0, nil, &UploadError{Name: u.Name, Op: "place", Kind: ErrFileExists,
+			Err: fmt.Errorf("destination %q already exists", u.dest)}
+	default:
+		return 0, nil, fmt.Errorf("invalid write mode %d", u.WriteMode)
+	}
+}
+
+// dryRun checks that the verified temp file could be placed, as in place,
+// without modifying Dir. The temp file is removed.
+func (u *UploadRequest) dryRun(_ context.Context, tempPath string) error {
+	defer u.removeTemp(tempPath)
+
+	root, closeRoot, err := u.openDest()
+	if err != nil {
+		return err
+	}
+	defer closeRoot()
+
+	if _, _, err := u.checkDest(root); err != nil {
+		return err
+	}
+	u.debug("dry run complete", "file", u.dest)
+	return nil
+}
+
+// copyInto copies the temp file to a partial file next to its destination and
+// renames it into place only once the copy is complete.
+func (u *UploadRequest) copyInto(root DestFS, tempPath string, perm os.FileMode, prev os.FileInfo) error {
+	dir, base := filepath.Split(u.dest)
+	partial := filepath.Join(dir, "."+base+".partial_"+rand.Text())
+	if err := copyFile(root, partial, tempPath, perm, u.Sync, u.CopyBufferSize); err != nil {
+		_ = root.Remove(partial)
+		return fmt.Errorf("error copying temp file %q to %q: %w", tempPath, u.dest, err)
+	}
+	if err := u.chownInto(root, partial, prev); err != nil {
+		_ = root.Remove(partial)
+		return fmt.Errorf("error setting owner of %q: %w", u.dest, err)
+	}
+	if err := root.Rename(partial, u.dest); err != nil {
+		_ = root.Remove(partial)
+		return fmt.Errorf("error renaming copied file %q to %q: %w", partial, u.dest, err)
+	}
+	u.removeTemp(tempPath)
+	return nil
+}
+
+// appendInto appends the temp file to the existing destination. If the copy
+// fails, the destination is truncated back to its original size.
+func (u *UploadRequest) appendInto(root DestFS, tempPath string) error {
+	in, err := os.Open(filepath.Clean(tempPath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := root.OpenFile(u.dest, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("error opening %q to append: %w", u.dest, err)
+	}
+	info, err := out.Stat()
+	if err != nil {
+		_ = out.Close()
+		return fmt.Errorf("error appending to %q: %w", u.dest, err)
+	}
+	if _, err := copyBuffer(out, in, u.CopyBufferSize); err != nil {
+		_ = out.Truncate(info.Size())
+		_ = out.Close()
+		return fmt.Errorf("error appending to %q: %w", u.dest, err)
+	}
+	if u.Sync {
+		if err := out.Sync(); err != nil {
+			_ = out.Close()
+			return fmt.Errorf("error syncing %q: %w", u.dest, err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing %q: %w", u.dest, err)
+	}
+	_ = in.Close()
+	u.removeTemp(tempPath)
+	return nil
+}
+
+// streamInto writes the upload to the existing named pipe u.dest, e.g. one
+// drained by another process, rather than replacing it, so there is no
+// backup, rename, or change of permissions. Opening a pipe for writing blocks
+// until it has a reader, so the open is abandoned if ctx is done first.
+func (u *UploadRequest) streamInto(ctx context.Context, root DestFS, tempPath string) error {
+	in, err := os.Open(filepath.Clean(tempPath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	type opened struct {
+		f   DestFile
+		err error
+	}
+	done := make(chan opened, 1)
+	go func() {
+		f, err := root.OpenFile(u.dest, os.O_WRONLY, 0)
+		done <- opened{f, err}
+	}()
+	var out DestFile
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return fmt.Errorf("error opening named pipe %q: %w", u.dest, o.err)
+		}
+		out = o.f
+	case <-ctx.Done():
+		go func() {
+			if o := <-done; o.err == nil {
+				_ = o.f.Close()
+			}
+		}()
+		return fmt.Errorf("error opening named pipe %q: %w", u.dest, ctx.Err())
+	}
+
+	// The pipe may have been replaced since it was checked
+	if info, err := out.Stat(); err != nil || info.Mode()&fs.ModeNamedPipe == 0 {
+		_ = out.Close()
+		return &UploadError{Name: u.Name, Op: "place", Kind: ErrPathTraversal,
+			Err: fmt.Errorf("destination %q is no longer a named pipe", u.dest)}
+	}
+	if _, err := copyBuffer(out, in, u.CopyBufferSize); err != nil {
+		_ = out.Close()
+		return u.writeError("stream", fmt.Errorf("error writing to named pipe %q: %w", u.dest, err))
+	}
+	if err := out.Close(); err != nil {
+		return u.writeError("stream", fmt.Errorf("error closing named pipe %q: %w", u.dest, err))
+	}
+	u.removeTemp(tempPath)
+	return nil
+}
+
+// renameInto moves the temp file to its destination on the same filesystem.
+func (u *UploadRequest) renameInto(root *os.Root, tempPath string, perm os.FileMode, prev os.FileInfo) error {
+	// Ensure that the destination directory does not escape the root before
+	// renaming outside of it
+	if _, err := root.Stat(filepath.Dir(u.dest)); err != nil {
+		return fmt.Errorf("error checking destination directory of %q: %w", u.dest, err)
+	}
+	if err := os.Chmod(tempPath, perm); err != nil {
+		return fmt.Errorf("error setting permissions of temp file %q: %w", tempPath, err)
+	}
+	if prev != nil {
+		preserveOwner(prev, func(uid, gid int) error { return os.Lchown(tempPath, uid, gid) })
+	}
+	if err := u.setOwner(func() (*os.File, error) { return os.Open(filepath.Clean(tempPath)) }); err != nil {
+		return fmt.Errorf("error setting owner of %q: %w", u.dest, err)
+	}
+	dir, err := u.resolvedDir()
+	if err != nil {
+		return err
+	}
+	newpath := filepath.Join(dir, u.dest)
+	if err := os.Rename(tempPath, newpath); err != nil {
+		return fmt.Errorf("error renaming temp file %q to %q: %w", tempPath, newpath, err)
+	}
+	return nil
+}
+
+// chownInto preserves the owner of the replaced file and applies Owner, if
+// set, to name within root. Ownership is only supported by a DestFS which can
+// change it.
+func (u *UploadRequest) chownInto(root DestFS, name string, prev os.FileInfo) error {
+	if r, ok := root.(rootFS); ok {
+		if prev != nil {
+			preserveOwner(prev, func(uid, gid int) error { return r.Lchown(name, uid, gid) })
+		}
+		return u.setOwner(func() (*os.File, error) { return r.Open(name) })
+	}
+
+	lchowner, ok := root.(lchownFS)
+	if ok && prev != nil {
+		preserveOwner(prev, func(uid, gid int) error { return lchowner.Lchown(name, uid, gid) })
+	}
+	if u.Owner == nil || (u.Owner.UID == -1 && u.Owner.GID == -1) {
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("destination filesystem does not support changing ownership")
+	}
+	return lchowner.Lchown(name, u.Owner.UID, u.Owner.GID)
+}
+
+// setOwner applies Owner, if set, to the file before it is moved into place.
+// Ownership is changed through the open file, so that the file cannot be
+// replaced between being checked and changed.
+func (u *UploadRequest) setOwner(open func() (*os.File, error)) error {
+	if u.Owner == nil || (u.Owner.UID == -1 && u.Owner.GID == -1) {
+		return nil
+	}
+	f, err := open()
+	if err != nil {
+		return err
+	}
+	if err := chownFile(f, u.Owner.UID, u.Owner.GID); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mkdirAll creates dir and any missing parents within root with DirMode. Each
+// missing directory is created and checked in turn, so that the mode is only
+// applied to directories created here and never through a symlink.
+func (u *UploadRequest) mkdirAll(root DestFS, dir string) error {
+	mode := u.DirMode
+	if mode == 0 {
+		mode = 0o700
+	}
+	var name string
+	for _, elem := range strings.Split(filepath.Clean(dir), string(filepath.Separator)) {
+		name = filepath.Join(name, elem)
+		if info, err := root.Lstat(name); err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%q is not a directory", name)
+			}
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := root.MkdirAll(name, mode); err != nil {
+			return err
+		}
+		if info, err := root.Lstat(name); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("%q is not a directory", name)
+		}
+		if chmod, ok := root.(chmodFS); ok {
+			if err := chmod.Chmod(name, mode); err != nil {
+				return err
+			}
+		}
+		u.debug("directory created", "dir", name, "mode", mode)
+	}
+	return nil
+}
+
+// destPerm returns the permissions to use for the uploaded file and, if it
+// replaces an existing file, the existing file's info.
+func (u *UploadRequest) destPerm(root DestFS) (os.FileMode, os.FileInfo, error) {
+	info, err := root.Lstat(u.dest)
+	if errors.Is(err, fs.ErrNotExist) {
+		if u.Mode == 0 {
+			return 0o600, nil, nil
+		}
+		return u.Mode.Perm(), nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return info.Mode().Perm(), info, nil
+}
+
+func (u *UploadRequest) syncDir(root DestFS) error {
+	syncer, ok := root.(dirSyncFS)
+	if !u.Sync || !ok {
+		return nil
+	}
+	if err := syncer.SyncDir(filepath.Dir(u.dest)); err != nil {
+		return fmt.Errorf("error syncing directory of uploaded file %q: %w", u.dest, err)
+	}
+	return nil
+}
+
+// copyFile copies the file at src to name within root with the given
+// permissions, optionally flushing the copy to stable storage.
+func copyFile(root DestFS, name, src string, perm os.FileMode, sync bool, bufSize int) error {
+	in, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	// Permissions given to OpenFile are subject to umask and do not apply to
+	// existing files
+	if err := out.Chmod(perm); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if _, err := copyBuffer(out, in, bufSize); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if sync {
+		if err := out.Sync(); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// copyBuffer copies src to dst through a buffer of the given size or, if size
+// is not positive, with io.Copy. io.Copy uses dst.ReadFrom when available, so
+// that an *os.File destination copies within the kernel where the platform
+// supports it, e.g. with copy_file_range on Linux, and a generic copy
+// otherwise.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	// Hide ReadFrom and WriteTo, which would otherwise bypass the buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, size))
 }
@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"cmp"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverwritePolicy controls whether an existing file may be overwritten by an
+// upload and whether it is backed up first.
+type OverwritePolicy int
+
+const (
+	// OverwriteReplace replaces an existing file, backing it up only if
+	// MaxBackups or BackupNamer enable backups.
+	OverwriteReplace OverwritePolicy = iota
+	// OverwriteBackup always backs up an existing file before it is
+	// replaced, keeping at most MaxBackups backups, or one if MaxBackups is
+	// zero.
+	OverwriteBackup
+	// OverwriteDeny fails the upload with [ErrFileExists] if the destination
+	// exists, whatever the WriteMode, so that uploaded files are written once.
+	OverwriteDeny
+)
+
+// backupTimeFormat is the layout of the timestamp inserted into backup names.
+const backupTimeFormat = "20060102150405.000000"
+
+// backupName returns the name to back up the existing file to, or an empty
+// string if it should not be backed up.
+func (u *UploadRequest) backupName(root DestFS, prev os.FileInfo) (string, error) {
+	if u.BackupNamer == nil {
+		return freeBackupName(root, u.dest, prev.ModTime())
+	}
+
+	backup, err := u.BackupNamer(u.dest, prev)
+	if err != nil {
+		return "", fmt.Errorf("error naming backup of %q: %w", u.dest, err)
+	}
+	if backup == "" {
+		return "", nil
+	}
+	if err := validateRename(backup); err != nil {
+		return "", &UploadError{Name: u.Name, Op: "backup", Kind: ErrPathTraversal, Err: err}
+	}
+	if filepath.Clean(backup) == filepath.Clean(u.dest) {
+		return "", fmt.Errorf("backup of %q must have a different name", u.dest)
+	}
+	if _, err := root.Lstat(backup); err == nil {
+		return "", fmt.Errorf("backup %q already exists", backup)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("error checking backup %q: %w", backup, err)
+	}
+	if err := u.mkdirAll(root, filepath.Dir(backup)); err != nil {
+		return "", fmt.Errorf("error creating directory for backup %q: %w", backup, err)
+	}
+	return backup, nil
+}
+
+// maxBackupSeq limits the number of backups which may share a timestamp.
+const maxBackupSeq = 100
+
+// formatBackupName returns the name used to back up the file name, last
+// modified at modTime. A positive seq disambiguates backups with the same
+// timestamp.
+func formatBackupName(name string, modTime time.Time, seq int) string {
+	ext := filepath.Ext(name)
+	stamp := modTime.UTC().Format(backupTimeFormat)
+	if seq > 0 {
+		stamp += "." + strconv.Itoa(seq)
+	}
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(name, ext), stamp, ext)
+}
+
+// freeBackupName returns a backup name for name which is not already in use,
+// so that an existing backup is never overwritten.
+func freeBackupName(root DestFS, name string, modTime time.Time) (string, error) {
+	for seq := range maxBackupSeq {
+		backup := formatBackupName(name, modTime, seq)
+		if _, err := root.Lstat(backup); errors.Is(err, fs.ErrNotExist) {
+			return backup, nil
+		} else if err != nil {
+			return "", fmt.Errorf("error checking backup %q: %w", backup, err)
+		}
+	}
+	return "", fmt.Errorf("error backing up %q: too many backups with timestamp %s",
+		name, modTime.UTC().Format(backupTimeFormat))
+}
+
+// backups returns the names of all backups of name within root, oldest first.
+func backups(root DestFS, name string) ([]string, error) {
+	dir, base := filepath.Split(name)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "."
+
+	entries, err := root.ReadDir(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	type backup struct {
+		name string
+		time time.Time
+		seq  int
+	}
+	var found []backup
+	for _, entry := range entries {
+		n := entry.Name()
+		if !entry.Type().IsRegular() || len(n) <= len(prefix)+len(ext) ||
+			!strings.HasPrefix(n, prefix) || !strings.HasSuffix(n, ext) {
+			continue
+		}
+		t, seq, ok := parseBackupStamp(n[len(prefix) : len(n)-len(ext)])
+		if !ok {
+			continue
+		}
+		found = append(found, backup{name: dir + n, time: t, seq: seq})
+	}
+	slices.SortFunc(found, func(a, b backup) int {
+		return cmp.Or(a.time.Compare(b.time), cmp.Compare(a.seq, b.seq), cmp.Compare(a.name, b.name))
+	})
+
+	names := make([]string, len(found))
+	for i, b := range found {
+		names[i] = b.name
+	}
+	return names, nil
+}
+
+// parseBackupStamp parses the timestamp and optional sequence number inserted
+// into a backup name.
+func parseBackupStamp(stamp string) (t time.Time, seq int, ok bool) {
+	if len(stamp) < len(backupTimeFormat) {
+		return time.Time{}, 0, false
+	}
+	t, err := time.Parse(backupTimeFormat, stamp[:len(backupTimeFormat)])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	if rest := stamp[len(backupTimeFormat):]; rest != "" {
+		digits, found := strings.CutPrefix(rest, ".")
+		if seq, err = strconv.Atoi(digits); !found || err != nil || seq <= 0 {
+			return time.Time{}, 0, false
+		}
+	}
+	return t, seq, true
+}
+
+// backupsEnabled reports whether an existing file is backed up before it is
+// replaced.
+func (u *UploadRequest) backupsEnabled() bool {
+	return u.Overwrite == OverwriteBackup || u.MaxBackups != 0 || u.BackupNamer != nil
+}
+
+// pruneBackups deletes the oldest backups beyond MaxBackups. Pruning is best
+// effort and does not cause the upload to fail.
+func (u *UploadRequest) pruneBackups(root DestFS) {
+	keep := u.MaxBackups
+	if u.Overwrite == OverwriteBackup && keep == 0 {
+		keep = 1
+	}
+	if keep <= 0 {
+		return
+	}
+	names, err := backups(root, u.dest)
+	if err != nil {
+		return
+	}
+	for _, name := range names[:max(len(names)-keep, 0)] {
+		_ = root.Remove(name)
+	}
+}
+
+// sha384File returns the hex encoded SHA-384 of the file name within root,
+// streaming it once.
+func sha384File(root DestFS, name string) (string, error) {
+	f, err := root.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	r, ok := f.(io.Reader)
+	if !ok {
+		return "", errors.New("destination files cannot be read")
+	}
+	h := crypto.SHA384.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
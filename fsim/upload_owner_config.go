@@ -0,0 +1,241 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+// UploadConfig is the configuration of an UploadRequest as plain data, so
+// that owner services may read uploads from configuration files, e.g. with
+// [encoding/json]. Fields are as documented on UploadRequest, except that
+// values without a natural form in configuration files are strings:
+//
+//   - HashAlg is "sha-256" or "sha-384"
+//   - ExpectedSHA384 is hex encoded
+//   - Mode and DirMode are octal permission strings, e.g. "0640"
+//   - WriteMode is "replace", "append", or "fail"
+//   - Overwrite is "overwrite", "backup", or "deny"
+//   - IdleTimeout, MaxDuration, and DigestTimeout are parsed by
+//     [time.ParseDuration], and only DigestTimeout may be negative
+//
+// Options which take functions or interfaces, such as Sink or Metrics, may be
+// set on the UploadRequest returned by NewUploadRequest.
+type UploadConfig struct {
+	Dir               string         `json:"dir"`
+	Name              string         `json:"name"`
+	Rename            string         `json:"rename,omitempty"`
+	AllowExtensions   []string       `json:"allowExtensions,omitempty"`
+	TempDir           string         `json:"tempDir,omitempty"`
+	PredictableTemp   bool           `json:"predictableTemp,omitempty"`
+	CopyBufferSize    int            `json:"copyBufferSize,omitempty"`
+	Metadata          map[string]any `json:"metadata,omitempty"`
+	Compression       string         `json:"compression,omitempty"`
+	MaxBytes          int64          `json:"maxBytes,omitempty"`
+	AllowShort        bool           `json:"allowShort,omitempty"`
+	MinFreeBytes      int64          `json:"minFreeBytes,omitempty"`
+	HashAlg           string         `json:"hashAlg,omitempty"`
+	DigestMessageName string         `json:"digestMessageName,omitempty"`
+	ExpectedSHA384    string         `json:"expectedSha384,omitempty"`
+	QuarantineDir     string         `json:"quarantineDir,omitempty"`
+	Sync              bool           `json:"sync,omitempty"`
+	Mode              string         `json:"mode,omitempty"`
+	MaxBackups        int            `json:"maxBackups,omitempty"`
+	WriteMode         string         `json:"writeMode,omitempty"`
+	Overwrite         string         `json:"overwrite,omitempty"`
+	CreateDirs        bool           `json:"createDirs,omitempty"`
+	DirMode           string         `json:"dirMode,omitempty"`
+	IdleTimeout       string         `json:"idleTimeout,omitempty"`
+	MaxBytesPerSecond int64          `json:"maxBytesPerSecond,omitempty"`
+	MaxDuration       string         `json:"maxDuration,omitempty"`
+	DigestTimeout     string         `json:"digestTimeout,omitempty"`
+	MinCipherStrength int            `json:"minCipherStrength,omitempty"`
+	AllowInactive     bool           `json:"allowInactive,omitempty"`
+	WriteReceipt      bool           `json:"writeReceipt,omitempty"`
+	ReceiptSuffix     string         `json:"receiptSuffix,omitempty"`
+	DryRun            bool           `json:"dryRun,omitempty"`
+}
+
+// NewUploadRequest validates an UploadConfig and returns the UploadRequest it
+// describes. Errors which would otherwise only be found once the device has
+// sent the file, such as an empty Dir or a Rename which is not a local path,
+// are reported up front.
+func NewUploadRequest(cfg UploadConfig) (*UploadRequest, error) {
+	u, err := cfg.request()
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload config: %w", err)
+	}
+	return u, nil
+}
+
+func (cfg UploadConfig) request() (*UploadRequest, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("dir is required")
+	}
+	if cfg.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	dest := cfg.Rename
+	if dest == "" {
+		dest = filepath.Base(cfg.Name)
+	}
+	if err := validateRename(dest); err != nil {
+		return nil, err
+	}
+	if slices.Contains(cfg.AllowExtensions, "") {
+		return nil, errors.New("allowExtensions must not contain an empty extension")
+	}
+	if err := checkExtension(dest, cfg.AllowExtensions); err != nil {
+		return nil, err
+	}
+	switch cfg.Compression {
+	case "", CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", cfg.Compression)
+	}
+	for _, field := range []struct {
+		name string
+		n    int64
+	}{
+		{"copyBufferSize", int64(cfg.CopyBufferSize)},
+		{"maxBytes", cfg.MaxBytes},
+		{"minFreeBytes", cfg.MinFreeBytes},
+		{"maxBytesPerSecond", cfg.MaxBytesPerSecond},
+		{"minCipherStrength", int64(cfg.MinCipherStrength)},
+	} {
+		if field.n < 0 {
+			return nil, fmt.Errorf("%s must not be negative, got %d", field.name, field.n)
+		}
+	}
+
+	u := &UploadRequest{
+		Dir:               cfg.Dir,
+		Name:              cfg.Name,
+		Rename:            cfg.Rename,
+		AllowExtensions:   cfg.AllowExtensions,
+		TempDir:           cfg.TempDir,
+		PredictableTemp:   cfg.PredictableTemp,
+		CopyBufferSize:    cfg.CopyBufferSize,
+		Metadata:          cfg.Metadata,
+		Compression:       cfg.Compression,
+		MaxBytes:          cfg.MaxBytes,
+		AllowShort:        cfg.AllowShort,
+		MinFreeBytes:      cfg.MinFreeBytes,
+		DigestMessageName: cfg.DigestMessageName,
+		QuarantineDir:     cfg.QuarantineDir,
+		Sync:              cfg.Sync,
+		MaxBackups:        cfg.MaxBackups,
+		CreateDirs:        cfg.CreateDirs,
+		MaxBytesPerSecond: cfg.MaxBytesPerSecond,
+		MinCipherStrength: cfg.MinCipherStrength,
+		AllowInactive:     cfg.AllowInactive,
+		WriteReceipt:      cfg.WriteReceipt,
+		ReceiptSuffix:     cfg.ReceiptSuffix,
+		DryRun:            cfg.DryRun,
+	}
+
+	switch cfg.HashAlg {
+	case "":
+	case "sha-384":
+		u.HashAlg = protocol.Sha384Hash
+	case "sha-256":
+		u.HashAlg = protocol.Sha256Hash
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", cfg.HashAlg)
+	}
+	if cfg.ExpectedSHA384 != "" {
+		digest, err := hex.DecodeString(cfg.ExpectedSHA384)
+		if err != nil {
+			return nil, fmt.Errorf("expectedSha384: %w", err)
+		}
+		u.ExpectedSHA384 = digest
+	}
+	if _, _, err := u.digestAlg(); err != nil {
+		return nil, err
+	}
+	if _, err := u.marshalMetadata(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if u.Mode, err = parseMode("mode", cfg.Mode); err != nil {
+		return nil, err
+	}
+	if u.DirMode, err = parseMode("dirMode", cfg.DirMode); err != nil {
+		return nil, err
+	}
+
+	switch cfg.WriteMode {
+	case "", "replace":
+		u.WriteMode = WriteReplace
+	case "append":
+		u.WriteMode = WriteAppend
+	case "fail":
+		u.WriteMode = WriteFail
+	default:
+		return nil, fmt.Errorf("unsupported write mode %q", cfg.WriteMode)
+	}
+
+	switch cfg.Overwrite {
+	case "", "overwrite":
+		u.Overwrite = OverwriteReplace
+	case "backup":
+		u.Overwrite = OverwriteBackup
+	case "deny":
+		u.Overwrite = OverwriteDeny
+	default:
+		return nil, fmt.Errorf("unsupported overwrite policy %q", cfg.Overwrite)
+	}
+
+	if u.IdleTimeout, err = parseDuration("idleTimeout", cfg.IdleTimeout); err != nil {
+		return nil, err
+	}
+	if u.MaxDuration, err = parseDuration("maxDuration", cfg.MaxDuration); err != nil {
+		return nil, err
+	}
+	// A negative digest timeout awaits the digest indefinitely
+	if cfg.DigestTimeout != "" {
+		if u.DigestTimeout, err = time.ParseDuration(cfg.DigestTimeout); err != nil {
+			return nil, fmt.Errorf("digestTimeout: %w", err)
+		}
+	}
+
+	return u, nil
+}
+
+// parseMode parses an optional, octal file permission.
+func parseMode(field, s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("%s %q is not an octal file permission", field, s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseDuration parses an optional, non-negative duration.
+func parseDuration(field, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", field, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %s", field, s)
+	}
+	return d, nil
+}
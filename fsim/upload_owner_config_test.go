@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/fsim"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+)
+
+func TestNewUploadRequest(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		dir := t.TempDir()
+		dirJSON, err := json.Marshal(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cfg fsim.UploadConfig
+		if err := json.Unmarshal([]byte(`{
+			"dir": `+string(dirJSON)+`,
+			"name": "logs/device.log",
+			"rename": "device.log",
+			"maxBytes": 1048576,
+			"hashAlg": "sha-256",
+			"mode": "0640",
+			"dirMode": "0750",
+			"writeMode": "fail",
+			"overwrite": "deny",
+			"idleTimeout": "30s",
+			"maxDuration": "5m",
+			"maxBackups": -1,
+			"digestTimeout": "-1s",
+			"metadata": {"content-type": "text/plain"}
+		}`), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		u, err := fsim.NewUploadRequest(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case u.Dir != dir, u.Name != "logs/device.log", u.Rename != "device.log":
+			t.Errorf("unexpected paths: dir=%q name=%q rename=%q", u.Dir, u.Name, u.Rename)
+		case u.MaxBytes != 1<<20:
+			t.Errorf("expected max bytes of 1MiB, got %d", u.MaxBytes)
+		case u.HashAlg != protocol.Sha256Hash:
+			t.Errorf("expected SHA-256, got %s", u.HashAlg)
+		case u.Mode != 0o640, u.DirMode != 0o750:
+			t.Errorf("expected modes 0640 and 0750, got %o and %o", u.Mode, u.DirMode)
+		case u.WriteMode != fsim.WriteFail:
+			t.Errorf("expected WriteFail, got %d", u.WriteMode)
+		case u.Overwrite != fsim.OverwriteDeny:
+			t.Errorf("expected OverwriteDeny, got %d", u.Overwrite)
+		case u.IdleTimeout != 30*time.Second, u.MaxDuration != 5*time.Minute:
+			t.Errorf("unexpected timeouts: idle=%s max=%s", u.IdleTimeout, u.MaxDuration)
+		case u.DigestTimeout != -time.Second:
+			t.Errorf("expected digest timeout of -1s, got %s", u.DigestTimeout)
+		case u.MaxBackups != -1:
+			t.Errorf("expected all backups to be kept, got max backups of %d", u.MaxBackups)
+		case u.Metadata["content-type"] != "text/plain":
+			t.Errorf("unexpected metadata %v", u.Metadata)
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		dir := t.TempDir()
+		u, err := fsim.NewUploadRequest(fsim.UploadConfig{Dir: dir, Name: "file.bin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("Hello World!\n"), 256)
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+	})
+
+	for _, test := range []struct {
+		name   string
+		cfg    fsim.UploadConfig
+		expect string
+	}{
+		{name: "empty dir", cfg: fsim.UploadConfig{Name: "file.bin"}, expect: "dir is required"},
+		{name: "empty name", cfg: fsim.UploadConfig{Dir: "uploads"}, expect: "name is required"},
+		{name: "parent rename", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", Rename: "../file.bin"}, expect: "not a local path"},
+		{name: "absolute rename", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", Rename: "/etc/passwd"}, expect: "not a local path"},
+		{name: "parent name", cfg: fsim.UploadConfig{Dir: "uploads", Name: ".."}, expect: "not a local path"},
+		{name: "extension", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.sh", AllowExtensions: []string{".log"}}, expect: "allowed extension"},
+		{name: "empty extension", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.log", AllowExtensions: []string{".log", ""}}, expect: "allowExtensions"},
+		{name: "compression", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", Compression: "lz4"}, expect: "compression"},
+		{name: "negative max bytes", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", MaxBytes: -1}, expect: "maxBytes"},
+		{name: "hash algorithm", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", HashAlg: "md5"}, expect: "hash algorithm"},
+		{name: "expected digest", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", ExpectedSHA384: "not hex"}, expect: "expectedSha384"},
+		{name: "expected digest length", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", ExpectedSHA384: "abcd"}, expect: "SHA-384"},
+		{name: "digest message name", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", DigestMessageName: "data"}, expect: "data"},
+		{name: "metadata key", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", Metadata: map[string]any{"name": "x"}}, expect: "metadata"},
+		{name: "mode", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", Mode: "rw-r-----"}, expect: "mode"},
+		{name: "dir mode", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", DirMode: "0o755"}, expect: "dirMode"},
+		{name: "mode bits", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", Mode: "4755"}, expect: "mode"},
+		{name: "write mode", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", WriteMode: "merge"}, expect: "write mode"},
+		{name: "overwrite", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", Overwrite: "replace"}, expect: "overwrite policy"},
+		{name: "idle timeout", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", IdleTimeout: "soon"}, expect: "idleTimeout"},
+		{name: "negative max duration", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", MaxDuration: "-1s"}, expect: "maxDuration"},
+		{name: "digest timeout", cfg: fsim.UploadConfig{Dir: "uploads", Name: "file.bin", DigestTimeout: "1 minute"}, expect: "digestTimeout"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			u, err := fsim.NewUploadRequest(test.cfg)
+			if err == nil {
+				t.Fatalf("expected error, got %+v", u)
+			}
+			if !strings.Contains(err.Error(), test.expect) {
+				t.Fatalf("expected error containing %q, got %v", test.expect, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// DestFS is a writable filesystem which uploaded files are placed in. By
+// default, uploads are placed in Dir through an [os.Root].
+//
+// Names are relative to the root of the filesystem, use the OS path separator,
+// and are always local, as reported by [path/filepath.IsLocal]. An
+// implementation must not allow names, including through symlinks, to refer
+// to files outside of its root, as this is the boundary which protects the
+// owner from paths chosen by the device.
+//
+// If the DestFS implements SyncDir(name string) error, it is called to flush
+// the directory containing an uploaded file when UploadRequest.Sync is set.
+type DestFS interface {
+	// OpenFile opens a file, like [os.OpenFile].
+	OpenFile(name string, flag int, perm fs.FileMode) (DestFile, error)
+	// Lstat returns info describing the named file without following a
+	// final symlink.
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of the named directory.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Rename renames (moves) a file, replacing any existing file.
+	Rename(oldname, newname string) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// MkdirAll creates a directory and any missing parents.
+	MkdirAll(name string, perm fs.FileMode) error
+}
+
+// DestFile is a file opened for writing in a DestFS. It is implemented by
+// [*os.File].
+type DestFile interface {
+	io.WriteCloser
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+	Chmod(mode fs.FileMode) error
+}
+
+// lchownFS is a DestFS which supports changing the ownership of files.
+type lchownFS interface {
+	Lchown(name string, uid, gid int) error
+}
+
+// chmodFS is a DestFS which supports changing the mode of files.
+type chmodFS interface {
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// dirSyncFS is a DestFS which supports flushing directories.
+type dirSyncFS interface {
+	SyncDir(name string) error
+}
+
+// rootFS is the default DestFS, which confines names to a directory using an
+// [os.Root].
+type rootFS struct{ *os.Root }
+
+var _ DestFS = rootFS{}
+
+// OpenFile implements DestFS.
+func (r rootFS) OpenFile(name string, flag int, perm fs.FileMode) (DestFile, error) {
+	f, err := r.Root.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ReadDir implements DestFS.
+func (r rootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	d, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = d.Close() }()
+	return d.ReadDir(-1)
+}
+
+// SyncDir flushes the entries of the named directory to stable storage.
+func (r rootFS) SyncDir(name string) error { return syncDir(r.Root, name) }
+
+// openDest returns Dest or, by default, Dir opened as a DestFS. The returned
+// function must be called to release it.
+func (u *UploadRequest) openDest() (DestFS, func(), error) {
+	if u.Dest != nil {
+		return u.Dest, func() {}, nil
+	}
+	dir, err := u.resolvedDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening upload directory %q: %w", u.Dir, err)
+	}
+	return rootFS{root}, func() { _ = root.Close() }, nil
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"time"
+)
+
+// paused reports whether Gate is closed, blocking the device until it is
+// checked again in the next exchange.
+func (u *UploadRequest) paused() bool {
+	if u.Gate == nil || u.Gate() {
+		return false
+	}
+	u.blocked()
+	u.debug("upload paused", "written", u.written)
+	return true
+}
+
+// checkDeadline fails the upload if it has exceeded MaxDuration.
+func (u *UploadRequest) checkDeadline(op string) error {
+	if u.MaxDuration <= 0 || u.started.IsZero() || time.Since(u.started) <= u.MaxDuration {
+		return nil
+	}
+	return &UploadError{Name: u.Name, Op: op, Kind: ErrDeadlineExceeded,
+		Err: fmt.Errorf("upload did not complete within %s", u.MaxDuration)}
+}
+
+// checkDigestTimeout fails the upload if the device has not sent the digest
+// within DigestTimeout of sending all data.
+func (u *UploadRequest) checkDigestTimeout() error {
+	timeout := cmp.Or(u.DigestTimeout, time.Minute)
+	if timeout < 0 || u.dataReceived.IsZero() || time.Since(u.dataReceived) <= timeout {
+		return nil
+	}
+	digestName, _, _ := u.digestAlg()
+	return &UploadError{Name: u.Name, Op: "produce", Kind: ErrMissingDigest,
+		Err: fmt.Errorf("%s not received within %s of the end of data", digestName, timeout)}
+}
+
+// blocked restarts timeouts while the device is kept from sending.
+func (u *UploadRequest) blocked() {
+	// The device cannot send while blocked, so it is not idle
+	u.resetIdle()
+	if !u.dataReceived.IsZero() {
+		u.dataReceived = time.Now()
+	}
+}
+
+// resetIdle restarts the idle timeout, if enabled.
+func (u *UploadRequest) resetIdle() {
+	if u.IdleTimeout > 0 {
+		u.deadline = time.Now().Add(u.IdleTimeout)
+	}
+}
+
+// tokenBucket limits a byte rate, allowing bursts of one second at that rate.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait takes n tokens from the bucket at the given rate, blocking until the
+// bucket has been refilled or the context is done. A zero rate is unlimited.
+func (b *tokenBucket) wait(ctx context.Context, rate int64, n int) error {
+	if rate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(rate), float64(rate))
+	}
+	b.last = now
+
+	// Allow the bucket to go into debt, waiting until it is paid off
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(-b.tokens / float64(rate) * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,219 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCopyFile(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 1024)
+
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = root.Close() }()
+
+	if err := copyFile(rootFS{root}, "dst", src, 0o640, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("copied contents did not match")
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(dir, "dst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o640 {
+			t.Errorf("expected copied file permissions %o, got %o", 0o640, perm)
+		}
+	}
+
+	if err := copyFile(rootFS{root}, "../escape", src, 0o640, false, 0); err == nil {
+		t.Fatal("expected copy outside of root to fail")
+	}
+
+	// A buffer smaller than the file is used for the whole copy
+	if err := copyFile(rootFS{root}, "dst", src, 0o640, false, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "dst")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("contents copied with a buffer did not match (err %v)", err)
+	}
+
+	// Files of the default DestFS copy within the kernel, through ReadFrom,
+	// and other files fall back to a generic copy
+	if f, err := (rootFS{root}).OpenFile("dst", os.O_WRONLY, 0); err != nil {
+		t.Fatal(err)
+	} else if _, ok := f.(io.ReaderFrom); !ok {
+		t.Error("expected destination file to implement io.ReaderFrom")
+	} else {
+		_ = f.Close()
+	}
+	if err := copyFile(noReadFromFS{rootFS{root}}, "generic", src, 0o640, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "generic")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("contents copied without ReadFrom did not match (err %v)", err)
+	}
+}
+
+// noReadFromFS is a DestFS whose files hide ReadFrom, forcing a generic copy.
+type noReadFromFS struct{ rootFS }
+
+func (fsys noReadFromFS) OpenFile(name string, flag int, perm fs.FileMode) (DestFile, error) {
+	f, err := fsys.rootFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ DestFile }{f}, nil
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	const size = 64 << 20
+	src := filepath.Join(b.TempDir(), "src")
+	if err := os.WriteFile(src, bytes.Repeat([]byte{0xa5}, size), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	root, err := os.OpenRoot(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = root.Close() }()
+
+	for _, test := range []struct {
+		name    string
+		fsys    DestFS
+		bufSize int
+	}{
+		{name: "default", fsys: rootFS{root}},
+		{name: "generic", fsys: noReadFromFS{rootFS{root}}},
+		{name: "32KiB", fsys: rootFS{root}, bufSize: 32 << 10},
+		{name: "1MiB", fsys: rootFS{root}, bufSize: 1 << 20},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for b.Loop() {
+				if err := copyFile(test.fsys, "dst", src, 0o600, false, test.bufSize); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directory sync is not supported on windows")
+	}
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = root.Close() }()
+
+	for _, name := range []string{".", "sub"} {
+		if err := syncDir(root, name); err != nil {
+			t.Errorf("error syncing %q: %v", name, err)
+		}
+	}
+	if err := syncDir(root, ".."); err == nil {
+		t.Error("expected syncing a directory outside of root to fail")
+	}
+}
+
+func TestPlaceCopyFailure(t *testing.T) {
+	original := []byte("original contents\n")
+
+	t.Run("partial copy", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file.txt"), original, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = root.Close() }()
+
+		// Reading a directory fails after it has been opened, after the
+		// partial file has been created
+		u := &UploadRequest{Dir: dir, Rename: "file.txt", dest: "file.txt", Logger: testLogger(t)}
+		if err := u.copyInto(rootFS{root}, t.TempDir(), 0o600, nil); err == nil {
+			t.Fatal("expected copy to fail")
+		}
+		assertOnlyFile(t, dir, "file.txt", original)
+	})
+
+	t.Run("restore backup", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file.txt"), original, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		// The missing temp file cannot be renamed or copied over the
+		// destination once it has been backed up
+		for _, tempDir := range []string{dir, t.TempDir()} {
+			u := &UploadRequest{Dir: dir, Rename: "file.txt", MaxBackups: 1, dest: "file.txt", Logger: testLogger(t)}
+			err := u.place(t.Context(), filepath.Join(tempDir, "missing"))
+			if err == nil {
+				t.Fatal("expected place to fail")
+			}
+			if strings.Contains(err.Error(), "error backing up") || strings.Contains(err.Error(), "error restoring") {
+				t.Fatalf("expected backup to be made and restored, got %v", err)
+			}
+			assertOnlyFile(t, dir, "file.txt", original)
+		}
+	})
+}
+
+func assertOnlyFile(t *testing.T, dir, name string, contents []byte) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		t.Fatalf("expected only %q in %s, found %v", name, dir, entries)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatalf("expected %q to be unchanged, got %q", name, got)
+	}
+}
+
+// testLogger returns a logger which writes to the log of t, so that upload
+// events are not sent to the default logger, which other tests may replace.
+func testLogger(t *testing.T) *slog.Logger {
+	return slog.New(slog.NewTextHandler(t.Output(), &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
@@ -0,0 +1,147 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"errors"
+	"sync"
+)
+
+// Metrics receives counters for uploads, so that they may be exported to a
+// monitoring system without this package depending on one. Implementations
+// must be safe for concurrent use when shared between modules.
+type Metrics interface {
+	// IncStarted is called when an upload is requested from the device.
+	IncStarted()
+	// IncSucceeded is called when an upload has been verified and placed.
+	IncSucceeded()
+	// IncFailed is called once when a started upload fails. The reason is
+	// the message of the [UploadError] Kind, such as "digest mismatch", or
+	// "other" for errors without a kind.
+	IncFailed(reason string)
+	// AddBytes is called with the number of bytes of upload data written.
+	AddBytes(n int64)
+}
+
+// NopMetrics is a Metrics which discards all counters. It is used when
+// UploadRequest.Metrics is nil.
+type NopMetrics struct{}
+
+// IncStarted implements Metrics.
+func (NopMetrics) IncStarted() {}
+
+// IncSucceeded implements Metrics.
+func (NopMetrics) IncSucceeded() {}
+
+// IncFailed implements Metrics.
+func (NopMetrics) IncFailed(string) {}
+
+// AddBytes implements Metrics.
+func (NopMetrics) AddBytes(int64) {}
+
+// MemoryMetrics is a Metrics which keeps counters in memory, e.g. for tests.
+// The zero value is ready to use.
+type MemoryMetrics struct {
+	mu        sync.Mutex
+	started   int64
+	succeeded int64
+	failed    map[string]int64
+	bytes     int64
+}
+
+// IncStarted implements Metrics.
+func (m *MemoryMetrics) IncStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started++
+}
+
+// IncSucceeded implements Metrics.
+func (m *MemoryMetrics) IncSucceeded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.succeeded++
+}
+
+// IncFailed implements Metrics.
+func (m *MemoryMetrics) IncFailed(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failed == nil {
+		m.failed = make(map[string]int64)
+	}
+	m.failed[reason]++
+}
+
+// AddBytes implements Metrics.
+func (m *MemoryMetrics) AddBytes(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes += n
+}
+
+// Started returns the number of uploads started.
+func (m *MemoryMetrics) Started() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.started
+}
+
+// Succeeded returns the number of uploads which succeeded.
+func (m *MemoryMetrics) Succeeded() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.succeeded
+}
+
+// Failed returns the number of uploads which failed for the given reason.
+func (m *MemoryMetrics) Failed(reason string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failed[reason]
+}
+
+// Bytes returns the total number of bytes of upload data written.
+func (m *MemoryMetrics) Bytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+var (
+	_ Metrics = NopMetrics{}
+	_ Metrics = (*MemoryMetrics)(nil)
+)
+
+// failureReason returns the reason reported to Metrics for an upload error.
+func failureReason(err error) string {
+	var uerr *UploadError
+	if errors.As(err, &uerr) && uerr.Kind != nil {
+		return uerr.Kind.Error()
+	}
+	return "other"
+}
+
+// count reports the outcome of a started upload to Metrics, once.
+func (u *UploadRequest) count(err error) {
+	if !u.requested || u.reported {
+		return
+	}
+	switch {
+	case err != nil:
+		u.metrics().IncFailed(failureReason(err))
+	case u.done:
+		u.metrics().IncSucceeded()
+	default:
+		return
+	}
+	u.reported = true
+}
+
+func (u *UploadRequest) metrics() Metrics {
+	if u.Metrics == nil {
+		return NopMetrics{}
+	}
+	return u.Metrics
+}
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// MultiUpload implements an owner module for fdo.upload which requests
+// several files from the device within a single module instance.
+//
+// The fdo.upload messages sent by the device do not identify the file that
+// they belong to, so files are requested one at a time, in order, and each
+// request is completed before the next file is requested. Every request keeps
+// its own state, including its temp file and digest.
+//
+// Errors are returned as reported by the failed request, prefixed with its
+// position and Name, so that [errors.Is] and [errors.As] still match an
+// [UploadError]. No further files are requested after a failure.
+type MultiUpload struct {
+	Requests []*UploadRequest
+
+	// internal state
+	index int
+}
+
+var _ serviceinfo.OwnerModule = (*MultiUpload)(nil)
+
+// HandleInfo implements serviceinfo.OwnerModule.
+func (m *MultiUpload) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
+	if m.index >= len(m.Requests) {
+		return fmt.Errorf("unexpected message %q after all uploads completed", messageName)
+	}
+	return m.fileError(m.Requests[m.index].HandleInfo(ctx, messageName, messageBody))
+}
+
+// ProduceInfo implements serviceinfo.OwnerModule.
+func (m *MultiUpload) ProduceInfo(ctx context.Context, producer *serviceinfo.Producer) (blockPeer, moduleDone bool, _ error) {
+	for m.index < len(m.Requests) {
+		blockPeer, done, err := m.Requests[m.index].ProduceInfo(ctx, producer)
+		if err != nil || !done {
+			return blockPeer, false, m.fileError(err)
+		}
+		// Request the next file in the same round
+		m.index++
+	}
+	return false, true, nil
+}
+
+// fileError adds which of the requested files failed to err.
+func (m *MultiUpload) fileError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("upload %d of %d (%s): %w", m.index+1, len(m.Requests), m.Requests[m.index].Name, err)
+}
+
+// Result returns the result of the completed upload of the file with the
+// given name on the device.
+func (m *MultiUpload) Result(name string) (result UploadResult, ok bool) {
+	for _, u := range m.Requests {
+		if u.Name == name {
+			return u.Result()
+		}
+	}
+	return UploadResult{}, false
+}
@@ -0,0 +1,11 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build !(linux || darwin || freebsd)
+
+package fsim
+
+import "context"
+
+// freeSpace is not implemented on this platform.
+func freeSpace(context.Context, string) (available int64, ok bool, _ error) { return 0, false, nil }
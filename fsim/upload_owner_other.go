@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build !unix
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// sameFilesystem always reports false where device IDs are not available, so
+// uploads are always copied into place.
+func sameFilesystem(ctx context.Context, path1, path2 string) (bool, error) { return false, nil }
+
+// syncDir is a no-op where directories cannot be opened for syncing.
+func syncDir(root *os.Root, dir string) error { return nil }
+
+// preserveOwner is a no-op where file ownership is not available.
+func preserveOwner(info os.FileInfo, chown func(uid, gid int) error) {}
+
+// chownFile fails where file ownership is not available.
+func chownFile(f *os.File, uid, gid int) error {
+	return errors.New("changing file ownership is not supported on this platform")
+}
+
+// isDiskFull always reports false where errno values are not available, so
+// write errors are reported as ErrIO.
+func isDiskFull(err error) bool { return false }
@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkQuarantine ensures that QuarantineDir exists before the upload is
+// requested, so that a failed upload is not lost to a misconfiguration.
+func (u *UploadRequest) checkQuarantine() error {
+	if u.QuarantineDir == "" || u.Sink != nil {
+		return nil
+	}
+	info, err := os.Stat(u.QuarantineDir)
+	if err != nil {
+		return fmt.Errorf("upload of %q: error checking quarantine directory: %w", u.Name, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("upload of %q: quarantine directory %q is not a directory", u.Name, u.QuarantineDir)
+	}
+	return nil
+}
+
+// quarantine moves the temp file into QuarantineDir, copying it if it cannot
+// be renamed, e.g. across filesystems, and returns its new path.
+func (u *UploadRequest) quarantine(tempPath string, failed time.Time) (string, error) {
+	root, err := os.OpenRoot(u.QuarantineDir)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = root.Close() }()
+
+	name, err := freeBackupName(rootFS{root}, url.PathEscape(u.Name), failed)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(u.QuarantineDir, name)
+	if err := os.Rename(tempPath, path); err == nil {
+		return path, nil
+	}
+	if err := copyFile(rootFS{root}, name, tempPath, 0o600, false, u.CopyBufferSize); err != nil {
+		_ = root.Remove(name)
+		return "", err
+	}
+	u.removeTemp(tempPath)
+	return path, nil
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UploadReceipt is the record of a completed upload written when
+// WriteReceipt is set.
+type UploadReceipt struct {
+	// Name of the file on the device
+	Name string `json:"name"`
+	// Absolute path of the uploaded file
+	Path string `json:"path"`
+	// Size of the uploaded file in bytes
+	Size int64 `json:"size"`
+	// DigestAlg is the name of the digest message, e.g. "sha-384"
+	DigestAlg string `json:"digestAlg"`
+	// Digest of the uploaded file, hex encoded
+	Digest string `json:"digest"`
+	// Completed is the time the upload was placed in Dir
+	Completed time.Time `json:"completed"`
+	// Backup is the name within Dir of the file replaced by the upload, if
+	// it was backed up
+	Backup string `json:"backup,omitempty"`
+	// BackupSHA384 is the SHA-384 of the backup, hex encoded
+	BackupSHA384 string `json:"backupSha384,omitempty"`
+}
+
+// VerifyFile checks that the file at path has the expected digest, as the
+// digest sent by the device is checked during an upload, e.g. to recheck a
+// file uploaded before a crash without transferring it again. The algorithm
+// is selected by the length of expected: SHA-384, the default for uploads, or
+// SHA-256. If the digest does not match, the error wraps [ErrSHAMismatch].
+func VerifyFile(path string, expected []byte) error {
+	var hashFunc crypto.Hash
+	switch len(expected) {
+	case crypto.SHA384.Size():
+		hashFunc = crypto.SHA384
+	case crypto.SHA256.Size():
+		hashFunc = crypto.SHA256
+	default:
+		return fmt.Errorf("invalid digest length for %q: got %d bytes, expected %d or %d",
+			path, len(expected), crypto.SHA384.Size(), crypto.SHA256.Size())
+	}
+
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := hashFunc.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("error reading %q: %w", path, err)
+	}
+	if !bytes.Equal(h.Sum(nil), expected) {
+		return fmt.Errorf("verifying %q: %w: %s did not match", path, ErrSHAMismatch, hashFunc)
+	}
+	return nil
+}
+
+// writeReceipt writes the receipt of a completed upload through an [os.Root],
+// so that it cannot escape Dir.
+func (u *UploadRequest) writeReceipt() error {
+	digestAlg, _, err := u.digestAlg()
+	if err != nil {
+		return err
+	}
+	receipt, err := json.MarshalIndent(UploadReceipt{
+		Name:         u.Name,
+		Path:         u.result.Path,
+		Size:         u.result.Size,
+		DigestAlg:    digestAlg,
+		Digest:       hex.EncodeToString(u.digest),
+		Completed:    time.Now().UTC(),
+		Backup:       u.backup,
+		BackupSHA384: u.backupDigest,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	suffix := u.ReceiptSuffix
+	if suffix == "" {
+		suffix = ".receipt.json"
+	}
+	root, closeRoot, err := u.openDest()
+	if err != nil {
+		return err
+	}
+	defer closeRoot()
+
+	f, err := root.OpenFile(u.dest+suffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(receipt, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if u.Sync {
+		if err := f.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return u.syncDir(root)
+}
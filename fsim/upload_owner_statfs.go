@@ -0,0 +1,26 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build linux || darwin || freebsd
+
+package fsim
+
+import (
+	"context"
+	"math"
+	"syscall"
+)
+
+// freeSpace returns the number of bytes available to an unprivileged user on
+// the filesystem containing path, or ctx.Err() if ctx is done first.
+func freeSpace(ctx context.Context, path string) (available int64, ok bool, _ error) {
+	var stat syscall.Statfs_t
+	if err := statContext(ctx, func() error { return syscall.Statfs(path, &stat) }); err != nil {
+		return 0, false, err
+	}
+	bavail, bsize := uint64(stat.Bavail), uint64(stat.Bsize) //nolint:gosec // Sizes are never negative
+	if bsize > 0 && bavail > math.MaxInt64/bsize {
+		return math.MaxInt64, true, nil
+	}
+	return int64(bavail * bsize), true, nil //nolint:gosec // Overflow checked above
+}
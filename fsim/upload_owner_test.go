@@ -0,0 +1,3840 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim_test
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/fsim"
+	"github.com/fido-device-onboard/go-fdo/fsim/fsimtest"
+	"github.com/fido-device-onboard/go-fdo/kex"
+	"github.com/fido-device-onboard/go-fdo/protocol"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+type message struct {
+	Name string
+	Body []byte
+}
+
+// deviceUpload returns the service info messages sent by a device uploading
+// data in chunks of chunkSize bytes.
+func deviceUpload(t *testing.T, data []byte, chunkSize int) []message {
+	t.Helper()
+
+	sum := sha512.Sum384(data)
+	msgs := []message{
+		{Name: "active", Body: mustMarshal(t, true)},
+		{Name: "length", Body: mustMarshal(t, int64(len(data)))},
+	}
+	for len(data) > 0 {
+		n := min(chunkSize, len(data))
+		msgs = append(msgs, message{Name: "data", Body: mustMarshal(t, data[:n])})
+		data = data[n:]
+	}
+	return append(msgs, message{Name: "sha-384", Body: mustMarshal(t, sum[:])})
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := cbor.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// runUpload drives the owner module through a complete upload, returning the
+// first error produced.
+func runUpload(ctx context.Context, u *fsim.UploadRequest, msgs []message) error {
+	if _, _, err := u.ProduceInfo(ctx, serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := u.HandleInfo(ctx, msg.Name, bytes.NewReader(msg.Body)); err != nil {
+			return err
+		}
+	}
+	_, done, err := u.ProduceInfo(ctx, serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU))
+	if err != nil {
+		return err
+	}
+	if !done {
+		return errNotDone
+	}
+	return nil
+}
+
+var errNotDone = errors.New("module did not complete")
+
+func TestUploadResume(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	const offset = 1000
+
+	for _, test := range []struct {
+		name    string
+		partial []byte
+		offset  int64
+	}{
+		{name: "resume", partial: data[:offset], offset: offset},
+		{name: "offset beyond length", partial: append(bytes.Clone(data), "extra"...), offset: int64(len(data)) + 5},
+		{name: "offset does not match partial file", partial: data[:offset], offset: offset + 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			partial, err := os.Create(filepath.Join(dir, "partial"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := partial.Write(test.partial); err != nil {
+				t.Fatal(err)
+			}
+			h := sha512.New384()
+			_, _ = h.Write(test.partial)
+
+			var resumed string
+			u := &fsim.UploadRequest{
+				Dir:  dir,
+				Name: "file.bin",
+				ResumeFrom: func(name string) (int64, hash.Hash, *os.File, error) {
+					resumed = name
+					return test.offset, h, partial, nil
+				},
+			}
+			if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+				t.Fatal(err)
+			}
+			if resumed != "file.bin" {
+				t.Errorf("expected ResumeFrom to be called with %q, got %q", "file.bin", resumed)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("uploaded contents did not match: got %d bytes, expected %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestUploadResumeCleanup(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	// resumable returns an upload which resumes from a partial file in dir
+	resumable := func(t *testing.T, dir string) *fsim.UploadRequest {
+		partial, err := os.Create(filepath.Join(dir, "partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := partial.Write(data[:1000]); err != nil {
+			t.Fatal(err)
+		}
+		h := sha512.New384()
+		_, _ = h.Write(data[:1000])
+		return &fsim.UploadRequest{
+			Dir:        dir,
+			Name:       "file.bin",
+			ResumeFrom: func(string) (int64, hash.Hash, *os.File, error) { return 1000, h, partial, nil },
+		}
+	}
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		dir := t.TempDir()
+		msgs := deviceUpload(t, data, 100)
+		otherSum := sha512.Sum384([]byte("other"))
+		msgs[len(msgs)-1].Body = mustMarshal(t, otherSum[:])
+		if err := runUpload(t.Context(), resumable(t, dir), msgs); !errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected digest mismatch, got %v", err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Fatalf("expected the partial file to be removed, got %v", entries)
+		}
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		dir := t.TempDir()
+		u := resumable(t, dir)
+		msgs := deviceUpload(t, data, 100)
+		if err := runUpload(t.Context(), u, msgs[:len(msgs)/2]); !errors.Is(err, errNotDone) {
+			t.Fatalf("expected the upload to be incomplete, got %v", err)
+		}
+		u.Reset()
+		if _, err := os.Stat(filepath.Join(dir, "partial")); err != nil {
+			t.Fatalf("expected the partial file to be kept: %v", err)
+		}
+	})
+}
+
+func TestUploadMaxBytes(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	t.Run("length exceeds max", func(t *testing.T) {
+		dir := t.TempDir()
+		var created bool
+		u := &fsim.UploadRequest{
+			Dir:      dir,
+			Name:     "file.bin",
+			MaxBytes: int64(len(data)) - 1,
+			CreateTemp: func() (*os.File, error) {
+				created = true
+				return os.CreateTemp(dir, "fdo.upload_*")
+			},
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); !errors.Is(err, fsim.ErrLengthExceeded) {
+			t.Fatalf("expected upload exceeding max length to fail, got %v", err)
+		}
+		if created {
+			t.Error("expected temp file not to be created")
+		}
+	})
+
+	t.Run("data exceeds max", func(t *testing.T) {
+		msgs := deviceUpload(t, data, 100)
+		msgs[1].Body = mustMarshal(t, int64(10)) // under-report length
+		u := &fsim.UploadRequest{
+			Dir:      t.TempDir(),
+			Name:     "file.bin",
+			MaxBytes: 150,
+		}
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrLengthExceeded) {
+			t.Fatalf("expected upload exceeding max bytes to fail, got %v", err)
+		}
+	})
+
+	t.Run("within max", func(t *testing.T) {
+		u := &fsim.UploadRequest{
+			Dir:      t.TempDir(),
+			Name:     "file.bin",
+			MaxBytes: int64(len(data)),
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUploadMinFreeBytes(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	u := &fsim.UploadRequest{
+		Dir:          t.TempDir(),
+		Name:         "file.bin",
+		MinFreeBytes: math.MaxInt64 - int64(len(data)),
+	}
+	err := runUpload(t.Context(), u, deviceUpload(t, data, 100))
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+		if err == nil || !strings.Contains(err.Error(), "bytes available") {
+			t.Fatalf("expected insufficient free space error, got %v", err)
+		}
+	default:
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u = &fsim.UploadRequest{
+		Dir:          t.TempDir(),
+		Name:         "file.bin",
+		MinFreeBytes: 1,
+	}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	type progress struct{ written, total int64 }
+	var got []progress
+	u := &fsim.UploadRequest{
+		Dir:  t.TempDir(),
+		Name: "file.bin",
+		OnProgress: func(name string, written, total int64) {
+			if name != "file.bin" {
+				t.Errorf("expected progress for %q, got %q", "file.bin", name)
+			}
+			got = append(got, progress{written, total})
+		},
+	}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	total := int64(len(data))
+	expect := []progress{{1000, total}, {2000, total}, {3000, total}, {total, total}, {total, total}}
+	if !slices.Equal(got, expect) {
+		t.Fatalf("expected progress %v, got %v", expect, got)
+	}
+}
+
+func TestUploadOnChunk(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	t.Run("snapshot", func(t *testing.T) {
+		got := make(map[int64][]byte)
+		u := &fsim.UploadRequest{
+			Dir:  t.TempDir(),
+			Name: "file.bin",
+			OnChunk: func(_ string, written int64, digest []byte) error {
+				got[written] = digest
+				return nil
+			},
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int64{1000, 2000, 3000, int64(len(data))} {
+			if sum := sha512.Sum384(data[:n]); !bytes.Equal(got[n], sum[:]) {
+				t.Errorf("expected digest of first %d bytes %x, got %x", n, sum, got[n])
+			}
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		errBadPrefix := errors.New("bad prefix")
+		u := &fsim.UploadRequest{
+			Dir:     dir,
+			Name:    "file.bin",
+			TempDir: tempDir,
+			OnChunk: func(_ string, written int64, _ []byte) error {
+				if written >= 2000 {
+					return errBadPrefix
+				}
+				return nil
+			},
+		}
+		err := runUpload(t.Context(), u, deviceUpload(t, data, 1000))
+		if !errors.Is(err, fsim.ErrRejected) || !errors.Is(err, errBadPrefix) {
+			t.Fatalf("expected upload to be rejected, got %v", err)
+		}
+		for _, d := range []string{dir, tempDir} {
+			if entries, _ := os.ReadDir(d); len(entries) > 0 {
+				t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+			}
+		}
+	})
+}
+
+func TestUploadHashAlg(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	sha256Sum := sha256.Sum256(data)
+
+	t.Run("request", func(t *testing.T) {
+		for alg, expect := range map[protocol.HashAlg][]byte{
+			0:                   {0xf5},
+			protocol.Sha384Hash: {0xf5},
+			protocol.Sha256Hash: mustMarshal(t, "sha-256"),
+		} {
+			u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", HashAlg: alg}
+			producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+			if _, _, err := u.ProduceInfo(t.Context(), producer); err != nil {
+				t.Fatal(err)
+			}
+			i := slices.IndexFunc(producer.ServiceInfo(), func(kv *serviceinfo.KV) bool { return kv.Key == "fdo.upload:need-sha" })
+			if i < 0 {
+				t.Fatal("need-sha not sent")
+			}
+			if got := producer.ServiceInfo()[i].Val; !bytes.Equal(got, expect) {
+				t.Errorf("%v: expected need-sha % x, got % x", alg, expect, got)
+			}
+		}
+	})
+
+	t.Run("sha-256", func(t *testing.T) {
+		msgs := deviceUpload(t, data, 100)
+		msgs[len(msgs)-1] = message{Name: "sha-256", Body: mustMarshal(t, sha256Sum[:])}
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", HashAlg: protocol.Sha256Hash}
+		if err := runUpload(t.Context(), u, msgs); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("wrong digest message", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", HashAlg: protocol.Sha256Hash}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err == nil {
+			t.Fatal("expected sha-384 digest to be rejected")
+		}
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		msgs := deviceUpload(t, data, 100)
+		msgs[len(msgs)-1] = message{Name: "sha-256", Body: mustMarshal(t, make([]byte, sha256.Size))}
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", HashAlg: protocol.Sha256Hash}
+		err := runUpload(t.Context(), u, msgs)
+		if !errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected sha-256 mismatch, got %v", err)
+		}
+		var uploadErr *fsim.UploadError
+		if !errors.As(err, &uploadErr) || uploadErr.Name != "file.bin" || uploadErr.Op != "verify" {
+			t.Fatalf("expected upload error for verifying file.bin, got %#v", uploadErr)
+		}
+	})
+
+	t.Run("wrong digest length", func(t *testing.T) {
+		msgs := deviceUpload(t, data, 100)
+		msgs[len(msgs)-1].Body = mustMarshal(t, sha256Sum[:])
+		tempDir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", TempDir: tempDir}
+		err := runUpload(t.Context(), u, msgs)
+		if err == nil {
+			t.Fatal("expected 32 byte sha-384 digest to be rejected")
+		}
+		if errors.Is(err, fsim.ErrSHAMismatch) || !strings.Contains(err.Error(), "invalid digest length") {
+			t.Fatalf("expected invalid digest length error, got %v", err)
+		}
+		if u.Status().HaveDigest {
+			t.Fatal("expected invalid digest not to be stored")
+		}
+		if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+			t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+		}
+	})
+}
+
+func TestUploadExpectedSHA384(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	expected := sha512.Sum384(data)
+
+	t.Run("match", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", ExpectedSHA384: expected[:]}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+	})
+
+	t.Run("substituted content", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, ExpectedSHA384: expected[:]}
+		// The device reports a digest which matches the content it sent
+		substitute := bytes.Repeat([]byte("Goodbye World!\n"), 256)
+		err := runUpload(t.Context(), u, deviceUpload(t, substitute, 1000))
+		if !errors.Is(err, fsim.ErrSHAMismatch) || !strings.Contains(err.Error(), "expected digest") {
+			t.Fatalf("expected mismatch with the expected digest, got %v", err)
+		}
+		for _, d := range []string{dir, tempDir} {
+			if entries, _ := os.ReadDir(d); len(entries) > 0 {
+				t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+			}
+		}
+	})
+
+	for _, test := range []struct {
+		name     string
+		hashAlg  protocol.HashAlg
+		expected []byte
+	}{
+		{name: "sha-256", hashAlg: protocol.Sha256Hash, expected: expected[:]},
+		{name: "short digest", expected: expected[:32]},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", HashAlg: test.hashAlg, ExpectedSHA384: test.expected}
+			producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+			if _, _, err := u.ProduceInfo(t.Context(), producer); err == nil || !strings.Contains(err.Error(), "SHA-384") {
+				t.Fatalf("expected invalid expected digest error, got %v", err)
+			}
+			if info := producer.ServiceInfo(); len(info) > 0 {
+				t.Fatalf("expected no upload to be requested, got %d service info", len(info))
+			}
+		})
+	}
+}
+
+func TestUploadQuarantine(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	badDigest := func(t *testing.T) []message {
+		msgs := deviceUpload(t, data, 1000)
+		msgs[len(msgs)-1].Body = mustMarshal(t, make([]byte, sha512.Size384))
+		return msgs
+	}
+	assertQuarantined := func(t *testing.T, quarantineDir string) {
+		t.Helper()
+		entries, err := os.ReadDir(quarantineDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("expected one quarantined file, found %d", len(entries))
+		}
+		name := entries[0].Name()
+		if !strings.HasPrefix(name, "logs%2Fdevice.") || !strings.HasSuffix(name, ".log") {
+			t.Fatalf("expected quarantined file named for logs/device.log, got %q", name)
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, "logs%2Fdevice."), ".log")
+		if _, err := time.Parse("20060102150405.000000", stamp); err != nil {
+			t.Fatalf("expected timestamp in quarantined file name %q: %v", name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(quarantineDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("expected quarantined file to contain the %d bytes received, got %d", len(data), len(got))
+		}
+	}
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		dir, tempDir, quarantineDir := t.TempDir(), t.TempDir(), t.TempDir()
+		var logs recordHandler
+		u := &fsim.UploadRequest{Dir: dir, Name: "logs/device.log", TempDir: tempDir, QuarantineDir: quarantineDir,
+			Logger: slog.New(&logs)}
+		if err := runUpload(t.Context(), u, badDigest(t)); !errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected digest mismatch, got %v", err)
+		}
+		assertQuarantined(t, quarantineDir)
+		for _, d := range []string{dir, tempDir} {
+			if entries, _ := os.ReadDir(d); len(entries) > 0 {
+				t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+			}
+		}
+		if !slices.Contains(logs.messages, "upload quarantined") {
+			t.Fatalf("expected quarantine to be logged, got log messages %q", logs.messages)
+		}
+	})
+
+	t.Run("expected digest mismatch", func(t *testing.T) {
+		quarantineDir := t.TempDir()
+		other := sha512.Sum384([]byte("other"))
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "logs/device.log", QuarantineDir: quarantineDir,
+			ExpectedSHA384: other[:]}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); !errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected digest mismatch, got %v", err)
+		}
+		assertQuarantined(t, quarantineDir)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		dir, quarantineDir := t.TempDir(), t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "logs/device.log", QuarantineDir: quarantineDir}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyUpload(t, dir, "device.log", data)
+		if entries, _ := os.ReadDir(quarantineDir); len(entries) > 0 {
+			t.Fatalf("expected nothing to be quarantined, found %s", entries[0].Name())
+		}
+	})
+
+	t.Run("missing dir", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "logs/device.log",
+			QuarantineDir: filepath.Join(t.TempDir(), "missing")}
+		producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+		if _, _, err := u.ProduceInfo(t.Context(), producer); err == nil || !strings.Contains(err.Error(), "quarantine") {
+			t.Fatalf("expected missing quarantine directory error, got %v", err)
+		}
+		if info := producer.ServiceInfo(); len(info) > 0 {
+			t.Fatalf("expected no upload to be requested, got %d service info", len(info))
+		}
+	})
+}
+
+func TestUploadVerifyHash(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	sum := sha512.Sum512(data)
+	expect := hex.EncodeToString(sum[:])
+
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", VerifyHash: sha512.New}
+		producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+		if _, _, err := u.ProduceInfo(t.Context(), producer); err != nil {
+			t.Fatal(err)
+		}
+		// The device is still asked for SHA-384
+		for _, kv := range producer.ServiceInfo() {
+			if kv.Key == "fdo.upload:need-sha" && !bytes.Equal(kv.Val, mustMarshal(t, true)) {
+				t.Fatalf("expected need-sha of true, got %x", kv.Val)
+			}
+		}
+		for _, msg := range deviceUpload(t, data, 1000) {
+			if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+		if result, _ := u.Result(); result.VerifyDigest != expect {
+			t.Fatalf("expected SHA-512 %s, got %q", expect, result.VerifyDigest)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		dir := t.TempDir()
+		partial, err := os.Create(filepath.Join(dir, "partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := partial.Write(data[:1000]); err != nil {
+			t.Fatal(err)
+		}
+		h := sha512.New384()
+		_, _ = h.Write(data[:1000])
+		u := &fsim.UploadRequest{
+			Dir:        dir,
+			Name:       "file.bin",
+			VerifyHash: sha512.New,
+			ResumeFrom: func(string) (int64, hash.Hash, *os.File, error) { return 1000, h, partial, nil },
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := u.Result(); result.VerifyDigest != expect {
+			t.Fatalf("expected SHA-512 %s, got %q", expect, result.VerifyDigest)
+		}
+	})
+
+	t.Run("sink", func(t *testing.T) {
+		u := &fsim.UploadRequest{
+			Name:       "file.bin",
+			VerifyHash: sha512.New,
+			Sink: func(string) (io.WriteCloser, error) {
+				return os.Create(filepath.Join(t.TempDir(), "sink"))
+			},
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := u.Result(); result.VerifyDigest != expect {
+			t.Fatalf("expected SHA-512 %s, got %q", expect, result.VerifyDigest)
+		}
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := u.Result(); result.VerifyDigest != "" {
+			t.Fatalf("expected no additional digest, got %q", result.VerifyDigest)
+		}
+	})
+}
+
+func TestUploadSync(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	for _, tempDir := range []string{"", t.TempDir()} {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{
+			Dir:  dir,
+			Name: "file.bin",
+			Sync: true,
+			CreateTemp: func() (*os.File, error) {
+				return os.CreateTemp(tempDir, "fdo.upload_*")
+			},
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("uploaded contents did not match")
+		}
+	}
+}
+
+func TestUploadContextCanceled(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	tempDir := t.TempDir()
+
+	ctx, cancel := context.WithDeadline(t.Context(), time.Now())
+	defer cancel()
+
+	u := &fsim.UploadRequest{
+		Dir:  t.TempDir(),
+		Name: "file.bin",
+		CreateTemp: func() (*os.File, error) {
+			return os.CreateTemp(tempDir, "fdo.upload_*")
+		},
+	}
+	if err := runUpload(ctx, u, deviceUpload(t, data, 100)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if entries, err := os.ReadDir(tempDir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) > 0 {
+		t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+	}
+}
+
+func TestUploadMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not supported on windows")
+	}
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	for _, test := range []struct {
+		name     string
+		existing os.FileMode
+		mode     os.FileMode
+		expect   os.FileMode
+	}{
+		{name: "default", expect: 0o600},
+		{name: "mode", mode: 0o644, expect: 0o644},
+		{name: "preserve existing", existing: 0o640, mode: 0o644, expect: 0o640},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, tempDir := range []string{dir, ""} {
+				if test.existing != 0 {
+					path := filepath.Join(dir, "file.bin")
+					if err := os.WriteFile(path, []byte("old"), test.existing); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.Chmod(path, test.existing); err != nil {
+						t.Fatal(err)
+					}
+				}
+				u := &fsim.UploadRequest{
+					Dir:  dir,
+					Name: "file.bin",
+					Mode: test.mode,
+					CreateTemp: func() (*os.File, error) {
+						return os.CreateTemp(tempDir, "fdo.upload_*")
+					},
+				}
+				if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+					t.Fatal(err)
+				}
+				info, err := os.Stat(filepath.Join(dir, "file.bin"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if perm := info.Mode().Perm(); perm != test.expect {
+					t.Errorf("temp dir %q: expected permissions %o, got %o", tempDir, test.expect, perm)
+				}
+				if err := os.Remove(filepath.Join(dir, "file.bin")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadMaxBackups(t *testing.T) {
+	upload := func(t *testing.T, dir string, overwrite fsim.OverwritePolicy, maxBackups int, data []byte, modTime time.Time) {
+		t.Helper()
+		if path := filepath.Join(dir, "file.bin"); !modTime.IsZero() {
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		u := &fsim.UploadRequest{
+			Dir:        dir,
+			Name:       "file.bin",
+			Overwrite:  overwrite,
+			MaxBackups: maxBackups,
+			CreateTemp: func() (*os.File, error) {
+				return os.CreateTemp(dir, ".fdo.upload_*")
+			},
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := func(t *testing.T, dir string) map[string]string {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, entry := range entries {
+			b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[entry.Name()] = string(b)
+		}
+		return got
+	}
+	base := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+
+	t.Run("prune oldest", func(t *testing.T) {
+		dir := t.TempDir()
+		upload(t, dir, fsim.OverwriteReplace, 2, []byte("v1"), time.Time{})
+		upload(t, dir, fsim.OverwriteReplace, 2, []byte("v2"), base.Add(2*time.Hour)) // backs up v1
+		upload(t, dir, fsim.OverwriteReplace, 2, []byte("v3"), base.Add(time.Hour))   // backs up v2, older timestamp than v1
+		upload(t, dir, fsim.OverwriteReplace, 2, []byte("v4"), base.Add(3*time.Hour)) // backs up v3, prunes v2
+
+		expect := map[string]string{
+			"file.bin":                       "v4",
+			"file.20240102050405.123456.bin": "v1",
+			"file.20240102060405.123456.bin": "v3",
+		}
+		if got := files(t, dir); !maps.Equal(got, expect) {
+			t.Fatalf("expected files %v, got %v", expect, got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		dir := t.TempDir()
+		upload(t, dir, fsim.OverwriteReplace, 0, []byte("v1"), time.Time{})
+		upload(t, dir, fsim.OverwriteReplace, 0, []byte("v2"), base)
+
+		expect := map[string]string{"file.bin": "v2"}
+		if got := files(t, dir); !maps.Equal(got, expect) {
+			t.Fatalf("expected files %v, got %v", expect, got)
+		}
+	})
+
+	t.Run("backup policy", func(t *testing.T) {
+		dir := t.TempDir()
+		upload(t, dir, fsim.OverwriteBackup, 0, []byte("v1"), time.Time{})
+		upload(t, dir, fsim.OverwriteBackup, 0, []byte("v2"), base)                // backs up v1
+		upload(t, dir, fsim.OverwriteBackup, 0, []byte("v3"), base.Add(time.Hour)) // backs up v2, prunes v1
+
+		expect := map[string]string{
+			"file.bin":                       "v3",
+			"file.20240102040405.123456.bin": "v2",
+		}
+		if got := files(t, dir); !maps.Equal(got, expect) {
+			t.Fatalf("expected files %v, got %v", expect, got)
+		}
+	})
+
+	t.Run("keep all", func(t *testing.T) {
+		dir := t.TempDir()
+		upload(t, dir, fsim.OverwriteReplace, -1, []byte("v1"), time.Time{})
+		for i := range 5 {
+			upload(t, dir, fsim.OverwriteReplace, -1, []byte("v"), base.Add(time.Duration(i)*time.Hour))
+		}
+		if got := files(t, dir); len(got) != 6 {
+			t.Fatalf("expected 5 backups, got %v", got)
+		}
+	})
+
+	t.Run("collision", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file.20240102030405.123456.bin"), []byte("v0"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		upload(t, dir, fsim.OverwriteReplace, 2, []byte("v1"), time.Time{})
+		upload(t, dir, fsim.OverwriteReplace, 2, []byte("v2"), base) // backs up v1 with a taken name
+		upload(t, dir, fsim.OverwriteReplace, 2, []byte("v3"), base) // backs up v2 with two taken names, prunes v0
+
+		expect := map[string]string{
+			"file.bin":                         "v3",
+			"file.20240102030405.123456.1.bin": "v1",
+			"file.20240102030405.123456.2.bin": "v2",
+		}
+		if got := files(t, dir); !maps.Equal(got, expect) {
+			t.Fatalf("expected files %v, got %v", expect, got)
+		}
+	})
+}
+
+func TestMultiUpload(t *testing.T) {
+	files := map[string][]byte{
+		"first.bin":       bytes.Repeat([]byte("Hello World!\n"), 512),
+		"logs/second.log": bytes.Repeat([]byte("Goodbye World!\n"), 64),
+		"third.bin":       {},
+	}
+	fsys := fstest.MapFS{}
+	for name, data := range files {
+		fsys[name] = &fstest.MapFile{Data: data, Mode: 0o644}
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		dir := t.TempDir()
+		owner := &fsim.MultiUpload{Requests: []*fsim.UploadRequest{
+			{Dir: dir, Name: "first.bin"},
+			{Dir: dir, Name: "logs/second.log", HashAlg: protocol.Sha256Hash},
+			{Dir: dir, Name: "third.bin", Rename: "empty.bin"},
+		}}
+		device := &fsim.Upload{FS: fsys, ChunkSize: 1000}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.upload", owner, device); err != nil {
+			t.Fatal(err)
+		}
+		for name, dest := range map[string]string{"first.bin": "first.bin", "logs/second.log": "second.log", "third.bin": "empty.bin"} {
+			result, ok := owner.Result(name)
+			if !ok || result.Size != int64(len(files[name])) {
+				t.Fatalf("expected result of %d bytes for %s, got %+v (ok=%t)", len(files[name]), name, result, ok)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, dest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, files[name]) {
+				t.Fatalf("upload contents of %q did not match expected", name)
+			}
+		}
+	})
+
+	t.Run("failed file", func(t *testing.T) {
+		dir := t.TempDir()
+		owner := &fsim.MultiUpload{Requests: []*fsim.UploadRequest{
+			{Dir: dir, Name: "first.bin"},
+			{Dir: dir, Name: "logs/second.log", MaxBytes: 10},
+			{Dir: dir, Name: "third.bin"},
+		}}
+		device := &fsim.Upload{FS: fsys}
+		err := fsimtest.RunExchange(t.Context(), "fdo.upload", owner, device)
+		if err == nil || !strings.Contains(err.Error(), "upload 2 of 3 (logs/second.log)") {
+			t.Fatalf("expected error for the second file, got %v", err)
+		}
+		var uploadErr *fsim.UploadError
+		if !errors.As(err, &uploadErr) || uploadErr.Name != "logs/second.log" {
+			t.Fatalf("expected upload error for logs/second.log, got %v", err)
+		}
+		if _, ok := owner.Result("first.bin"); !ok {
+			t.Fatal("expected first upload to have completed")
+		}
+		if _, ok := owner.Result("third.bin"); ok {
+			t.Fatal("expected third upload not to be requested")
+		}
+	})
+}
+
+func TestUploadResult(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	dir := t.TempDir()
+
+	u := &fsim.UploadRequest{Dir: dir, Name: "path/to/file.bin"}
+	if _, ok := u.Result(); ok {
+		t.Fatal("expected no result before upload")
+	}
+	device := &fsim.Upload{FS: fstest.MapFS{
+		"path/to/file.bin": &fstest.MapFile{Data: data, Mode: 0o644},
+	}}
+	if err := fsimtest.RunExchange(t.Context(), "fdo.upload", u, device); err != nil {
+		t.Fatal(err)
+	}
+	result, ok := u.Result()
+	if !ok {
+		t.Fatal("expected result after upload")
+	}
+	// The method depends on whether the default temp dir shares a device
+	// with dir
+	expect := fsim.UploadResult{Path: filepath.Join(dir, "file.bin"), Size: int64(len(data)), Method: result.Method}
+	if result != expect || (result.Method != "rename" && result.Method != "copy") {
+		t.Fatalf("expected result %+v, got %+v", expect, result)
+	}
+}
+
+func TestUploadStatus(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	total := int64(len(data))
+	u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+	if status := u.Status(); status != (fsim.UploadStatus{}) {
+		t.Fatalf("expected empty status before upload, got %+v", status)
+	}
+
+	// Poll concurrently, as an operator diagnosing a stall would
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = u.Status()
+			}
+		}
+	}()
+	defer func() { close(stop); <-polled }()
+
+	if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+		t.Fatal(err)
+	}
+	if status := u.Status(); status != (fsim.UploadStatus{Requested: true}) {
+		t.Fatalf("expected requested status, got %+v", status)
+	}
+
+	// Messages are active, length, data..., and sha-384
+	msgs := deviceUpload(t, data, 1000)
+	for i, msg := range msgs {
+		if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+			t.Fatal(err)
+		}
+		expect := fsim.UploadStatus{Requested: true}
+		switch {
+		case i == 0:
+		case i < len(msgs)-1:
+			expect.Length, expect.HasLength, expect.Written = total, true, min(int64(i-1)*1000, total)
+		default:
+			expect.Length, expect.HasLength, expect.Written, expect.HaveDigest, expect.Done = total, true, total, true, true
+		}
+		if status := u.Status(); status != expect {
+			t.Fatalf("after message %d (%s): expected status %+v, got %+v", i, msg.Name, expect, status)
+		}
+	}
+
+	u.Reset()
+	if status := u.Status(); status != (fsim.UploadStatus{}) {
+		t.Fatalf("expected empty status after reset, got %+v", status)
+	}
+}
+
+func TestUploadProgressReporter(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	total := int64(len(data))
+
+	var module serviceinfo.OwnerModule = &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+	reporter, ok := module.(serviceinfo.ProgressReporter)
+	if !ok {
+		t.Fatal("expected upload to implement ProgressReporter")
+	}
+	if done, total := reporter.Progress(); done != 0 || total != -1 {
+		t.Fatalf("expected progress 0/-1 before upload, got %d/%d", done, total)
+	}
+
+	if _, _, err := module.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+		t.Fatal(err)
+	}
+	// Messages are active, length, data..., and sha-384
+	msgs := deviceUpload(t, data, 1000)
+	for i, msg := range msgs {
+		if err := module.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+			t.Fatal(err)
+		}
+		expectDone, expectTotal := int64(0), total
+		switch {
+		case i == 0:
+			expectTotal = -1
+		case i < len(msgs)-1:
+			expectDone = min(int64(i-1)*1000, total)
+		default:
+			expectDone = total
+		}
+		if done, total := reporter.Progress(); done != expectDone || total != expectTotal {
+			t.Fatalf("after message %d (%s): expected progress %d/%d, got %d/%d",
+				i, msg.Name, expectDone, expectTotal, done, total)
+		}
+	}
+}
+
+func TestUploadDevice(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 1000)
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file.bin"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		chunkSize int
+		hashAlg   protocol.HashAlg
+		digest    func([]byte) []byte
+	}{
+		{name: "default", digest: func(b []byte) []byte { sum := sha512.Sum384(b); return sum[:] }},
+		{name: "small chunks", chunkSize: 100, digest: func(b []byte) []byte { sum := sha512.Sum384(b); return sum[:] }},
+		{name: "large chunks", chunkSize: 4000, digest: func(b []byte) []byte { sum := sha512.Sum384(b); return sum[:] }},
+		{name: "sha-256", hashAlg: protocol.Sha256Hash, digest: func(b []byte) []byte { sum := sha256.Sum256(b); return sum[:] }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			owner := &fsim.UploadRequest{Dir: dir, Name: "file.bin", HashAlg: test.hashAlg, WriteReceipt: true}
+			device := &fsim.Upload{FS: os.DirFS(srcDir), ChunkSize: test.chunkSize}
+			if err := fsimtest.RunExchange(t.Context(), "fdo.upload", owner, device); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("uploaded file does not match (err %v)", err)
+			}
+			b, err := os.ReadFile(filepath.Join(dir, "file.bin.receipt.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var receipt fsim.UploadReceipt
+			if err := json.Unmarshal(b, &receipt); err != nil {
+				t.Fatal(err)
+			}
+			if expect := hex.EncodeToString(test.digest(data)); receipt.Digest != expect {
+				t.Errorf("expected digest sent by device to be %s, got %s", expect, receipt.Digest)
+			}
+		})
+	}
+}
+
+// memDest is an in-memory fsim.DestFS.
+type memDest struct{ fstest.MapFS }
+
+func (m memDest) OpenFile(name string, flag int, perm fs.FileMode) (fsim.DestFile, error) {
+	key := filepath.ToSlash(name)
+	if dir := path.Dir(key); dir != "." {
+		if info, err := m.Stat(dir); err != nil || !info.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	f, ok := m.MapFS[key]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		f = &fstest.MapFile{Mode: perm, ModTime: time.Now()}
+		m.MapFS[key] = f
+	case flag&os.O_TRUNC != 0:
+		f.Data = nil
+	}
+	return &memFile{m: m, key: key, f: f}, nil
+}
+
+func (m memDest) Lstat(name string) (fs.FileInfo, error) { return m.Stat(filepath.ToSlash(name)) }
+
+func (m memDest) ReadDir(name string) ([]fs.DirEntry, error) {
+	return m.MapFS.ReadDir(filepath.ToSlash(name))
+}
+
+func (m memDest) Rename(oldname, newname string) error {
+	f, ok := m.MapFS[filepath.ToSlash(oldname)]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	delete(m.MapFS, filepath.ToSlash(oldname))
+	m.MapFS[filepath.ToSlash(newname)] = f
+	return nil
+}
+
+func (m memDest) Remove(name string) error {
+	if _, ok := m.MapFS[filepath.ToSlash(name)]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.MapFS, filepath.ToSlash(name))
+	return nil
+}
+
+func (m memDest) MkdirAll(name string, perm fs.FileMode) error {
+	for dir := filepath.ToSlash(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := m.MapFS[dir]; !ok {
+			m.MapFS[dir] = &fstest.MapFile{Mode: fs.ModeDir | perm}
+		}
+	}
+	return nil
+}
+
+type memFile struct {
+	m   memDest
+	key string
+	f   *fstest.MapFile
+}
+
+func (f *memFile) Write(p []byte) (int, error)  { f.f.Data = append(f.f.Data, p...); return len(p), nil }
+func (f *memFile) Stat() (fs.FileInfo, error)   { return f.m.Stat(f.key) }
+func (f *memFile) Sync() error                  { return nil }
+func (f *memFile) Truncate(size int64) error    { f.f.Data = f.f.Data[:size]; return nil }
+func (f *memFile) Chmod(mode fs.FileMode) error { f.f.Mode = mode; return nil }
+func (f *memFile) Close() error                 { return nil }
+
+func TestUploadDest(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	old := []byte("old")
+	upload := func(t *testing.T, u *fsim.UploadRequest) error {
+		t.Helper()
+		u.Name, u.TempDir = "file.bin", t.TempDir()
+		return fsimtest.RunExchange(t.Context(), "fdo.upload", u, &fsim.Upload{
+			FS: fstest.MapFS{"file.bin": &fstest.MapFile{Data: data}},
+		})
+	}
+
+	t.Run("create", func(t *testing.T) {
+		dest := memDest{fstest.MapFS{}}
+		u := &fsim.UploadRequest{Dest: dest, Rename: "sub/file.bin", CreateDirs: true, Mode: 0o640, WriteReceipt: true}
+		if err := upload(t, u); err != nil {
+			t.Fatal(err)
+		}
+		if f := dest.MapFS["sub/file.bin"]; f == nil || !bytes.Equal(f.Data, data) || f.Mode != 0o640 {
+			t.Fatalf("expected uploaded file with mode 0640, got %+v", f)
+		}
+		if dest.MapFS["sub/file.bin.receipt.json"] == nil {
+			t.Error("expected receipt to be written to Dest")
+		}
+		if result, _ := u.Result(); result.Path != filepath.Join("sub", "file.bin") || result.Method != "copy" {
+			t.Errorf("expected result path relative to Dest placed by copy, got %+v", result)
+		}
+	})
+
+	t.Run("backup", func(t *testing.T) {
+		dest := memDest{fstest.MapFS{"file.bin": &fstest.MapFile{Data: old, Mode: 0o600}}}
+		if err := upload(t, &fsim.UploadRequest{Dest: dest, MaxBackups: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if len(dest.MapFS) != 2 || !bytes.Equal(dest.MapFS["file.bin"].Data, data) {
+			t.Fatalf("expected uploaded file and one backup, got %v", slices.Collect(maps.Keys(dest.MapFS)))
+		}
+		for name, f := range dest.MapFS {
+			if name != "file.bin" && !bytes.Equal(f.Data, old) {
+				t.Errorf("expected backup %q to hold the previous file", name)
+			}
+		}
+	})
+
+	t.Run("file exists", func(t *testing.T) {
+		dest := memDest{fstest.MapFS{"file.bin": &fstest.MapFile{Data: old}}}
+		if err := upload(t, &fsim.UploadRequest{Dest: dest, WriteMode: fsim.WriteFail}); !errors.Is(err, fsim.ErrFileExists) {
+			t.Fatalf("expected file exists error, got %v", err)
+		}
+		if !bytes.Equal(dest.MapFS["file.bin"].Data, old) {
+			t.Fatal("expected existing file to be unchanged")
+		}
+	})
+
+	t.Run("owner unsupported", func(t *testing.T) {
+		dest := memDest{fstest.MapFS{}}
+		if err := upload(t, &fsim.UploadRequest{Dest: dest, Owner: &fsim.FileOwner{UID: 0, GID: -1}}); err == nil {
+			t.Fatal("expected setting owner to fail")
+		}
+		if len(dest.MapFS) > 0 {
+			t.Fatalf("expected Dest to be empty, got %v", slices.Collect(maps.Keys(dest.MapFS)))
+		}
+	})
+}
+
+// hashNamedUpload is a device module which, like some forks, sends the digest
+// in a "hash" message, requested with a need-sha value of "hash".
+type hashNamedUpload struct{ fsim.Upload }
+
+func (u *hashNamedUpload) Receive(ctx context.Context, messageName string, messageBody io.Reader, respond func(string) io.Writer, yield func()) error {
+	if messageName == "need-sha" {
+		var needSha string
+		if err := cbor.NewDecoder(messageBody).Decode(&needSha); err != nil {
+			return err
+		}
+		if needSha != "hash" {
+			return fmt.Errorf("unexpected need-sha %q", needSha)
+		}
+		messageBody = bytes.NewReader([]byte{0xf5}) // true
+	}
+	return u.Upload.Receive(ctx, messageName, messageBody, func(messageName string) io.Writer {
+		if messageName == "sha-384" {
+			messageName = "hash"
+		}
+		return respond(messageName)
+	}, yield)
+}
+
+func TestUploadDigestMessageName(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	fsys := fstest.MapFS{"file.bin": &fstest.MapFile{Data: data}}
+
+	t.Run("custom", func(t *testing.T) {
+		dir := t.TempDir()
+		owner := &fsim.UploadRequest{Dir: dir, Name: "file.bin", DigestMessageName: "hash"}
+		device := &hashNamedUpload{fsim.Upload{FS: fsys}}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.upload", owner, device); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("uploaded file does not match (err %v)", err)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		owner := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", DigestMessageName: "sha-384"}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.upload", owner, &fsim.Upload{FS: fsys}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("standard digest rejected", func(t *testing.T) {
+		owner := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", DigestMessageName: "hash"}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.upload", owner, &fsim.Upload{FS: fsys}); err == nil {
+			t.Fatal("expected standard device to reject need-sha of \"hash\"")
+		}
+	})
+
+	for _, name := range []string{"data", "sha-256", "content-type", "a:b"} {
+		t.Run("invalid "+name, func(t *testing.T) {
+			owner := &fsim.UploadRequest{
+				Name:              "file.bin",
+				DigestMessageName: name,
+				Metadata:          map[string]any{"content-type": "text/plain"},
+			}
+			if _, _, err := owner.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err == nil {
+				t.Fatalf("expected digest message name %q to be rejected", name)
+			}
+		})
+	}
+}
+
+func TestUploadSink(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	t.Run("success", func(t *testing.T) {
+		dir := t.TempDir()
+		pr, pw := io.Pipe()
+		done := make(chan []byte)
+		go func() {
+			b, _ := io.ReadAll(pr)
+			done <- b
+		}()
+
+		u := &fsim.UploadRequest{
+			Dir:  dir,
+			Name: "file.bin",
+			Sink: func(name string) (io.WriteCloser, error) { return pw, nil },
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-done; !bytes.Equal(got, data) {
+			t.Fatal("sink contents did not match")
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+			t.Fatalf("expected Dir to be unused, found %s", entries[0].Name())
+		}
+		if result, _ := u.Result(); result != (fsim.UploadResult{Size: int64(len(data))}) {
+			t.Fatalf("unexpected result: %+v", result)
+		}
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		errc := make(chan error)
+		go func() {
+			_, err := io.ReadAll(pr)
+			errc <- err
+		}()
+
+		msgs := deviceUpload(t, data, 100)
+		msgs[len(msgs)-1].Body = mustMarshal(t, make([]byte, sha512.Size384))
+		u := &fsim.UploadRequest{
+			Name: "file.bin",
+			Sink: func(name string) (io.WriteCloser, error) { return pw, nil },
+		}
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected digest mismatch, got %v", err)
+		}
+		if err := <-errc; err == nil {
+			t.Fatal("expected sink to be closed with an error")
+		}
+	})
+}
+
+func TestUploadDeviceAbort(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	for _, test := range []struct {
+		name   string
+		reason any
+		expect string
+	}{
+		{name: "error", reason: "file changed while reading", expect: "file changed while reading"},
+		{name: "abort", reason: 5, expect: "5"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, tempDir := t.TempDir(), t.TempDir()
+			msgs := deviceUpload(t, data, 1000)
+			msgs = append(msgs[:3], message{Name: test.name, Body: mustMarshal(t, test.reason)})
+
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir}
+			err := runUpload(t.Context(), u, msgs)
+			var abort *fsim.DeviceAbortError
+			if !errors.Is(err, fsim.ErrDeviceAbort) || !errors.As(err, &abort) || abort.Message != test.expect {
+				t.Fatalf("expected device abort with message %q, got %v", test.expect, err)
+			}
+			for _, d := range []string{dir, tempDir} {
+				if entries, _ := os.ReadDir(d); len(entries) > 0 {
+					t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+				}
+			}
+		})
+	}
+}
+
+func TestUploadAbort(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	t.Run("mid data", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		metrics := new(fsim.MemoryMetrics)
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, Metrics: metrics}
+		if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+			t.Fatal(err)
+		}
+		// Messages are active, length, data..., and sha-384
+		msgs := deviceUpload(t, data, 1000)
+		for _, msg := range msgs[:4] {
+			if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if entries, _ := os.ReadDir(tempDir); len(entries) != 1 {
+			t.Fatalf("expected a temp file before aborting, found %d files", len(entries))
+		}
+
+		// Abort from another goroutine, as an owner process would
+		aborted := make(chan struct{})
+		go func() { defer close(aborted); u.Abort() }()
+		<-aborted
+
+		err := u.HandleInfo(t.Context(), msgs[4].Name, bytes.NewReader(msgs[4].Body))
+		if !errors.Is(err, fsim.ErrAborted) {
+			t.Fatalf("expected aborted error, got %v", err)
+		}
+		for _, d := range []string{dir, tempDir} {
+			if entries, _ := os.ReadDir(d); len(entries) > 0 {
+				t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+			}
+		}
+		if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); !errors.Is(err, fsim.ErrAborted) {
+			t.Fatalf("expected aborted error from produce, got %v", err)
+		}
+		if metrics.Failed(fsim.ErrAborted.Error()) != 1 {
+			t.Fatalf("expected one aborted upload, got %d", metrics.Failed(fsim.ErrAborted.Error()))
+		}
+	})
+
+	t.Run("before request", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		u.Abort()
+		producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+		if _, _, err := u.ProduceInfo(t.Context(), producer); !errors.Is(err, fsim.ErrAborted) {
+			t.Fatalf("expected aborted error, got %v", err)
+		}
+		if info := producer.ServiceInfo(); len(info) > 0 {
+			t.Fatalf("expected no upload to be requested, got %d service info", len(info))
+		}
+	})
+
+	t.Run("after done", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		u.Abort()
+		if _, done, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil || !done {
+			t.Fatalf("expected completed upload to be unaffected, got done=%t err=%v", done, err)
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+		u.Abort()
+		u.Reset()
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+	})
+}
+
+func TestUploadIncompleteChunk(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	chunk := mustMarshal(t, data[:100])
+
+	for _, test := range []struct {
+		name string
+		body []byte
+	}{
+		{name: "short chunk", body: chunk[:50]},
+		{name: "short final chunk", body: append(bytes.Clone(chunk), chunk[:len(chunk)-1]...)},
+		{name: "short header", body: chunk[:1]},
+		{name: "unterminated indefinite", body: append([]byte{0x5f}, chunk...)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			msgs := deviceUpload(t, data, 1000)
+			msgs[2].Body = test.body
+
+			u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", TempDir: tempDir}
+			if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrIncompleteChunk) {
+				t.Fatalf("expected incomplete chunk error, got %v", err)
+			}
+			if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+				t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+			}
+		})
+	}
+}
+
+func TestUploadInvalidRename(t *testing.T) {
+	data := []byte("Hello World!\n")
+	for _, test := range []struct {
+		name   string
+		Name   string
+		Rename string
+	}{
+		{name: "whitespace", Name: "file.txt", Rename: "  "},
+		{name: "dot", Name: "file.txt", Rename: "."},
+		{name: "clean to dot", Name: "file.txt", Rename: "a/.."},
+		{name: "trailing separator", Name: "file.txt", Rename: "a" + string(filepath.Separator)},
+		{name: "nul byte", Name: "file.txt", Rename: "a\x00b"},
+		{name: "parent", Name: "file.txt", Rename: "../file.txt"},
+		{name: "absolute", Name: "file.txt", Rename: filepath.Join(string(filepath.Separator), "file.txt")},
+		{name: "empty name", Name: "", Rename: ""},
+		{name: "whitespace name", Name: " ", Rename: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, tempDir := t.TempDir(), t.TempDir()
+			u := &fsim.UploadRequest{
+				Dir:    dir,
+				Name:   test.Name,
+				Rename: test.Rename,
+				CreateTemp: func() (*os.File, error) {
+					return os.CreateTemp(tempDir, "upload_*")
+				},
+			}
+			if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); !errors.Is(err, fsim.ErrPathTraversal) {
+				t.Fatalf("expected rename %q to be rejected, got %v", test.Rename, err)
+			}
+			for _, d := range []string{dir, tempDir} {
+				if entries, _ := os.ReadDir(d); len(entries) > 0 {
+					t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+				}
+			}
+		})
+	}
+}
+
+func TestUploadAllowExtensions(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 20)
+	allow := []string{".log", ".tar.gz", "JSON"}
+
+	for _, test := range []struct {
+		name, rename string
+		allowed      bool
+	}{
+		{name: "device.log", allowed: true},
+		{name: "DEVICE.LOG", allowed: true},
+		{name: "bin/tool", rename: "logs/tool.Log", allowed: true},
+		{name: "logs.tar.gz", allowed: true},
+		{name: "logs.TAR.GZ", allowed: true},
+		{name: "config.json", allowed: true},
+		{name: "logs.gz"},
+		{name: "install.sh"},
+		{name: "device.log.exe"},
+		{name: "device.log", rename: "device.exe"},
+		{name: "devicelog"},
+		{name: ".log"},
+		{name: ".bashrc"},
+		{name: ".hidden.log"},
+	} {
+		t.Run(test.name+test.rename, func(t *testing.T) {
+			dir := t.TempDir()
+			u := &fsim.UploadRequest{Dir: dir, Name: test.name, Rename: test.rename, CreateDirs: true, AllowExtensions: allow}
+			err := runUpload(t.Context(), u, deviceUpload(t, data, 100))
+			if test.allowed {
+				if err != nil {
+					t.Fatalf("expected %q to be allowed, got %v", cmp.Or(test.rename, test.name), err)
+				}
+				return
+			}
+			if !errors.Is(err, fsim.ErrNameNotAllowed) {
+				t.Fatalf("expected %q to be rejected, got %v", cmp.Or(test.rename, test.name), err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Fatalf("expected %s to be empty, found %s", dir, entries[0].Name())
+			}
+		})
+	}
+
+	t.Run("existing file", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "install.sh"), []byte("v1"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		u := &fsim.UploadRequest{Dir: dir, Name: "install.sh", MaxBackups: -1, AllowExtensions: allow}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); !errors.Is(err, fsim.ErrNameNotAllowed) {
+			t.Fatalf("expected install.sh to be rejected, got %v", err)
+		}
+		assertOnlyUpload(t, dir, "install.sh", []byte("v1"))
+	})
+}
+
+func TestUploadCreateDirs(t *testing.T) {
+	data := []byte("Hello World!\n")
+	rename := filepath.Join("a", "b", "file.txt")
+
+	t.Run("missing directory", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.txt", Rename: rename, TempDir: t.TempDir()}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err == nil {
+			t.Fatal("expected upload into a missing directory to fail")
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+			t.Fatalf("expected dir to be empty, found %s", entries[0].Name())
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.txt", Rename: rename, TempDir: t.TempDir(), CreateDirs: true}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, rename)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("expected %q, got %q (err %v)", data, got, err)
+		}
+		if result, _ := u.Result(); result.Path != filepath.Join(dir, rename) {
+			t.Errorf("expected result path %q, got %q", filepath.Join(dir, rename), result.Path)
+		}
+	})
+
+	t.Run("dir mode", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("file permissions are not supported on windows")
+		}
+		for _, test := range []struct {
+			name   string
+			mode   os.FileMode
+			expect os.FileMode
+		}{
+			{name: "default", expect: 0o700},
+			// Group write is usually removed by the umask
+			{name: "explicit", mode: 0o770, expect: 0o770},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				dir := t.TempDir()
+				if err := os.Mkdir(filepath.Join(dir, "a"), 0o711); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(filepath.Join(dir, "a"), 0o711); err != nil {
+					t.Fatal(err)
+				}
+				u := &fsim.UploadRequest{Dir: dir, Name: "file.txt", Rename: rename, TempDir: t.TempDir(), CreateDirs: true, DirMode: test.mode}
+				if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+					t.Fatal(err)
+				}
+				for name, expect := range map[string]os.FileMode{"a": 0o711, filepath.Join("a", "b"): test.expect} {
+					info, err := os.Lstat(filepath.Join(dir, name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !info.IsDir() || info.Mode().Perm() != expect {
+						t.Errorf("expected %s to be a directory with mode %o, got %s", name, expect, info.Mode())
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("traversal", func(t *testing.T) {
+		dir, outside := t.TempDir(), t.TempDir()
+		if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+		for _, rename := range []string{
+			filepath.Join("..", filepath.Base(outside), "b", "file.txt"),
+			filepath.Join("link", "b", "file.txt"),
+		} {
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.txt", Rename: rename, TempDir: t.TempDir(), CreateDirs: true}
+			if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err == nil {
+				t.Fatalf("expected rename %q to be rejected", rename)
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) > 0 {
+				t.Fatalf("expected nothing to be created outside of dir, found %s", entries[0].Name())
+			}
+		}
+	})
+}
+
+func TestUploadSymlinkDir(t *testing.T) {
+	data := []byte("Hello World!\n")
+	parent := t.TempDir()
+	target, other := filepath.Join(parent, "target"), filepath.Join(parent, "other")
+	for _, dir := range []string{target, other} {
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(parent, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	u := &fsim.UploadRequest{
+		Dir:     link,
+		Name:    "file.txt",
+		TempDir: t.TempDir(),
+		// Retarget Dir once the upload has started, which must not redirect
+		// the file
+		PreCommit: func(string, fsim.UploadMeta) error {
+			if err := os.Remove(link); err != nil {
+				return err
+			}
+			return os.Symlink(other, link)
+		},
+	}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+		t.Fatal(err)
+	}
+	assertOnlyUpload(t, target, "file.txt", data)
+	if entries, _ := os.ReadDir(other); len(entries) > 0 {
+		t.Fatalf("expected nothing to be placed in the new target, found %s", entries[0].Name())
+	}
+}
+
+func TestUploadBackpressure(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	msgs := deviceUpload(t, data, 1000)
+
+	var busy bool
+	u := &fsim.UploadRequest{
+		Dir:          t.TempDir(),
+		Name:         "file.bin",
+		TempDir:      t.TempDir(),
+		Backpressure: func() bool { return busy },
+	}
+	produce := func() (blockPeer, done bool) {
+		t.Helper()
+		blockPeer, done, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blockPeer, done
+	}
+	handle := func(msgs []message) {
+		t.Helper()
+		for _, msg := range msgs {
+			if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The request is sent regardless of backpressure
+	busy = true
+	if blockPeer, _ := produce(); blockPeer {
+		t.Fatal("expected request not to block the device")
+	}
+
+	// Assert backpressure after the first data message, then release it
+	handle(msgs[:3])
+	for range 3 {
+		if blockPeer, done := produce(); !blockPeer || done {
+			t.Fatalf("expected device to be blocked, got blockPeer=%t, done=%t", blockPeer, done)
+		}
+	}
+	busy = false
+	if blockPeer, done := produce(); blockPeer || done {
+		t.Fatalf("expected device to be released, got blockPeer=%t, done=%t", blockPeer, done)
+	}
+
+	// A completed upload never blocks
+	handle(msgs[3:])
+	busy = true
+	if blockPeer, done := produce(); blockPeer || !done {
+		t.Fatalf("expected upload to complete, got blockPeer=%t, done=%t", blockPeer, done)
+	}
+	if got, err := os.ReadFile(filepath.Join(u.Dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file does not match (err %v)", err)
+	}
+}
+
+func TestUploadGate(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	msgs := deviceUpload(t, data, 1000)
+
+	var mu sync.Mutex
+	open := false
+	setOpen := func(v bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		open = v
+	}
+	const interval = 20 * time.Millisecond
+	u := &fsim.UploadRequest{
+		Dir:         t.TempDir(),
+		Name:        "file.bin",
+		TempDir:     t.TempDir(),
+		IdleTimeout: interval,
+		Gate: func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return open
+		},
+	}
+	produce := func() (blockPeer, done bool, info int) {
+		t.Helper()
+		producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+		blockPeer, done, err := u.ProduceInfo(t.Context(), producer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blockPeer, done, len(producer.ServiceInfo())
+	}
+	handle := func(msgs []message) {
+		t.Helper()
+		for _, msg := range msgs {
+			if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The upload is requested while the gate is closed, then paused without
+	// waiting for the gate
+	if blockPeer, done, info := produce(); blockPeer || done || info == 0 {
+		t.Fatalf("expected upload to be requested, got blockPeer=%t, done=%t, %d service info", blockPeer, done, info)
+	}
+	start := time.Now()
+	if blockPeer, done, info := produce(); !blockPeer || done || info > 0 {
+		t.Fatalf("expected paused upload, got blockPeer=%t, done=%t, %d service info", blockPeer, done, info)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("expected paused exchange to return without waiting, returned after %s", elapsed)
+	}
+	setOpen(true)
+	if blockPeer, done, _ := produce(); blockPeer || done {
+		t.Fatalf("expected device to be resumed, got blockPeer=%t, done=%t", blockPeer, done)
+	}
+
+	// Pause in progress for longer than the idle timeout, then resume
+	handle(msgs[:3])
+	setOpen(false)
+	for range 3 {
+		time.Sleep(interval)
+		if blockPeer, done, _ := produce(); !blockPeer || done {
+			t.Fatalf("expected device to be paused, got blockPeer=%t, done=%t", blockPeer, done)
+		}
+	}
+	setOpen(true)
+	if blockPeer, done, _ := produce(); blockPeer || done {
+		t.Fatalf("expected device to be resumed, got blockPeer=%t, done=%t", blockPeer, done)
+	}
+
+	handle(msgs[3:])
+	if blockPeer, done, _ := produce(); blockPeer || !done {
+		t.Fatalf("expected upload to complete, got blockPeer=%t, done=%t", blockPeer, done)
+	}
+	if got, err := os.ReadFile(filepath.Join(u.Dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file does not match (err %v)", err)
+	}
+}
+
+func TestUploadMetrics(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	metrics := new(fsim.MemoryMetrics)
+	u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", TempDir: t.TempDir(), Metrics: metrics}
+
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	// Calling ProduceInfo again must not count the upload twice
+	if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+		t.Fatal(err)
+	}
+
+	u.Reset()
+	msgs := deviceUpload(t, data, 1000)
+	msgs[len(msgs)-1].Body = mustMarshal(t, make([]byte, sha512.Size384))
+	if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrSHAMismatch) {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+
+	if got := metrics.Started(); got != 2 {
+		t.Errorf("expected 2 uploads started, got %d", got)
+	}
+	if got := metrics.Succeeded(); got != 1 {
+		t.Errorf("expected 1 upload succeeded, got %d", got)
+	}
+	if got := metrics.Failed(fsim.ErrSHAMismatch.Error()); got != 1 {
+		t.Errorf("expected 1 upload failed with a digest mismatch, got %d", got)
+	}
+	if got := metrics.Bytes(); got != 2*int64(len(data)) {
+		t.Errorf("expected %d bytes, got %d", 2*len(data), got)
+	}
+}
+
+func TestUploadNoLeakedFiles(t *testing.T) {
+	if _, err := os.ReadDir("/proc/self/fd"); err != nil {
+		t.Skip("open files cannot be counted:", err)
+	}
+	openFiles := func() int {
+		t.Helper()
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	badDigest := deviceUpload(t, data, 1000)
+	badDigest[len(badDigest)-1].Body = mustMarshal(t, make([]byte, sha512.Size384))
+	truncated := deviceUpload(t, data, 1000)
+	truncated[2].Body = truncated[2].Body[:10]
+	unsupported := deviceUpload(t, data, 1000)
+	unsupported[3] = message{Name: "unknown", Body: mustMarshal(t, true)}
+
+	for _, test := range []struct {
+		name   string
+		msgs   []message
+		config func(u *fsim.UploadRequest)
+	}{
+		{name: "success", msgs: deviceUpload(t, data, 1000)},
+		{name: "digest mismatch", msgs: badDigest},
+		{name: "incomplete chunk", msgs: truncated},
+		{name: "unsupported message", msgs: unsupported},
+		{name: "max bytes", msgs: deviceUpload(t, data, 1000), config: func(u *fsim.UploadRequest) { u.MaxBytes = 100 }},
+		{name: "missing dir", msgs: deviceUpload(t, data, 1000), config: func(u *fsim.UploadRequest) { u.Dir = filepath.Join(u.Dir, "missing") }},
+		{name: "file exists", msgs: deviceUpload(t, data, 1000), config: func(u *fsim.UploadRequest) {
+			u.WriteMode = fsim.WriteFail
+			if err := os.WriteFile(filepath.Join(u.Dir, u.Name), nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "rejected", msgs: deviceUpload(t, data, 1000), config: func(u *fsim.UploadRequest) {
+			u.PreCommit = func(string, fsim.UploadMeta) error { return errors.New("rejected") }
+		}},
+		{name: "invalid compression", msgs: deviceUpload(t, data, 1000), config: func(u *fsim.UploadRequest) {
+			u.Compression = fsim.CompressionGzip
+		}},
+		{name: "write failure", msgs: deviceUpload(t, data, 1000), config: func(u *fsim.UploadRequest) {
+			// A temp file opened read-only fails on the first write
+			u.CreateTemp = func() (*os.File, error) {
+				f, err := os.CreateTemp(u.TempDir, "upload_*")
+				if err != nil {
+					return nil, err
+				}
+				_ = f.Close()
+				return os.Open(f.Name())
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			upload := func() error {
+				u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", TempDir: t.TempDir()}
+				if test.config != nil {
+					test.config(u)
+				}
+				err := runUpload(t.Context(), u, test.msgs)
+				if entries, _ := os.ReadDir(u.TempDir); len(entries) > 0 {
+					t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+				}
+				return err
+			}
+
+			// The first upload may cause the runtime to open files
+			_ = upload()
+			before := openFiles()
+			for range 10 {
+				if err := upload(); (err == nil) != (test.name == "success") {
+					t.Fatalf("unexpected result: %v", err)
+				}
+			}
+			if after := openFiles(); after > before {
+				t.Fatalf("%d files leaked by 10 uploads", after-before)
+			}
+		})
+	}
+}
+
+func TestUploadIdleTimeout(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	msgs := deviceUpload(t, data, 100)
+
+	t.Run("timeout", func(t *testing.T) {
+		tempDir := t.TempDir()
+		u := &fsim.UploadRequest{
+			Dir:         t.TempDir(),
+			Name:        "file.bin",
+			IdleTimeout: 50 * time.Millisecond,
+			CreateTemp: func() (*os.File, error) {
+				return os.CreateTemp(tempDir, "upload_*")
+			},
+		}
+
+		// Send all but the final data and digest messages
+		if err := runUpload(t.Context(), u, msgs[:3]); !errors.Is(err, errNotDone) {
+			t.Fatalf("expected upload to be incomplete, got %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); !errors.Is(err, fsim.ErrIdleTimeout) {
+			t.Fatalf("expected idle upload to time out, got %v", err)
+		}
+		if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+			t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		if err := runUpload(t.Context(), u, msgs[:3]); !errors.Is(err, errNotDone) {
+			t.Fatalf("expected upload to be incomplete, got %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+			t.Fatal(err)
+		}
+		if err := runUpload(t.Context(), u, msgs[3:]); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestUploadCreateTempFor(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	dir := t.TempDir()
+	var (
+		gotName string
+		gotSize int64
+	)
+	u := &fsim.UploadRequest{
+		Dir:  dir,
+		Name: "file.bin",
+		CreateTemp: func() (*os.File, error) {
+			t.Error("expected CreateTempFor to take precedence over CreateTemp")
+			return os.CreateTemp(t.TempDir(), "upload_*")
+		},
+		CreateTempFor: func(name string, size int64) (*os.File, error) {
+			gotName, gotSize = name, size
+			f, err := os.CreateTemp(dir, ".upload_*")
+			if err != nil {
+				return nil, err
+			}
+			if err := f.Truncate(size); err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+			return f, nil
+		},
+	}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if gotName != "file.bin" || gotSize != int64(len(data)) {
+		t.Fatalf("expected CreateTempFor(%q, %d), got (%q, %d)", "file.bin", len(data), gotName, gotSize)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file.bin" {
+		t.Fatalf("expected temp file to be renamed to file.bin, found %v", entries)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("upload contents did not match")
+	}
+}
+
+func TestUploadLength(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	t.Run("under length", func(t *testing.T) {
+		msgs := deviceUpload(t, data, 100)
+		msgs[1].Body = mustMarshal(t, int64(len(data)+1))
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrShortUpload) {
+			t.Fatalf("expected short upload to fail, got %v", err)
+		}
+	})
+
+	t.Run("allow short", func(t *testing.T) {
+		msgs := deviceUpload(t, data, 100)
+		msgs[1].Body = mustMarshal(t, int64(len(data)+1))
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", AllowShort: true}
+		if err := runUpload(t.Context(), u, msgs); err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := u.Result(); result.Size != int64(len(data)) {
+			t.Fatalf("expected %d bytes, got %d", len(data), result.Size)
+		}
+	})
+
+	t.Run("over length", func(t *testing.T) {
+		msgs := deviceUpload(t, data, 100)
+		msgs[1].Body = mustMarshal(t, int64(len(data)-1))
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrLengthExceeded) {
+			t.Fatalf("expected long upload to fail, got %v", err)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		sum := sha512.Sum384(nil)
+		active := message{Name: "active", Body: mustMarshal(t, true)}
+		length := message{Name: "length", Body: mustMarshal(t, 0)}
+		empty := message{Name: "data", Body: mustMarshal(t, []byte{})}
+		digest := message{Name: "sha-384", Body: mustMarshal(t, sum[:])}
+		for name, msgs := range map[string][]message{
+			"no data":      deviceUpload(t, nil, 100),
+			"empty chunk":  {active, length, empty, digest},
+			"digest first": {active, digest, length},
+			"no length":    {active, empty, digest},
+		} {
+			dir := t.TempDir()
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+			if err := runUpload(t.Context(), u, msgs); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			path := filepath.Join(dir, "file.bin")
+			if info, err := os.Stat(path); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			} else if info.Size() != 0 {
+				t.Fatalf("%s: expected empty file, got %d bytes", name, info.Size())
+			}
+			if err := fsim.VerifyFile(path, sum[:]); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if result, _ := u.Result(); result.Size != 0 {
+				t.Fatalf("%s: expected result size 0, got %d", name, result.Size)
+			}
+		}
+	})
+
+	t.Run("empty from device", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+		device := &fsim.Upload{FS: fstest.MapFS{"file.bin": &fstest.MapFile{}}}
+		if err := fsimtest.RunExchange(t.Context(), "fdo.upload", u, device); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha512.Sum384(nil)
+		if err := fsim.VerifyFile(filepath.Join(dir, "file.bin"), sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestVerifyFile(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	dir := t.TempDir()
+	if err := runUpload(t.Context(), &fsim.UploadRequest{Dir: dir, Name: "file.bin"}, deviceUpload(t, data, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "file.bin")
+	sha384Sum, sha256Sum := sha512.Sum384(data), sha256.Sum256(data)
+	otherSum := sha512.Sum384([]byte("Goodbye World!\n"))
+
+	t.Run("match", func(t *testing.T) {
+		for _, digest := range [][]byte{sha384Sum[:], sha256Sum[:]} {
+			if err := fsim.VerifyFile(path, digest); err != nil {
+				t.Errorf("expected %d byte digest to match, got %v", len(digest), err)
+			}
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		if err := fsim.VerifyFile(path, otherSum[:]); !errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("invalid digest length", func(t *testing.T) {
+		err := fsim.VerifyFile(path, sha384Sum[:20])
+		if err == nil || errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected invalid digest length error, got %v", err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if err := fsim.VerifyFile(filepath.Join(dir, "missing"), sha384Sum[:]); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected file not found, got %v", err)
+		}
+	})
+}
+
+func TestUploadReceipt(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	sum := sha512.Sum384(data)
+
+	dir := t.TempDir()
+	start := time.Now()
+	u := &fsim.UploadRequest{
+		Dir:          dir,
+		Name:         "file.bin",
+		WriteReceipt: true,
+	}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "file.bin.receipt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receipt fsim.UploadReceipt
+	if err := json.Unmarshal(b, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	result, _ := u.Result()
+	if receipt.Name != "file.bin" || receipt.Path != result.Path || receipt.Size != int64(len(data)) {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	if receipt.DigestAlg != "sha-384" || receipt.Digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected receipt digest: %s %s", receipt.DigestAlg, receipt.Digest)
+	}
+	if receipt.Completed.Before(start.Add(-time.Second)) || receipt.Completed.After(time.Now().Add(time.Second)) {
+		t.Errorf("unexpected receipt completion time: %s", receipt.Completed)
+	}
+	if result.ReceiptErr != nil {
+		t.Errorf("unexpected receipt error: %v", result.ReceiptErr)
+	}
+
+	// A receipt which cannot be written does not fail the placed upload
+	dir = t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "file.bin.receipt.json"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	u = &fsim.UploadRequest{Dir: dir, Name: "file.bin", WriteReceipt: true}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+		t.Fatalf("expected upload to succeed without a receipt, got %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file does not match (err %v)", err)
+	}
+	if result, ok := u.Result(); !ok || result.ReceiptErr == nil {
+		t.Fatalf("expected receipt error to be reported, got %+v", result)
+	}
+}
+
+func TestUploadReceiptBackup(t *testing.T) {
+	readReceipt := func(t *testing.T, dir string) fsim.UploadReceipt {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(dir, "file.bin.receipt.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var receipt fsim.UploadReceipt
+		if err := json.Unmarshal(b, &receipt); err != nil {
+			t.Fatal(err)
+		}
+		return receipt
+	}
+	upload := func(t *testing.T, u *fsim.UploadRequest, data []byte) error {
+		t.Helper()
+		u.Reset()
+		return runUpload(t.Context(), u, deviceUpload(t, data, 100))
+	}
+
+	t.Run("backup", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", MaxBackups: -1, WriteReceipt: true}
+
+		// Nothing is replaced by the first upload
+		v1 := bytes.Repeat([]byte("v1\n"), 1000)
+		if err := upload(t, u, v1); err != nil {
+			t.Fatal(err)
+		}
+		if receipt := readReceipt(t, dir); receipt.Backup != "" || receipt.BackupSHA384 != "" {
+			t.Fatalf("expected no backup in receipt, got %q %q", receipt.Backup, receipt.BackupSHA384)
+		}
+
+		if err := upload(t, u, []byte("v2\n")); err != nil {
+			t.Fatal(err)
+		}
+		receipt := readReceipt(t, dir)
+		sum := sha512.Sum384(v1)
+		if receipt.BackupSHA384 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("expected receipt to record the digest of the replaced file, got %q", receipt.BackupSHA384)
+		}
+		if receipt.Backup == "" {
+			t.Fatal("expected receipt to name the backup")
+		}
+		if err := fsim.VerifyFile(filepath.Join(dir, receipt.Backup), sum[:]); err != nil {
+			t.Fatalf("expected backup to match the recorded digest: %v", err)
+		}
+	})
+
+	t.Run("without backup", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file.bin"), []byte("v1"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", WriteReceipt: true}
+		if err := upload(t, u, []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+		if receipt := readReceipt(t, dir); receipt.Backup != "" || receipt.BackupSHA384 != "" {
+			t.Fatalf("expected no backup in receipt, got %q %q", receipt.Backup, receipt.BackupSHA384)
+		}
+	})
+
+	t.Run("unreadable dest", func(t *testing.T) {
+		dest := memDest{fstest.MapFS{"file.bin": &fstest.MapFile{Data: []byte("v1"), Mode: 0o600}}}
+		u := &fsim.UploadRequest{Dest: dest, Name: "file.bin", MaxBackups: -1, WriteReceipt: true}
+		if err := upload(t, u, []byte("v2")); err == nil || !strings.Contains(err.Error(), "cannot be read") {
+			t.Fatalf("expected unreadable destination to be an error, got %v", err)
+		}
+		if got := string(dest.MapFS["file.bin"].Data); got != "v1" || len(dest.MapFS) != 1 {
+			t.Fatalf("expected destination to be unchanged, got %q and %d files", got, len(dest.MapFS))
+		}
+	})
+}
+
+func TestUploadSymlinkDestination(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	original := []byte("outside contents\n")
+
+	for _, maxBackups := range []int{0, 1} {
+		t.Run(fmt.Sprintf("max backups %d", maxBackups), func(t *testing.T) {
+			outside := filepath.Join(t.TempDir(), "target")
+			if err := os.WriteFile(outside, original, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			if err := os.Symlink(outside, filepath.Join(dir, "file.bin")); err != nil {
+				t.Skipf("symlinks not supported: %v", err)
+			}
+
+			for _, tempDir := range []string{dir, t.TempDir()} {
+				u := &fsim.UploadRequest{
+					Dir:        dir,
+					Name:       "file.bin",
+					MaxBackups: maxBackups,
+					CreateTemp: func() (*os.File, error) {
+						return os.CreateTemp(tempDir, ".upload_*")
+					},
+				}
+				if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); !errors.Is(err, fsim.ErrPathTraversal) {
+					t.Fatalf("expected symlink destination to be rejected, got %v", err)
+				}
+			}
+
+			if got, err := os.ReadFile(outside); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got, original) {
+				t.Fatal("symlink target was modified")
+			}
+			if info, err := os.Lstat(filepath.Join(dir, "file.bin")); err != nil {
+				t.Fatal(err)
+			} else if info.Mode()&os.ModeSymlink == 0 {
+				t.Fatal("expected symlink to be left in place")
+			}
+		})
+	}
+}
+
+func TestUploadTempDir(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	dir := t.TempDir()
+
+	// Capture the temp file while the upload is in progress
+	var temp os.FileInfo
+	u := &fsim.UploadRequest{
+		Dir:     dir,
+		Name:    "file.bin",
+		TempDir: dir,
+		OnProgress: func(name string, written, total int64) {
+			if temp != nil || written == total {
+				return
+			}
+			matches, err := filepath.Glob(filepath.Join(dir, "fdo.upload_*"))
+			if err != nil || len(matches) != 1 {
+				t.Fatalf("expected one temp file in Dir, got %v (err=%v)", matches, err)
+			}
+			if temp, err = os.Stat(matches[0]); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if temp == nil || !os.SameFile(temp, info) {
+		t.Fatal("expected temp file to be renamed into place")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected only the uploaded file in Dir, found %d entries", len(entries))
+	}
+}
+
+func TestUploadPredictableTemp(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	t.Run("success", func(t *testing.T) {
+		dir := t.TempDir()
+		var found bool
+		u := &fsim.UploadRequest{Dir: dir, Name: "path/to/file.bin", PredictableTemp: true}
+		u.OnProgress = func(string, int64, int64) {
+			_, err := os.Stat(u.TempPath())
+			found = found || err == nil
+		}
+		if expect := filepath.Join(dir, ".fdo.upload.path%2Fto%2Ffile.bin.partial"); u.TempPath() != expect {
+			t.Fatalf("expected temp path %q, got %q", expect, u.TempPath())
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Fatal("expected temp file at predictable path during upload")
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+	})
+
+	t.Run("stale temp file", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, PredictableTemp: true}
+		if err := os.WriteFile(u.TempPath(), []byte("left by a crash"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+		if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+			t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+		}
+	})
+
+	t.Run("concurrent names", func(t *testing.T) {
+		// Interleave two uploads of files with the same base name
+		dir := t.TempDir()
+		a := &fsim.UploadRequest{Dir: dir, Name: "a/file.bin", Rename: "a.bin", PredictableTemp: true}
+		b := &fsim.UploadRequest{Dir: dir, Name: "b/file.bin", Rename: "b.bin", PredictableTemp: true}
+		if a.TempPath() == b.TempPath() {
+			t.Fatalf("expected distinct temp paths, got %q", a.TempPath())
+		}
+		other := bytes.Repeat([]byte("Goodbye World!\n"), 256)
+		msgsA, msgsB := deviceUpload(t, data, 100), deviceUpload(t, other, 100)
+		for _, u := range []*fsim.UploadRequest{a, b} {
+			if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range max(len(msgsA), len(msgsB)) {
+			for _, run := range []struct {
+				u    *fsim.UploadRequest
+				msgs []message
+			}{{a, msgsA}, {b, msgsB}} {
+				if i >= len(run.msgs) {
+					continue
+				}
+				if err := run.u.HandleInfo(t.Context(), run.msgs[i].Name, bytes.NewReader(run.msgs[i].Body)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for name, expect := range map[string][]byte{"a.bin": data, "b.bin": other} {
+			if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(got, expect) {
+				t.Errorf("expected %s to be uploaded intact (err=%v)", name, err)
+			}
+		}
+	})
+}
+
+func assertOnlyUpload(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != name {
+		t.Fatalf("expected only %s in %s, found %v", name, dir, entries)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("%s does not match uploaded data", name)
+	}
+}
+
+func TestUploadMetadata(t *testing.T) {
+	u := &fsim.UploadRequest{
+		Name: "file.bin",
+		Metadata: map[string]any{
+			"content-type": "application/octet-stream",
+			"attempt":      2,
+			"Labels":       []string{"a", "b"},
+		},
+	}
+	producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+	if _, _, err := u.ProduceInfo(t.Context(), producer); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, kv := range producer.ServiceInfo() {
+		keys = append(keys, kv.Key)
+	}
+	expect := []string{
+		"fdo.upload:active",
+		"fdo.upload:need-sha",
+		"fdo.upload:name",
+		"fdo.upload:Labels",
+		"fdo.upload:attempt",
+		"fdo.upload:content-type",
+	}
+	if !slices.Equal(keys, expect) {
+		t.Fatalf("expected messages %v, got %v", expect, keys)
+	}
+	if got := producer.ServiceInfo()[5].Val; !bytes.Equal(got, mustMarshal(t, "application/octet-stream")) {
+		t.Fatalf("unexpected content-type body %x", got)
+	}
+
+	for _, key := range []string{"", "name", "sha-384", "a:b", "invalid\xff"} {
+		u := &fsim.UploadRequest{Name: "file.bin", Metadata: map[string]any{key: true}}
+		if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err == nil {
+			t.Errorf("expected metadata key %q to be rejected", key)
+		}
+	}
+	u = &fsim.UploadRequest{Name: "file.bin", Metadata: map[string]any{"ch": make(chan int)}}
+	if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err == nil {
+		t.Error("expected unmarshalable metadata value to be rejected")
+	}
+
+	// The request must be sent in a single round
+	u = &fsim.UploadRequest{Name: "file.bin", Metadata: map[string]any{"a": make([]byte, 1000), "b": make([]byte, 1000)}}
+	_, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU))
+	if tooLarge := (serviceinfo.ErrChunkTooLarge{}); !errors.As(err, &tooLarge) {
+		t.Errorf("expected metadata exceeding the MTU to be rejected, got %v", err)
+	}
+}
+
+func TestUploadDigestFirst(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	msgs := deviceUpload(t, data, 100)
+
+	// Move the digest before the data
+	digest := msgs[len(msgs)-1]
+	msgs = slices.Insert(msgs[:len(msgs)-1], 2, digest)
+
+	dir := t.TempDir()
+	u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+	if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range msgs {
+		if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+			t.Fatal(err)
+		}
+		// The upload completes as soon as the last data is handled
+		if _, ok := u.Result(); ok != (i == len(msgs)-1) {
+			t.Fatalf("after message %d of %d: expected completed=%t", i+1, len(msgs), !ok)
+		}
+	}
+	if _, done, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+		t.Fatal(err)
+	} else if !done {
+		t.Fatal("expected module to be done")
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("upload contents did not match")
+	}
+}
+
+func TestUploadWithoutLength(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	msgs := deviceUpload(t, data, 100)
+	active, length, chunks, digest := msgs[0], msgs[1], msgs[2:len(msgs)-1], msgs[len(msgs)-1]
+	end := message{Name: "data", Body: mustMarshal(t, []byte{})}
+	longer := message{Name: "length", Body: mustMarshal(t, int64(len(data)+1))}
+
+	concat := func(parts ...any) (out []message) {
+		for _, part := range parts {
+			switch part := part.(type) {
+			case message:
+				out = append(out, part)
+			case []message:
+				out = append(out, part...)
+			}
+		}
+		return out
+	}
+	for _, test := range []struct {
+		name   string
+		msgs   []message
+		expect error
+	}{
+		{name: "no length", msgs: concat(active, chunks, digest)},
+		{name: "length after data", msgs: concat(active, chunks, length, digest)},
+		{name: "digest first and length last", msgs: concat(active, digest, chunks, length)},
+		{name: "digest first and end of data", msgs: concat(active, digest, chunks, end)},
+		{name: "digest first without end of data", msgs: concat(active, digest, chunks), expect: errNotDone},
+		{name: "short after data", msgs: concat(active, chunks, longer, digest), expect: fsim.ErrShortUpload},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: t.TempDir()}
+			if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+				t.Fatal(err)
+			}
+			for i, msg := range test.msgs[:len(test.msgs)-1] {
+				if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+					t.Fatalf("message %d: %v", i+1, err)
+				}
+				if _, ok := u.Result(); ok {
+					t.Fatalf("after message %d of %d: expected upload to be incomplete", i+1, len(test.msgs))
+				}
+			}
+
+			err := runUpload(t.Context(), u, test.msgs[len(test.msgs)-1:])
+			if test.expect != nil {
+				if !errors.Is(err, test.expect) {
+					t.Fatalf("expected %v, got %v", test.expect, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("uploaded file does not match (err %v)", err)
+			}
+		})
+	}
+}
+
+func TestUploadCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 1024)
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// zstd is not implemented by the standard library, so zlib stands in to
+	// exercise NewDecompressor
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	newDecompressor := func(compression string, r io.Reader) (io.ReadCloser, error) {
+		if compression != fsim.CompressionZstd {
+			return nil, fmt.Errorf("unexpected compression %q", compression)
+		}
+		return zlib.NewReader(r)
+	}
+
+	for _, test := range []struct {
+		name            string
+		compression     string
+		compressed      []byte
+		newDecompressor func(string, io.Reader) (io.ReadCloser, error)
+	}{
+		{name: "gzip", compression: fsim.CompressionGzip, compressed: gzipped.Bytes()},
+		{name: "zstd", compression: fsim.CompressionZstd, compressed: zlibbed.Bytes(), newDecompressor: newDecompressor},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			u := &fsim.UploadRequest{
+				Dir:             dir,
+				Name:            "file.bin",
+				Compression:     test.compression,
+				NewDecompressor: test.newDecompressor,
+			}
+			if err := runUpload(t.Context(), u, deviceUpload(t, test.compressed, 100)); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("decompressed contents did not match")
+			}
+			if result, _ := u.Result(); result.Size != int64(len(data)) {
+				t.Fatalf("expected decompressed size %d, got %d", len(data), result.Size)
+			}
+		})
+	}
+
+	t.Run("zstd without decompressor", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", Compression: fsim.CompressionZstd}
+		if err := runUpload(t.Context(), u, deviceUpload(t, zlibbed.Bytes(), 100)); err == nil {
+			t.Fatal("expected zstd to require NewDecompressor")
+		}
+	})
+
+	t.Run("decompressed exceeds max", func(t *testing.T) {
+		u := &fsim.UploadRequest{
+			Dir:         t.TempDir(),
+			Name:        "file.bin",
+			Compression: fsim.CompressionGzip,
+			MaxBytes:    int64(len(data)) - 1,
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, gzipped.Bytes(), 100)); !errors.Is(err, fsim.ErrLengthExceeded) {
+			t.Fatalf("expected decompressed size to exceed max, got %v", err)
+		}
+	})
+}
+
+func TestUploadMaxBytesPerSecond(t *testing.T) {
+	const rate = 10_000
+	data := bytes.Repeat([]byte("Hello World!\n"), 2*rate/13) // ~2s of data
+
+	t.Run("throttled", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", MaxBytesPerSecond: rate}
+		start := time.Now()
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		// The first second of data is a burst
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Fatalf("expected upload to be throttled, took %s", elapsed)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", MaxBytesPerSecond: 1}
+		start := time.Now()
+		if err := runUpload(ctx, u, deviceUpload(t, data, 1000)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected throttled upload to be canceled, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("expected cancellation to interrupt throttling, took %s", elapsed)
+		}
+	})
+}
+
+func TestUploadBackupNamer(t *testing.T) {
+	upload := func(dir string, namer func(string, os.FileInfo) (string, error), data []byte) error {
+		return runUpload(t.Context(), &fsim.UploadRequest{
+			Dir:         dir,
+			Name:        "file.bin",
+			BackupNamer: namer,
+			CreateTemp: func() (*os.File, error) {
+				return os.CreateTemp(dir, ".fdo.upload_*")
+			},
+		}, deviceUpload(t, data, 100))
+	}
+	readFile := func(t *testing.T, path string) string {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		dir := t.TempDir()
+		var gotInfo os.FileInfo
+		namer := func(name string, info os.FileInfo) (string, error) {
+			gotInfo = info
+			return filepath.Join(".backups", name+".bak"), nil
+		}
+		if err := upload(dir, namer, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := upload(dir, namer, []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, filepath.Join(dir, "file.bin")); got != "v2" {
+			t.Fatalf("expected file.bin to contain v2, got %q", got)
+		}
+		if got := readFile(t, filepath.Join(dir, ".backups", "file.bin.bak")); got != "v1" {
+			t.Fatalf("expected backup to contain v1, got %q", got)
+		}
+		if gotInfo == nil || gotInfo.Size() != 2 {
+			t.Fatalf("expected namer to receive info of replaced file, got %v", gotInfo)
+		}
+
+		// A backup which already exists is not overwritten
+		if err := upload(dir, namer, []byte("v3")); err == nil {
+			t.Fatal("expected existing backup name to be rejected")
+		}
+		if got := readFile(t, filepath.Join(dir, ".backups", "file.bin.bak")); got != "v1" {
+			t.Fatalf("expected backup to contain v1, got %q", got)
+		}
+	})
+
+	t.Run("delete on empty", func(t *testing.T) {
+		dir := t.TempDir()
+		namer := func(string, os.FileInfo) (string, error) { return "", nil }
+		if err := upload(dir, namer, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := upload(dir, namer, []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || readFile(t, filepath.Join(dir, "file.bin")) != "v2" {
+			t.Fatalf("expected only the new file, found %v", entries)
+		}
+	})
+
+	t.Run("escape", func(t *testing.T) {
+		dir := t.TempDir()
+		namer := func(name string, _ os.FileInfo) (string, error) { return "../" + name, nil }
+		if err := upload(dir, namer, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := upload(dir, namer, []byte("v2")); !errors.Is(err, fsim.ErrPathTraversal) {
+			t.Fatalf("expected escaping backup name to be rejected, got %v", err)
+		}
+		if got := readFile(t, filepath.Join(dir, "file.bin")); got != "v1" {
+			t.Fatalf("expected file.bin to be unchanged, got %q", got)
+		}
+	})
+}
+
+func TestUploadMaxDuration(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 20)
+	tempDir := t.TempDir()
+
+	// Each tiny chunk is handled well within any idle timeout
+	u := &fsim.UploadRequest{
+		Dir:         t.TempDir(),
+		Name:        "file.bin",
+		IdleTimeout: time.Second,
+		MaxDuration: 50 * time.Millisecond,
+		CreateTemp: func() (*os.File, error) {
+			return os.CreateTemp(tempDir, "upload_*")
+		},
+		OnProgress: func(string, int64, int64) { time.Sleep(time.Millisecond) },
+	}
+	err := runUpload(t.Context(), u, deviceUpload(t, data, 1))
+	if !errors.Is(err, fsim.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline to be exceeded, got %v", err)
+	}
+	if errors.Is(err, fsim.ErrIdleTimeout) {
+		t.Fatal("expected deadline to be distinguished from idle timeout")
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+		t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+	}
+
+	// The deadline does not apply before the upload is requested
+	u = &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", TempDir: t.TempDir(), MaxDuration: time.Hour}
+	if err := u.HandleInfo(t.Context(), "data", bytes.NewReader(mustMarshal(t, data))); errors.Is(err, fsim.ErrDeadlineExceeded) {
+		t.Fatalf("expected no deadline before the upload was requested, got %v", err)
+	}
+}
+
+func TestUploadDigestTimeout(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 20)
+	const timeout = 20 * time.Millisecond
+	withheld := deviceUpload(t, data, 100)
+	withheld = withheld[:len(withheld)-1]
+
+	produce := func(t *testing.T, u *fsim.UploadRequest) (bool, error) {
+		t.Helper()
+		_, done, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU))
+		return done, err
+	}
+	start := func(t *testing.T, u *fsim.UploadRequest, msgs []message) {
+		t.Helper()
+		if _, err := produce(t, u); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			if err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if done, err := produce(t, u); done || err != nil {
+			t.Fatalf("expected upload to wait for the digest, got done=%t, err=%v", done, err)
+		}
+	}
+
+	for name, msgs := range map[string][]message{
+		"length reached": withheld,
+		"empty chunk": {
+			{Name: "active", Body: mustMarshal(t, true)},
+			{Name: "data", Body: mustMarshal(t, data)},
+			{Name: "data", Body: mustMarshal(t, []byte{})},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			metrics := new(fsim.MemoryMetrics)
+			u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", TempDir: tempDir, DigestTimeout: timeout, Metrics: metrics}
+			start(t, u, msgs)
+			time.Sleep(2 * timeout)
+			_, err := produce(t, u)
+			if !errors.Is(err, fsim.ErrMissingDigest) || !strings.Contains(err.Error(), "sha-384") {
+				t.Fatalf("expected missing digest error, got %v", err)
+			}
+			if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+				t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+			}
+			if got := metrics.Failed(fsim.ErrMissingDigest.Error()); got != 1 {
+				t.Fatalf("expected 1 upload failed with a missing digest, got %d", got)
+			}
+		})
+	}
+
+	t.Run("incomplete data", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", DigestTimeout: timeout}
+		start(t, u, withheld[:3])
+		time.Sleep(2 * timeout)
+		if done, err := produce(t, u); done || err != nil {
+			t.Fatalf("expected upload to wait for data, got done=%t, err=%v", done, err)
+		}
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		busy := false
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", DigestTimeout: timeout,
+			Backpressure: func() bool { return busy }}
+		start(t, u, withheld)
+		busy = true
+		for range 4 {
+			time.Sleep(timeout / 2)
+			if _, err := produce(t, u); err != nil {
+				t.Fatalf("expected blocked device not to time out, got %v", err)
+			}
+		}
+		busy = false
+		if done, err := produce(t, u); done || err != nil {
+			t.Fatalf("expected upload to wait for the digest, got done=%t, err=%v", done, err)
+		}
+		sum := sha512.Sum384(data)
+		if err := u.HandleInfo(t.Context(), "sha-384", bytes.NewReader(mustMarshal(t, sum[:]))); err != nil {
+			t.Fatal(err)
+		}
+		if done, err := produce(t, u); !done || err != nil {
+			t.Fatalf("expected upload to complete, got done=%t, err=%v", done, err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", DigestTimeout: -1}
+		start(t, u, withheld)
+		time.Sleep(2 * timeout)
+		if done, err := produce(t, u); done || err != nil {
+			t.Fatalf("expected upload to wait for the digest, got done=%t, err=%v", done, err)
+		}
+	})
+}
+
+func TestUploadMinCipherStrength(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 20)
+	withCipher := func(id kex.CipherSuiteID) context.Context {
+		return context.WithValue(t.Context(), serviceinfo.CipherSuiteKey{}, id)
+	}
+
+	for _, test := range []struct {
+		name string
+		ctx  context.Context
+	}{
+		{name: "weak cipher", ctx: withCipher(kex.A128GcmCipher)},
+		{name: "weak encrypt-then-mac cipher", ctx: withCipher(kex.CoseAes128CtrCipher)},
+		{name: "unknown cipher", ctx: t.Context()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			metrics := new(fsim.MemoryMetrics)
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", MinCipherStrength: 256, Metrics: metrics}
+			producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+			_, _, err := u.ProduceInfo(test.ctx, producer)
+			if !errors.Is(err, fsim.ErrWeakCipher) {
+				t.Fatalf("expected weak cipher error, got %v", err)
+			}
+			if uerr := (*fsim.UploadError)(nil); !errors.As(err, &uerr) || uerr.Op != "request" {
+				t.Fatalf("expected request UploadError, got %#v", err)
+			}
+			if info := producer.ServiceInfo(); len(info) > 0 {
+				t.Fatalf("expected no upload to be requested, got %d service info", len(info))
+			}
+			if metrics.Started() != 0 {
+				t.Fatal("expected upload not to be started")
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Fatalf("expected no files, found %s", entries[0].Name())
+			}
+		})
+	}
+
+	t.Run("strong cipher", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", MinCipherStrength: 256}
+		if err := runUpload(withCipher(kex.A256GcmCipher), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+	})
+}
+
+func TestUploadShouldUpload(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 20)
+	linux := serviceinfo.Devmod{
+		Os:      "Linux",
+		Arch:    "X86_64",
+		Version: "Ubuntu 22.04.4 LTS",
+		Device:  "edge-gateway",
+		FileSep: ":",
+		Bin:     "x86:X86_64",
+	}
+	windows := serviceinfo.Devmod{
+		Os:      "Windows",
+		Arch:    "AMD64",
+		Version: "10.0.22631",
+		Device:  "kiosk",
+		PathSep: `\`,
+		FileSep: ";",
+		Bin:     "AMD64",
+	}
+	arm := serviceinfo.Devmod{
+		Os:      "Linux",
+		Arch:    "aarch64",
+		Version: "Debian 12",
+		Device:  "edge-gateway",
+		FileSep: ":",
+		Bin:     "aarch64",
+	}
+	withDevmod := func(devmod serviceinfo.Devmod) context.Context {
+		return context.WithValue(t.Context(), serviceinfo.DevmodKey{}, devmod)
+	}
+	// Upload journal logs only from x86 Linux gateways
+	shouldUpload := func(devmod serviceinfo.Devmod) bool {
+		return devmod.Os == "Linux" && devmod.Device == "edge-gateway" &&
+			slices.Contains(strings.Split(devmod.Bin, devmod.FileSep), "X86_64")
+	}
+
+	t.Run("applies", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", ShouldUpload: shouldUpload}
+		if err := runUpload(withDevmod(linux), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyUpload(t, dir, "file.bin", data)
+		if result, ok := u.Result(); !ok || result.Skipped {
+			t.Fatalf("expected upload not to be skipped, got %+v", result)
+		}
+	})
+
+	for _, test := range []struct {
+		name   string
+		devmod serviceinfo.Devmod
+	}{
+		{name: "other os", devmod: windows},
+		{name: "other arch", devmod: arm},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			metrics := new(fsim.MemoryMetrics)
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", ShouldUpload: shouldUpload, Metrics: metrics}
+			producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+			_, done, err := u.ProduceInfo(withDevmod(test.devmod), producer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !done {
+				t.Fatal("expected skipped upload to complete")
+			}
+			if info := producer.ServiceInfo(); len(info) > 0 {
+				t.Fatalf("expected no upload to be requested, got %d service info", len(info))
+			}
+			if result, ok := u.Result(); !ok || !result.Skipped {
+				t.Fatalf("expected skipped result, got %+v (ok=%t)", result, ok)
+			}
+			if metrics.Started() != 0 {
+				t.Fatal("expected upload not to be started")
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Fatalf("expected no files, found %s", entries[0].Name())
+			}
+		})
+	}
+
+	t.Run("unknown devmod", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", ShouldUpload: shouldUpload}
+		producer := serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)
+		if _, _, err := u.ProduceInfo(t.Context(), producer); err == nil || !strings.Contains(err.Error(), "devmod") {
+			t.Fatalf("expected unknown devmod error, got %v", err)
+		}
+		if info := producer.ServiceInfo(); len(info) > 0 {
+			t.Fatalf("expected no upload to be requested, got %d service info", len(info))
+		}
+	})
+}
+
+func TestUploadInactive(t *testing.T) {
+	declined := []message{{Name: "active", Body: mustMarshal(t, false)}}
+
+	t.Run("allowed", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		metrics := new(fsim.MemoryMetrics)
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, AllowInactive: true, Metrics: metrics}
+		if err := runUpload(t.Context(), u, declined); err != nil {
+			t.Fatalf("expected declined upload to complete, got %v", err)
+		}
+		blockPeer, done, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU))
+		if err != nil || blockPeer || !done {
+			t.Fatalf("expected module to be done, got blockPeer=%t, done=%t, err=%v", blockPeer, done, err)
+		}
+		if result, ok := u.Result(); !ok || !result.Skipped {
+			t.Fatalf("expected skipped result, got %+v (ok=%t)", result, ok)
+		}
+		for _, d := range []string{dir, tempDir} {
+			if entries, _ := os.ReadDir(d); len(entries) > 0 {
+				t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+			}
+		}
+		if succeeded, failed := metrics.Succeeded(), metrics.Failed(fsim.ErrModuleInactive.Error()); succeeded != 0 || failed != 0 {
+			t.Fatalf("expected declined upload not to be counted, got %d succeeded and %d failed", succeeded, failed)
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		metrics := new(fsim.MemoryMetrics)
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", Metrics: metrics}
+		err := runUpload(t.Context(), u, declined)
+		if !errors.Is(err, fsim.ErrModuleInactive) {
+			t.Fatalf("expected ErrModuleInactive, got %v", err)
+		}
+		if _, ok := u.Result(); ok {
+			t.Fatal("expected no result for a failed upload")
+		}
+		if got := metrics.Failed(fsim.ErrModuleInactive.Error()); got != 1 {
+			t.Fatalf("expected 1 upload failed as inactive, got %d", got)
+		}
+	})
+
+	for name, module := range map[string]serviceinfo.OwnerModule{
+		"command":  &fsim.RunCommand{},
+		"download": &fsim.DownloadContents[*bytes.Reader]{},
+		"wget":     &fsim.WgetCommand{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := module.HandleInfo(t.Context(), "active", bytes.NewReader(mustMarshal(t, false))); !errors.Is(err, fsim.ErrModuleInactive) {
+				t.Fatalf("expected ErrModuleInactive, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadWriteMode(t *testing.T) {
+	upload := func(dir string, mode fsim.WriteMode, overwrite fsim.OverwritePolicy, maxBackups int, data []byte) error {
+		return runUpload(t.Context(), &fsim.UploadRequest{
+			Dir:        dir,
+			Name:       "file.log",
+			WriteMode:  mode,
+			Overwrite:  overwrite,
+			MaxBackups: maxBackups,
+		}, deviceUpload(t, data, 4))
+	}
+	for _, test := range []struct {
+		name       string
+		mode       fsim.WriteMode
+		overwrite  fsim.OverwritePolicy
+		maxBackups int
+		expect     string
+		entries    int
+		err        error
+	}{
+		{name: "replace", mode: fsim.WriteReplace, expect: "second\n", entries: 1},
+		{name: "replace with backup", mode: fsim.WriteReplace, maxBackups: 1, expect: "second\n", entries: 2},
+		{name: "replace with backup policy", mode: fsim.WriteReplace, overwrite: fsim.OverwriteBackup, expect: "second\n", entries: 2},
+		{name: "replace denied", mode: fsim.WriteReplace, overwrite: fsim.OverwriteDeny, expect: "first\n", entries: 1, err: fsim.ErrFileExists},
+		{name: "append", mode: fsim.WriteAppend, expect: "first\nsecond\n", entries: 1},
+		{name: "append denied", mode: fsim.WriteAppend, overwrite: fsim.OverwriteDeny, expect: "first\n", entries: 1, err: fsim.ErrFileExists},
+		{name: "fail", mode: fsim.WriteFail, expect: "first\n", entries: 1, err: fsim.ErrFileExists},
+		{name: "fail with backups", mode: fsim.WriteFail, maxBackups: 1, expect: "first\n", entries: 1, err: fsim.ErrFileExists},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// The first upload creates the file in every mode
+			if err := upload(dir, test.mode, test.overwrite, test.maxBackups, []byte("first\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := upload(dir, test.mode, test.overwrite, test.maxBackups, []byte("second\n")); !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "file.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.expect {
+				t.Fatalf("expected %q, got %q", test.expect, got)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != test.entries {
+				t.Fatalf("expected %d entries in Dir, found %d", test.entries, len(entries))
+			}
+		})
+	}
+}
+
+func TestUploadIndefiniteLengthData(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	sum := sha512.Sum384(data)
+
+	// Send all data as one indefinite length byte string of 100 byte chunks,
+	// followed by a definite length chunk in the same message
+	body := []byte{0x5f}
+	rest := data[:len(data)-100]
+	for len(rest) > 0 {
+		n := min(100, len(rest))
+		body = append(body, mustMarshal(t, rest[:n])...)
+		rest = rest[n:]
+	}
+	body = append(body, 0xff)
+	body = append(body, mustMarshal(t, data[len(data)-100:])...)
+
+	dir := t.TempDir()
+	u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+	if err := runUpload(t.Context(), u, []message{
+		{Name: "active", Body: mustMarshal(t, true)},
+		{Name: "length", Body: mustMarshal(t, int64(len(data)))},
+		{Name: "data", Body: body},
+		{Name: "sha-384", Body: mustMarshal(t, sum[:])},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("uploaded file does not match")
+	}
+}
+
+func TestUploadStrictEncoding(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	sum := sha512.Sum384(data)
+
+	for _, test := range []struct {
+		name    string
+		message int
+		body    []byte
+	}{
+		{name: "non-minimal length", message: 1, body: []byte{0x1a, 0x00, 0x00, 0x0d, 0x00}},
+		{name: "length with trailing data", message: 1, body: append(mustMarshal(t, int64(len(data))), 0x00)},
+		{name: "non-minimal digest length", message: -1, body: append([]byte{0x59, 0x00, 0x30}, sum[:]...)},
+		{name: "digest with trailing data", message: -1, body: append(mustMarshal(t, sum[:]), 0x00)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			msgs := deviceUpload(t, data, 1000)
+			if test.message < 0 {
+				test.message += len(msgs)
+			}
+			msgs[test.message].Body = test.body
+			dir := t.TempDir()
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+			if err := runUpload(t.Context(), u, msgs); err == nil {
+				t.Fatal("expected error")
+			}
+			if entries, err := os.ReadDir(dir); err != nil {
+				t.Fatal(err)
+			} else if len(entries) > 0 {
+				t.Fatalf("expected no files, got %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestUploadMessageOrder(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	sum := sha512.Sum384(data)
+	badSum := sha512.Sum384(nil)
+	active := message{Name: "active", Body: mustMarshal(t, true)}
+	length := message{Name: "length", Body: mustMarshal(t, int64(len(data)))}
+	head := message{Name: "data", Body: mustMarshal(t, data[:1000])}
+	tail := message{Name: "data", Body: mustMarshal(t, data[1000:])}
+	empty := message{Name: "data", Body: mustMarshal(t, []byte{})}
+	digest := message{Name: "sha-384", Body: mustMarshal(t, sum[:])}
+
+	for _, test := range []struct {
+		name     string
+		msgs     []message
+		expect   error
+		contains string
+	}{
+		{name: "length between data", msgs: []message{active, head, length, tail, digest}},
+		{name: "repeated length", msgs: []message{active, length, head, length, tail, length, digest}},
+		{name: "repeated digest", msgs: []message{active, digest, length, head, digest, tail}},
+		{name: "length after end of data", msgs: []message{active, head, tail, empty, length, digest}},
+		{
+			name:   "changed length",
+			msgs:   []message{active, length, head, {Name: "length", Body: mustMarshal(t, int64(len(data)+10))}, tail, digest},
+			expect: fsim.ErrUnexpectedMessage,
+		},
+		{
+			name:     "negative length",
+			msgs:     []message{active, {Name: "length", Body: mustMarshal(t, -1)}, head, tail, digest},
+			contains: "invalid length",
+		},
+		{
+			name:   "changed digest",
+			msgs:   []message{active, {Name: "sha-384", Body: mustMarshal(t, badSum[:])}, length, head, digest, tail},
+			expect: fsim.ErrUnexpectedMessage,
+		},
+		{name: "data after end", msgs: []message{active, head, empty, tail, digest}, expect: fsim.ErrUnexpectedMessage},
+		{name: "data after digest", msgs: []message{active, head, tail, digest, empty}, expect: fsim.ErrUnexpectedMessage},
+		{name: "length after digest", msgs: []message{active, head, tail, digest, length}, expect: fsim.ErrUnexpectedMessage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+			err := runUpload(t.Context(), u, test.msgs)
+			switch {
+			case test.expect != nil:
+				if !errors.Is(err, test.expect) {
+					t.Fatalf("expected %v, got %v", test.expect, err)
+				}
+			case test.contains != "":
+				if err == nil || !strings.Contains(err.Error(), test.contains) {
+					t.Fatalf("expected error containing %q, got %v", test.contains, err)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertOnlyUpload(t, dir, "file.bin", data)
+			}
+		})
+	}
+}
+
+func TestUploadChunkDigest(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 400)
+
+	// chunkedUpload returns the messages of an upload in 1000 byte chunks,
+	// with each chunk preceded by its digest when withDigest returns true
+	chunkedUpload := func(t *testing.T, hashAlg protocol.HashAlg, withDigest func(i int) bool, corrupt int) []message {
+		digestName, h := "sha-384", sha512.New384()
+		if hashAlg == protocol.Sha256Hash {
+			digestName, h = "sha-256", sha256.New()
+		}
+		msgs := []message{
+			{Name: "active", Body: mustMarshal(t, true)},
+			{Name: "length", Body: mustMarshal(t, int64(len(data)))},
+		}
+		for i := 0; i*1000 < len(data); i++ {
+			chunk := bytes.Clone(data[i*1000 : min((i+1)*1000, len(data))])
+			if withDigest(i) {
+				h.Reset()
+				_, _ = h.Write(chunk)
+				msgs = append(msgs, message{Name: "chunk-" + digestName, Body: mustMarshal(t, h.Sum(nil))})
+			}
+			if i == corrupt {
+				chunk[0] ^= 0xff
+			}
+			msgs = append(msgs, message{Name: "data", Body: mustMarshal(t, chunk)})
+		}
+		h.Reset()
+		_, _ = h.Write(data)
+		return append(msgs, message{Name: digestName, Body: mustMarshal(t, h.Sum(nil))})
+	}
+	all := func(int) bool { return true }
+
+	for _, test := range []struct {
+		name       string
+		hashAlg    protocol.HashAlg
+		withDigest func(int) bool
+	}{
+		{name: "every chunk", withDigest: all},
+		{name: "some chunks", withDigest: func(i int) bool { return i%2 == 1 }},
+		{name: "no chunks", withDigest: func(int) bool { return false }},
+		{name: "sha-256", hashAlg: protocol.Sha256Hash, withDigest: all},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", HashAlg: test.hashAlg}
+			if err := runUpload(t.Context(), u, chunkedUpload(t, test.hashAlg, test.withDigest, -1)); err != nil {
+				t.Fatal(err)
+			}
+			assertOnlyUpload(t, dir, "file.bin", data)
+		})
+	}
+
+	t.Run("corrupted middle chunk", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir}
+		msgs := chunkedUpload(t, 0, all, 2)
+		if _, _, err := u.ProduceInfo(t.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+			t.Fatal(err)
+		}
+		for i, msg := range msgs {
+			err := u.HandleInfo(t.Context(), msg.Name, bytes.NewReader(msg.Body))
+			if err == nil {
+				continue
+			}
+			// active, length, then a digest and data message per chunk
+			if expect := 2 + 2*2 + 1; i != expect {
+				t.Fatalf("expected failure at message %d, failed at %d: %v", expect, i, err)
+			}
+			if !errors.Is(err, fsim.ErrSHAMismatch) || !strings.Contains(err.Error(), "offset 2000") {
+				t.Fatalf("expected digest mismatch at offset 2000, got %v", err)
+			}
+			for _, d := range []string{dir, tempDir} {
+				if entries, _ := os.ReadDir(d); len(entries) > 0 {
+					t.Fatalf("expected no files in %s, found %s", d, entries[0].Name())
+				}
+			}
+			return
+		}
+		t.Fatal("expected corrupted chunk to fail the upload")
+	})
+
+	t.Run("corrupted chunk without digest", func(t *testing.T) {
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		msgs := chunkedUpload(t, 0, func(i int) bool { return i != 2 }, 2)
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrSHAMismatch) || strings.Contains(err.Error(), "offset") {
+			t.Fatalf("expected whole file digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("digest without data", func(t *testing.T) {
+		msgs := chunkedUpload(t, 0, all, -1)
+		last := msgs[len(msgs)-1]
+		msgs = append(msgs[:len(msgs)-1], msgs[len(msgs)-3], last)
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrUnexpectedMessage) {
+			t.Fatalf("expected unexpected message error, got %v", err)
+		}
+	})
+
+	t.Run("consecutive digests", func(t *testing.T) {
+		msgs := chunkedUpload(t, 0, all, -1)
+		msgs = slices.Insert(msgs, 2, msgs[2])
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin"}
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrUnexpectedMessage) {
+			t.Fatalf("expected unexpected message error, got %v", err)
+		}
+	})
+}
+
+func TestUploadReset(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"first.bin":  bytes.Repeat([]byte("Hello World!\n"), 256),
+		"second.bin": bytes.Repeat([]byte("Goodbye World!\n"), 100),
+	}
+
+	u := &fsim.UploadRequest{Dir: dir}
+	for _, name := range []string{"first.bin", "second.bin"} {
+		u.Reset()
+		if _, ok := u.Result(); ok {
+			t.Fatal("expected no result after reset")
+		}
+		u.Name = name
+		if err := runUpload(t.Context(), u, deviceUpload(t, files[name], 1000)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		result, ok := u.Result()
+		if !ok || result.Size != int64(len(files[name])) || filepath.Base(result.Path) != name {
+			t.Fatalf("%s: unexpected result %+v (ok=%t)", name, result, ok)
+		}
+	}
+
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("contents of %q did not match", name)
+		}
+	}
+
+	t.Run("interrupted", func(t *testing.T) {
+		data := files["first.bin"]
+		msgs := deviceUpload(t, data, 1000)
+		u := &fsim.UploadRequest{Dir: t.TempDir(), Name: "file.bin", TempDir: t.TempDir()}
+		if err := runUpload(t.Context(), u, msgs[:len(msgs)-2]); !errors.Is(err, errNotDone) {
+			t.Fatalf("expected incomplete upload, got %v", err)
+		}
+
+		// The partial upload is discarded and the next upload starts over
+		u.Reset()
+		if entries, _ := os.ReadDir(u.TempDir); len(entries) > 0 {
+			t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+		}
+		if err := runUpload(t.Context(), u, msgs); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(u.Dir, "file.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("contents did not match")
+		}
+	})
+}
+
+func TestUploadName(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	msgs := deviceUpload(t, data, 1000)
+	withName := func(name string) []message {
+		return slices.Insert(slices.Clone(msgs), 1, message{Name: "name", Body: mustMarshal(t, name)})
+	}
+
+	t.Run("echoed", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+		if err := runUpload(t.Context(), u, withName("file.bin")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "file.bin")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin"}
+		if err := runUpload(t.Context(), u, withName("other.bin")); !errors.Is(err, fsim.ErrNameMismatch) {
+			t.Fatalf("expected name mismatch, got %v", err)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+			t.Fatalf("expected no files in dir, found %s", entries[0].Name())
+		}
+	})
+}
+
+func TestUploadPreCommit(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	sum := sha512.Sum384(data)
+
+	t.Run("accept", func(t *testing.T) {
+		dir := t.TempDir()
+		var got fsim.UploadMeta
+		u := &fsim.UploadRequest{
+			Dir:    dir,
+			Name:   "path/to/file.bin",
+			Rename: "renamed.bin",
+			PreCommit: func(tempPath string, meta fsim.UploadMeta) error {
+				got = meta
+				contents, err := os.ReadFile(tempPath)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(contents, data) {
+					t.Error("temp file contents did not match")
+				}
+				if _, err := os.Stat(filepath.Join(dir, "renamed.bin")); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("expected destination not to exist before commit, got %v", err)
+				}
+				return nil
+			},
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		expect := fsim.UploadMeta{
+			Name:      "path/to/file.bin",
+			Rename:    "renamed.bin",
+			Length:    int64(len(data)),
+			DigestAlg: "sha-384",
+			Digest:    sum[:],
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expected meta %+v, got %+v", expect, got)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "renamed.bin")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		errInfected := errors.New("infected")
+		u := &fsim.UploadRequest{
+			Dir:       dir,
+			Name:      "file.bin",
+			TempDir:   tempDir,
+			PreCommit: func(string, fsim.UploadMeta) error { return errInfected },
+		}
+		err := runUpload(t.Context(), u, deviceUpload(t, data, 1000))
+		if !errors.Is(err, fsim.ErrRejected) || !errors.Is(err, errInfected) {
+			t.Fatalf("expected rejection, got %v", err)
+		}
+		for _, d := range []string{dir, tempDir} {
+			if entries, _ := os.ReadDir(d); len(entries) > 0 {
+				t.Fatalf("expected %s to be empty, found %s", d, entries[0].Name())
+			}
+		}
+	})
+}
+
+func TestUploadChunkBoundaries(t *testing.T) {
+	// Lines of varying length, so that chunks split lines at varying offsets
+	var data []byte
+	for i := range 300 {
+		data = fmt.Appendf(data, "%d: %s\n", i, strings.Repeat("x", i%17))
+	}
+
+	// Chunk sizes around byte string header size boundaries
+	for _, chunkSize := range []int{1, 7, 23, 24, 255, 256, 1014} {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.txt"}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, chunkSize)); err != nil {
+			t.Fatalf("chunk size %d: %v", chunkSize, err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("chunk size %d: contents did not match", chunkSize)
+		}
+	}
+}
+
+func TestUploadDryRun(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	newDirs := func(t *testing.T) (dir, tempDir string) {
+		dir, tempDir = t.TempDir(), t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file.bin"), []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return dir, tempDir
+	}
+	assertUnchanged := func(t *testing.T, dir, tempDir string) {
+		t.Helper()
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Fatalf("expected only the existing file in dir, found %d entries", len(entries))
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "file.bin")); err != nil || string(got) != "old" {
+			t.Fatalf("expected existing file to be unchanged, got %q (err %v)", got, err)
+		}
+		if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+			t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		dir, tempDir := newDirs(t)
+		u := &fsim.UploadRequest{
+			Dir:          dir,
+			Name:         "file.bin",
+			TempDir:      tempDir,
+			MaxBackups:   -1,
+			WriteReceipt: true,
+			DryRun:       true,
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		assertUnchanged(t, dir, tempDir)
+		result, ok := u.Result()
+		expect := fsim.UploadResult{Path: filepath.Join(dir, "file.bin"), Size: int64(len(data))}
+		if !ok || result != expect {
+			t.Fatalf("expected result %+v, got %+v (ok=%t)", expect, result, ok)
+		}
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		dir, tempDir := newDirs(t)
+		msgs := deviceUpload(t, data, 1000)
+		msgs[len(msgs)-1].Body = mustMarshal(t, make([]byte, sha512.Size384))
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, DryRun: true}
+		if err := runUpload(t.Context(), u, msgs); !errors.Is(err, fsim.ErrSHAMismatch) {
+			t.Fatalf("expected digest mismatch, got %v", err)
+		}
+	})
+
+	t.Run("file exists", func(t *testing.T) {
+		dir, tempDir := newDirs(t)
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, WriteMode: fsim.WriteFail, DryRun: true}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); !errors.Is(err, fsim.ErrFileExists) {
+			t.Fatalf("expected file exists error, got %v", err)
+		}
+		assertUnchanged(t, dir, tempDir)
+	})
+}
+
+func BenchmarkUploadData(b *testing.B) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 1<<20/13)
+	sum := sha512.Sum384(data)
+	var chunks [][]byte
+	for rest := data; len(rest) > 0; {
+		n := min(1014, len(rest))
+		chunk, err := cbor.Marshal(rest[:n])
+		if err != nil {
+			b.Fatal(err)
+		}
+		chunks, rest = append(chunks, chunk), rest[n:]
+	}
+	lengthBody, err := cbor.Marshal(int64(len(data)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	sumBody, err := cbor.Marshal(sum[:])
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dir := b.TempDir()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: dir, MaxBackups: -1}
+		if _, _, err := u.ProduceInfo(b.Context(), serviceinfo.NewProducer("fdo.upload", serviceinfo.DefaultMTU)); err != nil {
+			b.Fatal(err)
+		}
+		if err := u.HandleInfo(b.Context(), "length", bytes.NewReader(lengthBody)); err != nil {
+			b.Fatal(err)
+		}
+		for _, chunk := range chunks {
+			if err := u.HandleInfo(b.Context(), "data", bytes.NewReader(chunk)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := u.HandleInfo(b.Context(), "sha-384", bytes.NewReader(sumBody)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// recordHandler captures the messages of log records.
+type recordHandler struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, r.Message)
+	return nil
+}
+
+func TestUploadTempRemoval(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		u      func(dir, tempDir string) *fsim.UploadRequest
+		upload []byte
+	}{
+		{name: "rename", upload: data, u: func(dir, _ string) *fsim.UploadRequest {
+			return &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: dir}
+		}},
+		{name: "copy", upload: data, u: func(_, tempDir string) *fsim.UploadRequest {
+			return &fsim.UploadRequest{Dest: memDest{fstest.MapFS{}}, Name: "file.bin", TempDir: tempDir}
+		}},
+		{name: "decompress", upload: gzipped.Bytes(), u: func(dir, tempDir string) *fsim.UploadRequest {
+			return &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, Compression: fsim.CompressionGzip}
+		}},
+		{name: "dry run", upload: data, u: func(dir, tempDir string) *fsim.UploadRequest {
+			return &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir, DryRun: true}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, tempDir := t.TempDir(), t.TempDir()
+			var h recordHandler
+			u := test.u(dir, tempDir)
+			u.Logger = slog.New(&h)
+			if err := runUpload(t.Context(), u, deviceUpload(t, test.upload, 1000)); err != nil {
+				t.Fatal(err)
+			}
+			if slices.Contains(h.messages, "error removing temp file") {
+				t.Fatalf("expected no temp file removal error, got log messages %q", h.messages)
+			}
+			if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+				t.Fatalf("expected temp dir to be empty, found %s", entries[0].Name())
+			}
+		})
+	}
+
+	t.Run("removal fails", func(t *testing.T) {
+		var h recordHandler
+		u := &fsim.UploadRequest{
+			Dir:     t.TempDir(),
+			Name:    "file.bin",
+			TempDir: t.TempDir(),
+			Logger:  slog.New(&h),
+			// Replace the temp file with a non-empty directory, which cannot
+			// be removed
+			PreCommit: func(tempPath string, _ fsim.UploadMeta) error {
+				if err := os.Remove(tempPath); err != nil {
+					return err
+				}
+				if err := os.MkdirAll(filepath.Join(tempPath, "busy"), 0o700); err != nil {
+					return err
+				}
+				return errors.New("rejected")
+			},
+		}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); !errors.Is(err, fsim.ErrRejected) {
+			t.Fatalf("expected rejected upload, got %v", err)
+		}
+		if !slices.Contains(h.messages, "error removing temp file") {
+			t.Fatalf("expected temp file removal error to be logged, got log messages %q", h.messages)
+		}
+	})
+}
+
+func TestUploadLogger(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.bin"), []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var h recordHandler
+	u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: dir, MaxBackups: -1, Logger: slog.New(&h)}
+	if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"request sent",
+		"length received",
+		"receiving data",
+		"digest verified",
+		"backup created",
+		"placing file",
+		"upload complete",
+	}
+	if !slices.Equal(h.messages, expect) {
+		t.Fatalf("expected log messages %q, got %q", expect, h.messages)
+	}
+}
@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build unix
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// stat is replaced in tests to simulate a stalled filesystem.
+var stat = syscall.Stat
+
+// sameFilesystem reports whether both paths are on the same device, such that
+// a rename between them will succeed. An error is only returned if ctx is done
+// before both paths have been stat'd.
+func sameFilesystem(ctx context.Context, path1, path2 string) (bool, error) {
+	var stat1, stat2 syscall.Stat_t
+	err := statContext(ctx, func() error {
+		if err := stat(path1, &stat1); err != nil {
+			return err
+		}
+		return stat(path2, &stat2)
+	})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return false, ctxErr
+	}
+	return err == nil && stat1.Dev == stat2.Dev, nil
+}
+
+// syncDir flushes the directory entries of dir within root to stable storage.
+func syncDir(root *os.Root, dir string) error {
+	f, err := root.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// preserveOwner applies the owner and group of an existing file using chown.
+// Errors are ignored, as changing ownership requires privileges.
+func preserveOwner(info os.FileInfo, chown func(uid, gid int) error) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		_ = chown(int(stat.Uid), int(stat.Gid))
+	}
+}
+
+// chownFile changes the owner and group of an open file.
+func chownFile(f *os.File, uid, gid int) error { return f.Chown(uid, gid) }
+
+// isDiskFull reports whether err is caused by a filesystem being out of space
+// or quota.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build unix
+
+package fsim
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPlaceStalledStat(t *testing.T) {
+	// Simulate a hung filesystem, cancelling once a stat is in flight
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	stat = func(path string, st *syscall.Stat_t) error {
+		cancel()
+		<-release
+		return syscall.Stat(path, st)
+	}
+	defer func() { stat = syscall.Stat }()
+
+	original := []byte("original contents")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), original, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tempPath := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(tempPath, []byte("new contents"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &UploadRequest{Dir: dir, Rename: "file.txt", MaxBackups: 1, dest: "file.txt"}
+	if err := u.place(ctx, tempPath); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	assertOnlyFile(t, dir, "file.txt", original)
+}
@@ -0,0 +1,202 @@
+// SPDX-FileCopyrightText: (C) 2024 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+//go:build unix
+
+package fsim_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/fsim"
+)
+
+func TestUploadOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	for name, tempDir := range map[string]string{"temp in dir": "dir", "default temp dir": ""} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tempDir == "dir" {
+				tempDir = dir
+			}
+			u := &fsim.UploadRequest{
+				Dir:     dir,
+				Name:    "file.bin",
+				TempDir: tempDir,
+				Owner:   &fsim.FileOwner{UID: 1234, GID: -1},
+			}
+			if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(filepath.Join(dir, "file.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stat := info.Sys().(*syscall.Stat_t)
+			if stat.Uid != 1234 || stat.Gid != uint32(os.Getegid()) {
+				t.Fatalf("expected owner 1234:%d, got %d:%d", os.Getegid(), stat.Uid, stat.Gid)
+			}
+		})
+	}
+}
+
+type errWriter struct{ err error }
+
+func (w errWriter) Write([]byte) (int, error) { return 0, w.err }
+func (w errWriter) Close() error              { return nil }
+
+func TestUploadWriteError(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+	for _, test := range []struct {
+		err  error
+		kind error
+	}{
+		{err: syscall.ENOSPC, kind: fsim.ErrDiskFull},
+		{err: syscall.EDQUOT, kind: fsim.ErrDiskFull},
+		{err: &os.PathError{Op: "write", Path: "file", Err: syscall.ENOSPC}, kind: fsim.ErrDiskFull},
+		{err: syscall.EIO, kind: fsim.ErrIO},
+		{err: os.ErrClosed, kind: fsim.ErrIO},
+	} {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			u := &fsim.UploadRequest{
+				Name: "file.bin",
+				Sink: func(string) (io.WriteCloser, error) { return errWriter{test.err}, nil },
+			}
+			err := runUpload(t.Context(), u, deviceUpload(t, data, 1000))
+			if !errors.Is(err, test.kind) || !errors.Is(err, test.err) {
+				t.Fatalf("expected error of kind %v wrapping %v, got %v", test.kind, test.err, err)
+			}
+			if test.kind == fsim.ErrDiskFull && errors.Is(err, fsim.ErrIO) {
+				t.Fatalf("expected disk full error not to be an i/o error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadMethod(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 256)
+
+	t.Run("rename", func(t *testing.T) {
+		dir := t.TempDir()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: dir}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := u.Result(); result.Method != "rename" {
+			t.Fatalf("expected co-located temp file to be renamed, got %q", result.Method)
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		// Find a directory on a different device than the default temp dir
+		tempDir := t.TempDir()
+		var tempStat, stat syscall.Stat_t
+		if err := syscall.Stat(tempDir, &tempStat); err != nil {
+			t.Fatal(err)
+		}
+		var dir string
+		for _, candidate := range []string{"/dev/shm", "/var/tmp", os.Getenv("HOME")} {
+			if candidate == "" || syscall.Stat(candidate, &stat) != nil || stat.Dev == tempStat.Dev {
+				continue
+			}
+			var err error
+			if dir, err = os.MkdirTemp(candidate, "fdo.upload_test_"); err == nil {
+				t.Cleanup(func() { _ = os.RemoveAll(dir) })
+				break
+			}
+		}
+		if dir == "" {
+			t.Skip("no writable directory found on a different device than " + tempDir)
+		}
+
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", TempDir: tempDir}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if result, _ := u.Result(); result.Method != "copy" {
+			t.Fatalf("expected temp file on another device to be copied, got %q", result.Method)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "file.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("uploaded file does not match")
+		}
+	})
+}
+
+func TestUploadNamedPipe(t *testing.T) {
+	data := bytes.Repeat([]byte("Hello World!\n"), 4096)
+
+	t.Run("stream", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		fifo := filepath.Join(dir, "stream.fifo")
+		if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+			t.Skipf("named pipes not supported: %v", err)
+		}
+		received := make(chan []byte, 1)
+		go func() {
+			f, err := os.Open(fifo)
+			if err != nil {
+				t.Error(err)
+				received <- nil
+				return
+			}
+			defer func() { _ = f.Close() }()
+			got, err := io.ReadAll(f)
+			if err != nil {
+				t.Error(err)
+			}
+			received <- got
+		}()
+
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", Rename: "stream.fifo", TempDir: tempDir, MaxBackups: -1}
+		if err := runUpload(t.Context(), u, deviceUpload(t, data, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; !bytes.Equal(got, data) {
+			t.Fatalf("expected %d bytes from the pipe, got %d", len(data), len(got))
+		}
+		if result, _ := u.Result(); result.Method != "stream" {
+			t.Fatalf("expected stream method, got %q", result.Method)
+		}
+		if info, err := os.Lstat(fifo); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			t.Fatalf("expected named pipe to be left in place (err %v)", err)
+		}
+		for d, expect := range map[string]int{dir: 1, tempDir: 0} {
+			if entries, _ := os.ReadDir(d); len(entries) != expect {
+				t.Fatalf("expected %d entries in %s, found %d", expect, d, len(entries))
+			}
+		}
+	})
+
+	t.Run("no reader", func(t *testing.T) {
+		dir, tempDir := t.TempDir(), t.TempDir()
+		if err := syscall.Mkfifo(filepath.Join(dir, "stream.fifo"), 0o600); err != nil {
+			t.Skipf("named pipes not supported: %v", err)
+		}
+		ctx, cancel := context.WithCancel(t.Context())
+		defer cancel()
+		u := &fsim.UploadRequest{Dir: dir, Name: "file.bin", Rename: "stream.fifo", TempDir: tempDir,
+			PreCommit: func(string, fsim.UploadMeta) error { cancel(); return nil }}
+		if err := runUpload(ctx, u, deviceUpload(t, data, 1000)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected open of unread pipe to be abandoned, got %v", err)
+		}
+		if entries, _ := os.ReadDir(tempDir); len(entries) > 0 {
+			t.Fatalf("expected temp file to be removed, found %s", entries[0].Name())
+		}
+	})
+}
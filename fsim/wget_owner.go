@@ -4,7 +4,9 @@
 package fsim
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha512"
 	"fmt"
 	"io"
 	"net/url"
@@ -27,16 +29,24 @@ type WgetCommand struct {
 	// Optional size of download contents in bytes to ensure device receives
 	Length int64
 
-	// Optional SHA-384 of contents
+	// Optional SHA-384 of contents. The device verifies the contents against
+	// it and, if the device also reports the SHA-384 of the downloaded
+	// contents, the reported digest must match or the module fails with an
+	// error wrapping ErrSHAMismatch.
 	Checksum []byte
 
 	// Internal state
-	sent bool
-	done bool
+	sent   bool
+	done   bool
+	digest []byte
 }
 
 var _ serviceinfo.OwnerModule = (*WgetCommand)(nil)
 
+// Digest returns the SHA-384 of the downloaded contents, if the device
+// reported it. The fdo.wget spec does not require devices to do so.
+func (w *WgetCommand) Digest() []byte { return w.digest }
+
 // HandleInfo implements serviceinfo.OwnerModule.
 func (w *WgetCommand) HandleInfo(ctx context.Context, messageName string, messageBody io.Reader) error {
 	switch messageName {
@@ -46,7 +56,7 @@ func (w *WgetCommand) HandleInfo(ctx context.Context, messageName string, messag
 			return fmt.Errorf("error decoding message %s: %w", messageName, err)
 		}
 		if !deviceActive {
-			return fmt.Errorf("device service info module is not active")
+			return ErrModuleInactive
 		}
 		return nil
 
@@ -57,6 +67,22 @@ func (w *WgetCommand) HandleInfo(ctx context.Context, messageName string, messag
 		}
 		return fmt.Errorf("device reported error: %s", msg)
 
+	case "sha-384":
+		var digest []byte
+		if err := cbor.NewDecoder(messageBody).Decode(&digest); err != nil {
+			return fmt.Errorf("error decoding message %s: %w", messageName, err)
+		}
+		if len(digest) != sha512.Size384 {
+			return fmt.Errorf("invalid digest length for %s: got %d bytes, expected %d",
+				messageName, len(digest), sha512.Size384)
+		}
+		if len(w.Checksum) > 0 && !bytes.Equal(digest, w.Checksum) {
+			return fmt.Errorf("download of %q: %w: device reported %x, expected %x",
+				w.Name, ErrSHAMismatch, digest, w.Checksum)
+		}
+		w.digest = digest
+		return nil
+
 	case "done":
 		var n int64
 		if err := cbor.NewDecoder(messageBody).Decode(&n); err != nil {
@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package fsim_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/fsim"
+	"github.com/fido-device-onboard/go-fdo/fsim/fsimtest"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+// fakeWget simulates the device side of fdo.wget, reporting a fixed length
+// and, optionally, digest as soon as the URL is received.
+type fakeWget struct {
+	Length int64
+	Digest []byte
+
+	name     string
+	url      string
+	checksum []byte
+	fetched  bool
+}
+
+func (w *fakeWget) Transition(bool) error { return nil }
+
+func (w *fakeWget) Receive(_ context.Context, messageName string, messageBody io.Reader, _ func(string) io.Writer, _ func()) error {
+	dec := cbor.NewDecoder(messageBody)
+	switch messageName {
+	case "name":
+		return dec.Decode(&w.name)
+	case "sha-384":
+		return dec.Decode(&w.checksum)
+	case "url":
+		w.fetched = true
+		return dec.Decode(&w.url)
+	default:
+		return fmt.Errorf("unknown message %s", messageName)
+	}
+}
+
+func (w *fakeWget) Yield(_ context.Context, respond func(string) io.Writer, _ func()) error {
+	if !w.fetched {
+		return nil
+	}
+	w.fetched = false
+	if w.Digest != nil {
+		if err := cbor.NewEncoder(respond("sha-384")).Encode(w.Digest); err != nil {
+			return err
+		}
+	}
+	return cbor.NewEncoder(respond("done")).Encode(w.Length)
+}
+
+var _ serviceinfo.DeviceModule = (*fakeWget)(nil)
+
+func TestWgetCommandChecksum(t *testing.T) {
+	contents := []byte("Hello World!\n")
+	sum := sha512.Sum384(contents)
+	other := sha512.Sum384([]byte("Goodbye World!\n"))
+	u, err := url.Parse("https://example.com/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		checksum []byte
+		reported []byte
+		expect   error
+	}{
+		{name: "not reported", checksum: sum[:]},
+		{name: "match", checksum: sum[:], reported: sum[:]},
+		{name: "no checksum", reported: sum[:]},
+		{name: "mismatch", checksum: sum[:], reported: other[:], expect: fsim.ErrSHAMismatch},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			device := &fakeWget{Length: int64(len(contents)), Digest: test.reported}
+			owner := &fsim.WgetCommand{Name: "file.txt", URL: u, Checksum: test.checksum}
+
+			err := fsimtest.RunExchange(t.Context(), "fdo.wget", owner, device)
+			if test.expect != nil {
+				if !errors.Is(err, test.expect) {
+					t.Fatalf("expected %v, got %v", test.expect, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if device.name != owner.Name || device.url != u.String() || !bytes.Equal(device.checksum, test.checksum) {
+				t.Errorf("device received name %q, url %q, sha-384 %x", device.name, device.url, device.checksum)
+			}
+			if !bytes.Equal(owner.Digest(), test.reported) {
+				t.Errorf("expected digest %x, got %x", test.reported, owner.Digest())
+			}
+		})
+	}
+}
@@ -37,6 +37,10 @@ func (s SessionCrypter) String() string {
 	)
 }
 
+// CipherSuiteID returns the identifier of the cipher suite used to encrypt
+// the session.
+func (s SessionCrypter) CipherSuiteID() CipherSuiteID { return s.ID }
+
 // Encrypt uses a session key to encrypt a payload. Depending on the suite,
 // the result may be a plain COSE_Encrypt0 or one wrapped by COSE_Mac0.
 func (s SessionCrypter) Encrypt(rand io.Reader, payload any) (any, error) {
@@ -5,9 +5,23 @@ package serviceinfo
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
+// CipherSuiteKey is the context key for the kex.CipherSuiteID negotiated for
+// the TO2 session. It is set by the TO2 server for each call to an
+// OwnerModule, so that modules may enforce a minimum encryption strength.
+type CipherSuiteKey struct{}
+
+// DevmodKey is the context key for the Devmod reported by the device. It is
+// set by the TO2 server for each call to an OwnerModule once devmod has been
+// received, so that modules may decide whether they apply to the device.
+type DevmodKey struct{}
+
 // OwnerModule implements the owner service role for a service info module.
 type OwnerModule interface {
 	// HandleInfo is called once for each service info KV received from the
@@ -30,18 +44,44 @@ type OwnerModule interface {
 	//
 	// If `blockPeer` is true, the owner service will indicate
 	// IsMoreServiceInfo to keep the device from sending service info in the
-	// next exchange. If `moduleDone` is true, then IsMoreServiceInfo will not
-	// be set true, regardless of the value of `more`, and this module will no
-	// longer be used in the TO2 protocol.
+	// next exchange. ProduceInfo is then called again for the next exchange
+	// without any new service info from the device, so a module may apply
+	// backpressure by returning true until it is ready to handle more.
+	//
+	// If `moduleDone` is true, then IsMoreServiceInfo will not be set true,
+	// regardless of the value of `more`, and this module will no longer be
+	// used in the TO2 protocol.
 	ProduceInfo(ctx context.Context, producer *Producer) (blockPeer, moduleDone bool, _ error)
 }
 
+// ProgressReporter is an optional interface which may be implemented by
+// OwnerModules that transfer a known amount of data, such as file uploads.
+// A ModuleStateMachine may use it to schedule modules fairly, e.g. by
+// prioritizing modules which are nearly complete.
+type ProgressReporter interface {
+	// Progress returns the amount of work done and the total amount of work,
+	// in module-defined units such as bytes. If the total is not yet known,
+	// it is negative. Progress may be called at any time, including
+	// concurrently with HandleInfo and ProduceInfo.
+	Progress() (done, total int64)
+}
+
 // Producer allows an owner service info module to produce service info either
 // with auto-chunking (not yet implemented) or manually.
+//
+// A Producer is safe for concurrent use, so a module may write service info
+// from several goroutines during a single call to ProduceInfo. Each chunk is
+// checked against the remaining MTU and queued atomically, in the order that
+// writes are made. Writes from different goroutines are therefore interleaved
+// in an unspecified order, so messages which must be received in order should
+// be written by a single goroutine. All writes must complete before
+// ProduceInfo returns.
 type Producer struct {
 	moduleName string
 	mtu        uint16
-	info       []*KV
+
+	mu   sync.Mutex
+	info []*KV
 }
 
 // NewProducer creates a new producer instance for the given MTU.
@@ -57,18 +97,111 @@ func NewProducer(moduleName string, mtu uint16) *Producer {
 	}
 }
 
+// MTU returns the negotiated MTU that the producer was created with. Three
+// bytes of the MTU are reserved for the enclosing message, so the service info
+// produced in a single round is at most MTU()-3 bytes when encoded.
+func (p *Producer) MTU() uint16 { return p.mtu + 3 }
+
 // Available returns the remaining space available for a message body in bytes.
 // If the next service info will not fit in the remaining bytes, then the
 // module should return and on the next ProduceInfo the full MTU will be
 // available.
+//
+// The available space includes the byte string header (1-3 bytes for bodies
+// under 64KiB) which wraps the message body in the service info, so the
+// largest body a single WriteChunk can accept is Available minus the size of
+// that header. Because message bodies are already CBOR encoded, a module
+// streaming data as a CBOR byte string must subtract a second header, i.e. up
+// to 6 bytes, to find the largest chunk of data it can send in the round.
 func (p *Producer) Available(messageName string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.available(messageName)
+}
+
+func (p *Producer) available(messageName string) int {
 	return int(p.mtu) - int(ArraySizeCBOR(append(p.info, &KV{Key: p.moduleName + ":" + messageName}))) +
 		1 // 1 represents overcounting the size of the last KV, because the Val will be 1 byte
 }
 
+// MaxChunk returns the size of the largest message body that WriteChunk will
+// currently accept for the given message name. It is Available less the size
+// of the byte string header wrapping the message body. If no message body can
+// be written, MaxChunk returns a negative number.
+func (p *Producer) MaxChunk(messageName string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maxChunk(messageName)
+}
+
+func (p *Producer) maxChunk(messageName string) int {
+	available := p.available(messageName)
+	maxChunk := -1
+	// Byte string header sizes and the largest length each can encode
+	for _, header := range []struct{ size, maxLen int }{
+		{1, 23},
+		{2, 1<<8 - 1},
+		{3, 1<<16 - 1},
+		{5, 1<<32 - 1},
+	} {
+		maxChunk = max(maxChunk, min(available-header.size, header.maxLen))
+	}
+	return maxChunk
+}
+
+// ErrChunkTooLarge is returned by WriteChunk when a message body is larger
+// than the space remaining in the MTU.
+type ErrChunkTooLarge struct {
+	// Size of the message body
+	Size int
+	// Limit is the result of MaxChunk at the time of writing
+	Limit int
+}
+
+func (e ErrChunkTooLarge) Error() string {
+	return fmt.Sprintf("service info message body of %d bytes exceeds the %d bytes available", e.Size, e.Limit)
+}
+
+// ErrInvalidMessageName is returned by WriteChunk when a message name is not
+// a valid service info message name.
+//
+// A message name must be a non-empty UTF-8 string which does not contain
+// ':', which separates the module name from the message name in a service
+// info key.
+type ErrInvalidMessageName struct {
+	Name string
+}
+
+func (e ErrInvalidMessageName) Error() string {
+	return fmt.Sprintf("invalid service info message name %q", e.Name)
+}
+
+// ValidateMessageName returns ErrInvalidMessageName if name is not a valid
+// service info message name.
+func ValidateMessageName(name string) error {
+	if name == "" || strings.Contains(name, ":") || !utf8.ValidString(name) {
+		return ErrInvalidMessageName{Name: name}
+	}
+	return nil
+}
+
 // WriteChunk queues a single service info. If messageBody is larger than the
-// bytes available, WriteChunk will fail and no service info will be queued.
+// bytes available, WriteChunk will fail with ErrChunkTooLarge and no service
+// info will be queued. If messageName is not valid, it will fail with
+// ErrInvalidMessageName.
 func (p *Producer) WriteChunk(messageName string, messageBody []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writeChunk(messageName, messageBody)
+}
+
+func (p *Producer) writeChunk(messageName string, messageBody []byte) error {
+	if err := ValidateMessageName(messageName); err != nil {
+		return err
+	}
+	if limit := p.maxChunk(messageName); len(messageBody) > limit {
+		return ErrChunkTooLarge{Size: len(messageBody), Limit: max(limit, 0)}
+	}
 	p.info = append(p.info, &KV{
 		Key: p.moduleName + ":" + messageName,
 		Val: messageBody,
@@ -76,5 +209,72 @@ func (p *Producer) WriteChunk(messageName string, messageBody []byte) error {
 	return nil
 }
 
+// TryWriteChunk queues a single service info if messageBody fits in the bytes
+// available. Unlike WriteChunk, a message body which does not fit is not an
+// error. Instead, full is true and no service info is queued, so that a
+// module streaming many messages can fill each round without tracking the
+// remaining space itself.
+//
+// When full is true, the module should return from ProduceInfo and write the
+// same message body again on its next call, when the full MTU is available.
+// It must not report moduleDone in the same call, because the module will not
+// be called again and the unwritten message would be lost. Setting blockPeer
+// keeps the device from sending service info until the module has caught up.
+//
+// If nothing has been queued and the message body still does not fit, it can
+// never be sent, so ErrChunkTooLarge is returned.
+func (p *Producer) TryWriteChunk(messageName string, messageBody []byte) (full bool, _ error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := ValidateMessageName(messageName); err != nil {
+		return false, err
+	}
+	if limit := p.maxChunk(messageName); len(messageBody) > limit {
+		if len(p.info) == 0 {
+			return false, ErrChunkTooLarge{Size: len(messageBody), Limit: max(limit, 0)}
+		}
+		return true, nil
+	}
+	return false, p.writeChunk(messageName, messageBody)
+}
+
+// WriteChunks queues several service info in order, in a single pass. Each KV
+// holds a message name, rather than the full service info key, and its body.
+//
+// As many messages are queued as fit in the bytes available, stopping at the
+// first which does not fit, and n reports how many were queued. As with
+// TryWriteChunk, the module should return from ProduceInfo and write
+// messages[n:] on its next call.
+//
+// All message names are validated before any message is queued. If nothing
+// has been queued and the first message body still does not fit, it can never
+// be sent, so ErrChunkTooLarge is returned.
+func (p *Producer) WriteChunks(messages ...*KV) (n int, _ error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, kv := range messages {
+		if err := ValidateMessageName(kv.Key); err != nil {
+			return 0, err
+		}
+	}
+	for i, kv := range messages {
+		if limit := p.maxChunk(kv.Key); len(kv.Val) > limit {
+			if len(p.info) == 0 {
+				return 0, ErrChunkTooLarge{Size: len(kv.Val), Limit: max(limit, 0)}
+			}
+			return i, nil
+		}
+		p.info = append(p.info, &KV{
+			Key: p.moduleName + ":" + kv.Key,
+			Val: kv.Val,
+		})
+	}
+	return len(messages), nil
+}
+
 // ServiceInfo returns all ServiceInfo, guaranteed to fit within the MTU.
-func (p *Producer) ServiceInfo() []*KV { return p.info }
+func (p *Producer) ServiceInfo() []*KV {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info
+}
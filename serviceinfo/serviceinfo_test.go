@@ -5,6 +5,10 @@ package serviceinfo_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/fido-device-onboard/go-fdo/cbor"
@@ -46,3 +50,274 @@ func TestProducerAvailable(t *testing.T) {
 		t.Fatalf("expected available bytes < 0, got %d", available)
 	}
 }
+
+func TestProducerMTU(t *testing.T) {
+	const moduleName, messageName = "module", "message"
+	const mtu = 1300
+	producer := serviceinfo.NewProducer(moduleName, mtu)
+	if got := producer.MTU(); got != mtu {
+		t.Fatalf("expected MTU %d, got %d", mtu, got)
+	}
+
+	// A byte string chunk sized to the available bytes, less both byte string
+	// headers, fills the MTU exactly
+	chunk, err := cbor.Marshal(make([]byte, producer.Available(messageName)-6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.WriteChunk(messageName, chunk); err != nil {
+		t.Fatal(err)
+	}
+	if size := serviceinfo.ArraySizeCBOR(producer.ServiceInfo()); size != mtu-3 {
+		t.Fatalf("expected size to be equal to MTU=%d - 3 (message overhead), got %d", mtu, size)
+	}
+}
+
+func TestProducerChunkTooLarge(t *testing.T) {
+	const moduleName, messageName = "module", "message"
+	for _, mtu := range []uint16{64, 300, serviceinfo.DefaultMTU, 1<<16 - 1} {
+		producer := serviceinfo.NewProducer(moduleName, mtu)
+		limit := producer.MaxChunk(messageName)
+
+		err := producer.WriteChunk(messageName, make([]byte, limit+1))
+		var tooLarge serviceinfo.ErrChunkTooLarge
+		if !errors.As(err, &tooLarge) {
+			t.Fatalf("mtu=%d: expected ErrChunkTooLarge, got %v", mtu, err)
+		}
+		if tooLarge.Size != limit+1 || tooLarge.Limit != limit {
+			t.Fatalf("mtu=%d: unexpected error fields: %+v", mtu, tooLarge)
+		}
+		if len(producer.ServiceInfo()) != 0 {
+			t.Fatalf("mtu=%d: expected oversized chunk not to be queued", mtu)
+		}
+
+		if err := producer.WriteChunk(messageName, make([]byte, limit)); err != nil {
+			t.Fatalf("mtu=%d: %v", mtu, err)
+		}
+		if size := serviceinfo.ArraySizeCBOR(producer.ServiceInfo()); size > int64(mtu-3) {
+			t.Fatalf("mtu=%d: max chunk exceeded MTU with size %d", mtu, size)
+		}
+	}
+}
+
+func TestProducerTryWriteChunk(t *testing.T) {
+	const moduleName, messageName = "module", "message"
+	const mtu = serviceinfo.DefaultMTU
+	producer := serviceinfo.NewProducer(moduleName, mtu)
+
+	// Fill the round with fixed size chunks until the producer is full
+	chunk := make([]byte, 100)
+	var written int
+	for {
+		full, err := producer.TryWriteChunk(messageName, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full {
+			break
+		}
+		written++
+	}
+	if written == 0 || len(producer.ServiceInfo()) != written {
+		t.Fatalf("expected %d chunks to be queued, got %d", written, len(producer.ServiceInfo()))
+	}
+	if size := serviceinfo.ArraySizeCBOR(producer.ServiceInfo()); size > int64(mtu-3) {
+		t.Fatalf("chunks exceeded MTU with size %d", size)
+	}
+
+	// A smaller chunk may still fit in the remaining space
+	if limit := producer.MaxChunk(messageName); limit >= 0 {
+		if full, err := producer.TryWriteChunk(messageName, make([]byte, limit)); err != nil || full {
+			t.Fatalf("expected chunk of %d bytes to fit, got full=%t, err=%v", limit, full, err)
+		}
+	}
+
+	// The chunk fits again in the next round
+	producer = serviceinfo.NewProducer(moduleName, mtu)
+	if full, err := producer.TryWriteChunk(messageName, chunk); err != nil || full {
+		t.Fatalf("expected chunk to fit in empty producer, got full=%t, err=%v", full, err)
+	}
+
+	// A chunk which can never fit is an error
+	producer = serviceinfo.NewProducer(moduleName, mtu)
+	full, err := producer.TryWriteChunk(messageName, make([]byte, mtu))
+	var tooLarge serviceinfo.ErrChunkTooLarge
+	if full || !errors.As(err, &tooLarge) {
+		t.Fatalf("expected ErrChunkTooLarge, got full=%t, err=%v", full, err)
+	}
+}
+
+func TestProducerWriteChunks(t *testing.T) {
+	const moduleName = "module"
+	const mtu = serviceinfo.DefaultMTU
+
+	t.Run("batch", func(t *testing.T) {
+		producer := serviceinfo.NewProducer(moduleName, mtu)
+		n, err := producer.WriteChunks(
+			&serviceinfo.KV{Key: "active", Val: []byte{0xf5}},
+			&serviceinfo.KV{Key: "name", Val: []byte{0x61, 0x61}},
+			&serviceinfo.KV{Key: "flag", Val: []byte{0xf4}},
+		)
+		if err != nil || n != 3 {
+			t.Fatalf("expected 3 messages to be queued, got %d, %v", n, err)
+		}
+		var keys []string
+		for _, kv := range producer.ServiceInfo() {
+			keys = append(keys, kv.Key)
+		}
+		if got := strings.Join(keys, ","); got != "module:active,module:name,module:flag" {
+			t.Fatalf("unexpected service info keys %s", got)
+		}
+	})
+
+	t.Run("split at MTU", func(t *testing.T) {
+		var msgs []*serviceinfo.KV
+		for i := range 20 {
+			msgs = append(msgs, &serviceinfo.KV{Key: fmt.Sprintf("chunk%d", i), Val: make([]byte, 100)})
+		}
+		var rounds int
+		for len(msgs) > 0 {
+			producer := serviceinfo.NewProducer(moduleName, mtu)
+			n, err := producer.WriteChunks(msgs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				t.Fatal("expected progress in each round")
+			}
+			if size := serviceinfo.ArraySizeCBOR(producer.ServiceInfo()); size > int64(mtu-3) {
+				t.Fatalf("chunks exceeded MTU with size %d", size)
+			}
+			if n < len(msgs) && producer.MaxChunk(msgs[n].Key) >= len(msgs[n].Val) {
+				t.Fatalf("message %s was not queued, but fits", msgs[n].Key)
+			}
+			if got := producer.ServiceInfo()[0].Key; got != moduleName+":"+msgs[0].Key {
+				t.Fatalf("expected round to start with %s, got %s", msgs[0].Key, got)
+			}
+			msgs = msgs[n:]
+			rounds++
+		}
+		if rounds != 2 {
+			t.Fatalf("expected 2000 bytes to be sent in 2 rounds, took %d", rounds)
+		}
+	})
+
+	t.Run("exact fit", func(t *testing.T) {
+		producer := serviceinfo.NewProducer(moduleName, mtu)
+		if err := producer.WriteChunk("first", make([]byte, 500)); err != nil {
+			t.Fatal(err)
+		}
+		limit := producer.MaxChunk("last")
+		n, err := producer.WriteChunks(
+			&serviceinfo.KV{Key: "last", Val: make([]byte, limit)},
+			&serviceinfo.KV{Key: "extra", Val: nil},
+		)
+		if err != nil || n != 1 {
+			t.Fatalf("expected only the exactly fitting message to be queued, got %d, %v", n, err)
+		}
+		if size := serviceinfo.ArraySizeCBOR(producer.ServiceInfo()); size > int64(mtu-3) {
+			t.Fatalf("chunks exceeded MTU with size %d", size)
+		}
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		producer := serviceinfo.NewProducer(moduleName, mtu)
+		n, err := producer.WriteChunks(
+			&serviceinfo.KV{Key: "active", Val: []byte{0xf5}},
+			&serviceinfo.KV{Key: "module:name", Val: []byte{0xf5}},
+		)
+		var invalid serviceinfo.ErrInvalidMessageName
+		if n != 0 || !errors.As(err, &invalid) {
+			t.Fatalf("expected ErrInvalidMessageName, got %d, %v", n, err)
+		}
+		if len(producer.ServiceInfo()) > 0 {
+			t.Fatal("expected nothing to be queued")
+		}
+	})
+
+	t.Run("never fits", func(t *testing.T) {
+		producer := serviceinfo.NewProducer(moduleName, mtu)
+		n, err := producer.WriteChunks(&serviceinfo.KV{Key: "data", Val: make([]byte, mtu)})
+		var tooLarge serviceinfo.ErrChunkTooLarge
+		if n != 0 || !errors.As(err, &tooLarge) {
+			t.Fatalf("expected ErrChunkTooLarge, got %d, %v", n, err)
+		}
+	})
+}
+
+func TestProducerMessageName(t *testing.T) {
+	for _, name := range []string{
+		"active", "need-sha", "sha-384", "return_stdout", "nummodules", "a", "v1.2", "X",
+		"1st", "-name", ".name", "with space", "caf\u00e9", "slash/name", strings.Repeat("a", 1024),
+	} {
+		producer := serviceinfo.NewProducer("module", serviceinfo.DefaultMTU)
+		if err := producer.WriteChunk(name, []byte{0xf5}); err != nil {
+			t.Errorf("expected %q to be valid, got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{
+		"", "module:message", ":", "trailing:", "invalid\xff",
+	} {
+		producer := serviceinfo.NewProducer("module", serviceinfo.DefaultMTU)
+		var invalid serviceinfo.ErrInvalidMessageName
+		if err := producer.WriteChunk(name, []byte{0xf5}); !errors.As(err, &invalid) || invalid.Name != name {
+			t.Errorf("expected %q to be invalid, got %v", name, err)
+		}
+		if full, err := producer.TryWriteChunk(name, []byte{0xf5}); full || !errors.As(err, &invalid) {
+			t.Errorf("expected %q to be invalid when trying to write, got full=%t, err=%v", name, full, err)
+		}
+		if len(producer.ServiceInfo()) > 0 {
+			t.Errorf("expected nothing to be queued for %q", name)
+		}
+	}
+}
+
+func TestProducerConcurrentWrites(t *testing.T) {
+	const moduleName, writers = "module", 8
+	const mtu = 1<<16 - 1
+	producer := serviceinfo.NewProducer(moduleName, mtu)
+
+	// Each writer writes its chunks in order
+	const chunks = 50
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Go(func() {
+			messageName := fmt.Sprintf("writer%d", i)
+			for seq := range chunks {
+				body, err := cbor.Marshal(seq)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := producer.WriteChunk(messageName, append(body, make([]byte, 100)...)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if size := serviceinfo.ArraySizeCBOR(producer.ServiceInfo()); size > mtu-3 {
+		t.Fatalf("concurrent writes exceeded MTU with size %d", size)
+	}
+
+	// Chunks of each writer are queued in the order written
+	next := make(map[string]int)
+	for _, kv := range producer.ServiceInfo() {
+		var seq int
+		if err := cbor.NewDecoder(bytes.NewReader(kv.Val)).Decode(&seq); err != nil {
+			t.Fatal(err)
+		}
+		if seq != next[kv.Key] {
+			t.Fatalf("%s: expected chunk %d, got %d", kv.Key, next[kv.Key], seq)
+		}
+		next[kv.Key]++
+	}
+	for i := range writers {
+		if n := next[fmt.Sprintf("%s:writer%d", moduleName, i)]; n != chunks {
+			t.Fatalf("expected %d chunks from writer %d, got %d", chunks, i, n)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+)
+
+// ErrValueBufferFull is returned by ValueReader.HandleInfo when a chunk would
+// buffer more unread bytes than the limit given to NewValueReader.
+var ErrValueBufferFull = errors.New("value reader buffer full")
+
+// ValueReader reassembles a value which a peer sends in chunks, as CBOR byte
+// strings in any number of messages of the same name, such as fdo.upload:data,
+// into a single stream. An empty byte string ends the value.
+//
+// Messages are passed to HandleInfo as they are received and the value is
+// read with Read, which blocks until more of the value has been received, so
+// the value may be consumed by another goroutine as it arrives. Reads return
+// io.EOF once the value has ended and all of it has been read.
+//
+// At most the limit given to NewValueReader of unread bytes are buffered.
+// HandleInfo never blocks, because the peer cannot send more service info
+// until the module returns, so a chunk which does not fit fails with
+// ErrValueBufferFull instead.
+type ValueReader struct {
+	messageName string
+	maxBuffered int
+
+	mu    sync.Mutex
+	ready *sync.Cond
+	buf   bytes.Buffer
+	ended bool
+	err   error
+}
+
+// NewValueReader returns a ValueReader for the value sent in messages named
+// messageName, buffering at most maxBuffered unread bytes. If maxBuffered is
+// zero or negative, buffering is not limited.
+func NewValueReader(messageName string, maxBuffered int) *ValueReader {
+	r := &ValueReader{messageName: messageName, maxBuffered: maxBuffered}
+	r.ready = sync.NewCond(&r.mu)
+	return r
+}
+
+// HandleInfo appends the chunks of the value in messageBody, if messageName
+// is the name of the value, and reports whether it was. This allows it to be
+// called first from an OwnerModule or DeviceModule's message handler:
+//
+//	if ok, err := r.HandleInfo(messageName, messageBody); ok {
+//		return err
+//	}
+//
+// Chunks received after the value has ended are an error. If a chunk cannot
+// be decoded, the error is returned and also ends the value, so that Read
+// returns it.
+func (r *ValueReader) HandleInfo(messageName string, messageBody io.Reader) (ok bool, _ error) {
+	if messageName != r.messageName {
+		return false, nil
+	}
+	dec := cbor.NewDecoder(messageBody)
+	for {
+		var chunk []byte
+		if err := dec.Decode(&chunk); errors.Is(err, io.EOF) {
+			return true, nil
+		} else if err != nil {
+			err = fmt.Errorf("error decoding %s chunk: %w", r.messageName, err)
+			_ = r.CloseWithError(err)
+			return true, err
+		}
+		if err := r.write(chunk); err != nil {
+			return true, err
+		}
+	}
+}
+
+func (r *ValueReader) write(chunk []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	if r.ended {
+		return fmt.Errorf("%s chunk received after the end of the value", r.messageName)
+	}
+	if len(chunk) == 0 {
+		r.ended = true
+		r.ready.Broadcast()
+		return nil
+	}
+	if r.maxBuffered > 0 && r.buf.Len()+len(chunk) > r.maxBuffered {
+		return fmt.Errorf("%w: %d bytes buffered, %d byte %s chunk exceeds limit of %d",
+			ErrValueBufferFull, r.buf.Len(), len(chunk), r.messageName, r.maxBuffered)
+	}
+	_, _ = r.buf.Write(chunk)
+	r.ready.Broadcast()
+	return nil
+}
+
+// Read implements io.Reader.
+func (r *ValueReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.buf.Len() == 0 && !r.ended && r.err == nil {
+		r.ready.Wait()
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.buf.Read(p)
+}
+
+// Ended reports whether the end of the value has been received. The value
+// may not yet have been fully read.
+func (r *ValueReader) Ended() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ended
+}
+
+// CloseWithError causes pending and future reads to fail with err, e.g. when
+// the module is interrupted before the value has ended. A nil err ends the
+// value as if an empty chunk had been received.
+func (r *ValueReader) CloseWithError(err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.ended = true
+	} else if r.err == nil {
+		r.err = err
+	}
+	r.ready.Broadcast()
+	return nil
+}
@@ -0,0 +1,192 @@
+// SPDX-FileCopyrightText: (C) 2025 Intel Corporation
+// SPDX-License-Identifier: Apache 2.0
+
+package serviceinfo_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fido-device-onboard/go-fdo/cbor"
+	"github.com/fido-device-onboard/go-fdo/serviceinfo"
+)
+
+func chunkBody(t *testing.T, chunks ...[]byte) io.Reader {
+	t.Helper()
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		if err := cbor.NewEncoder(&body).Encode(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &body
+}
+
+func TestValueReader(t *testing.T) {
+	t.Run("multiple chunks", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		for _, chunk := range []string{"Hello", ", ", "World!"} {
+			if ok, err := r.HandleInfo("data", chunkBody(t, []byte(chunk))); !ok || err != nil {
+				t.Fatalf("expected chunk to be handled, got ok=%t err=%v", ok, err)
+			}
+		}
+		if r.Ended() {
+			t.Fatal("expected value not to have ended before an empty chunk")
+		}
+		if ok, err := r.HandleInfo("data", chunkBody(t, []byte{})); !ok || err != nil {
+			t.Fatalf("expected end of value to be handled, got ok=%t err=%v", ok, err)
+		}
+		if !r.Ended() {
+			t.Fatal("expected value to have ended")
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "Hello, World!" {
+			t.Fatalf("expected %q, got %q", "Hello, World!", got)
+		}
+	})
+
+	t.Run("multiple chunks in one message", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		if ok, err := r.HandleInfo("data", chunkBody(t, []byte("abc"), []byte("def"), []byte{})); !ok || err != nil {
+			t.Fatalf("expected chunks to be handled, got ok=%t err=%v", ok, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "abcdef" {
+			t.Fatalf("expected %q, got %q", "abcdef", got)
+		}
+	})
+
+	t.Run("empty value", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte{})); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.Read(make([]byte, 8)); n != 0 || !errors.Is(err, io.EOF) {
+			t.Fatalf("expected EOF, got n=%d err=%v", n, err)
+		}
+	})
+
+	t.Run("other messages", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		body := chunkBody(t, []byte("not data"))
+		if ok, err := r.HandleInfo("length", body); ok || err != nil {
+			t.Fatalf("expected message not to be handled, got ok=%t err=%v", ok, err)
+		}
+		if body.(*bytes.Buffer).Len() == 0 {
+			t.Fatal("expected unhandled message body not to be consumed")
+		}
+	})
+
+	t.Run("chunk after end", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte("abc"), []byte{})); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte("def"))); err == nil {
+			t.Fatal("expected error for chunk after end of value")
+		}
+	})
+
+	t.Run("buffer limit", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 8)
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte("12345"))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte("6789"))); !errors.Is(err, serviceinfo.ErrValueBufferFull) {
+			t.Fatalf("expected ErrValueBufferFull, got %v", err)
+		}
+
+		// Reading frees space for more chunks
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte("6789"), []byte{})); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "6789" {
+			t.Fatalf("expected %q, got %q", "6789", got)
+		}
+	})
+
+	t.Run("invalid chunk", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		var body bytes.Buffer
+		if err := cbor.NewEncoder(&body).Encode(42); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.HandleInfo("data", &body); err == nil {
+			t.Fatal("expected error decoding chunk")
+		}
+		if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "data") {
+			t.Fatalf("expected decode error from read, got %v", err)
+		}
+	})
+
+	t.Run("concurrent read", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		result := make(chan []byte)
+		go func() {
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+			}
+			result <- got
+		}()
+		var want []byte
+		for i := 1; i <= 10; i++ {
+			chunk := bytes.Repeat([]byte{byte('a' + i)}, i*10)
+			want = append(want, chunk...)
+			if _, err := r.HandleInfo("data", chunkBody(t, chunk)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte{})); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-result:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("expected %d bytes, got %d", len(want), len(got))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("read did not complete")
+		}
+	})
+
+	t.Run("close with error", func(t *testing.T) {
+		r := serviceinfo.NewValueReader("data", 0)
+		errInterrupted := errors.New("interrupted")
+		done := make(chan error)
+		go func() {
+			_, err := io.ReadAll(r)
+			done <- err
+		}()
+		_ = r.CloseWithError(errInterrupted)
+		select {
+		case err := <-done:
+			if !errors.Is(err, errInterrupted) {
+				t.Fatalf("expected interrupted error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("read did not return")
+		}
+		if _, err := r.HandleInfo("data", chunkBody(t, []byte("abc"))); !errors.Is(err, errInterrupted) {
+			t.Fatalf("expected interrupted error for later chunk, got %v", err)
+		}
+	})
+}
@@ -1463,6 +1463,15 @@ func (s *TO2Server) ownerServiceInfo(ctx context.Context, msg io.Reader) (*owner
 		return nil, fmt.Errorf("error decoding TO2.DeviceServiceInfo request: %w", err)
 	}
 
+	// Make the negotiated cipher suite available to owner modules
+	_, sess, err := s.Session.XSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key exchange session: %w", err)
+	}
+	if cs, ok := sess.(interface{ CipherSuiteID() kex.CipherSuiteID }); ok {
+		ctx = context.WithValue(ctx, serviceinfo.CipherSuiteKey{}, cs.CipherSuiteID())
+	}
+
 	// Get next owner service info module
 	var moduleName string
 	var module serviceinfo.OwnerModule
@@ -1474,6 +1483,7 @@ func (s *TO2Server) ownerServiceInfo(ctx context.Context, msg io.Reader) (*owner
 	} else if err != nil {
 		return nil, fmt.Errorf("error getting devmod state: %w", err)
 	} else {
+		ctx = context.WithValue(ctx, serviceinfo.DevmodKey{}, devmod)
 		var err error
 		moduleName, module, err = s.Modules.Module(ctx)
 		if err != nil {